@@ -4,20 +4,29 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math/rand/v2"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"reflect"
+	"regexp"
 	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
 const (
@@ -30,71 +39,126 @@ const (
 )
 
 const (
-	exitOK         = 0
-	exitUsage      = 2
-	exitValidation = 3
-	exitNotFound   = 4
-	exitRuntime    = 10
-	lockWaitMax    = 15 * time.Second
-	lockWaitStep   = 150 * time.Millisecond
-	agentTimeout   = 15 * time.Minute
-	verifyTimeout  = 2 * time.Minute
-	notifyctlPath  = `C:\dev\_skills\notifyctl\tool\notifyctl.exe`
+	priorityLow  = "low"
+	priorityMed  = "med"
+	priorityHigh = "high"
+)
+
+const (
+	verifyModeFirst = "first"
+	verifyModeAll   = "all"
+)
+
+const (
+	exitOK                 = 0
+	exitUsage              = 2
+	exitValidation         = 3
+	exitNotFound           = 4
+	exitRuntime            = 10
+	lockWaitMax            = 15 * time.Second
+	lockWaitStep           = 150 * time.Millisecond
+	agentTimeout           = 15 * time.Minute
+	verifyTimeout          = 2 * time.Minute
+	runRetention           = 100
+	previousAttemptsBudget = 6000
+	promptBudget           = 200000
+	notifyctlPath          = `C:\dev\_skills\notifyctl\tool\notifyctl.exe`
 )
 
 type Task struct {
-	ID        string   `json:"id"`
-	Title     string   `json:"title"`
-	Spec      string   `json:"spec"`
-	Verify    []string `json:"verify"`
-	Status    string   `json:"status"`
-	ModelHint string   `json:"model_hint,omitempty"`
-	Priority  string   `json:"priority,omitempty"`
-	Attempts  int      `json:"attempts"`
-	LastError string   `json:"last_error,omitempty"`
-	Source    string   `json:"source,omitempty"`
-	CreatedAt string   `json:"created_at"`
-	UpdatedAt string   `json:"updated_at"`
+	ID         string          `json:"id"`
+	Title      string          `json:"title"`
+	Spec       string          `json:"spec"`
+	Verify     []VerifyCommand `json:"verify"`
+	Status     string          `json:"status"`
+	ModelHint  string          `json:"model_hint,omitempty"`
+	Priority   string          `json:"priority,omitempty"`
+	DependsOn  []string        `json:"depends_on,omitempty"`
+	VerifyMode string          `json:"verify_mode,omitempty"`
+	Runner     string          `json:"runner,omitempty"`
+	ArchivedAt string          `json:"archived_at,omitempty"`
+	Attempts   int             `json:"attempts"`
+	LastError  string          `json:"last_error,omitempty"`
+	Source     string          `json:"source,omitempty"`
+	CreatedAt  string          `json:"created_at"`
+	UpdatedAt  string          `json:"updated_at"`
+
+	// Branch, BranchTarget, and MergeStrategy record where the task's
+	// last --branch-mode attempt ran and how it lands on the target.
+	Branch        string `json:"branch,omitempty"`
+	BranchTarget  string `json:"branch_target,omitempty"`
+	MergeStrategy string `json:"merge_strategy,omitempty"`
 }
 
 type InstanceMeta struct {
 	Name      string `json:"name"`
 	Workdir   string `json:"workdir"`
 	CreatedAt string `json:"created_at"`
+	// LastTaskNumber is the highest task number ever removed or archived,
+	// so new IDs never reuse one that runs.jsonl may still reference.
+	LastTaskNumber int `json:"last_task_number,omitempty"`
 }
 
 type RunLog struct {
-	TaskID           string `json:"task_id"`
-	Status           string `json:"status"`
-	Provider         string `json:"provider,omitempty"`
-	Model            string `json:"model,omitempty"`
-	PrimaryProvider  string `json:"primary_provider,omitempty"`
-	PrimaryModel     string `json:"primary_model,omitempty"`
-	FallbackProvider string `json:"fallback_provider,omitempty"`
-	FallbackModel    string `json:"fallback_model,omitempty"`
-	FallbackReason   string `json:"fallback_reason,omitempty"`
-	StartedAt        string `json:"started_at"`
-	FinishedAt       string `json:"finished_at"`
-	Error            string `json:"error,omitempty"`
-	OutputTail       string `json:"output_tail,omitempty"`
-	VerifyFailed     string `json:"verify_failed,omitempty"`
-}
-
-type fallbackAttempt struct {
-	PrimaryProvider  string
-	PrimaryModel     string
-	FallbackProvider string
-	FallbackModel    string
-	Reason           string
-}
-
-type goResult struct {
-	Instance  string   `json:"instance"`
-	Processed int      `json:"processed"`
-	Done      int      `json:"done"`
-	Failed    int      `json:"failed"`
-	Blocked   int      `json:"blocked"`
-	TaskIDs   []string `json:"task_ids,omitempty"`
+	RunID            string         `json:"run_id,omitempty"`
+	TaskID           string         `json:"task_id"`
+	Status           string         `json:"status"`
+	Provider         string         `json:"provider,omitempty"`
+	Model            string         `json:"model,omitempty"`
+	PrimaryProvider  string         `json:"primary_provider,omitempty"`
+	PrimaryModel     string         `json:"primary_model,omitempty"`
+	FallbackProvider string         `json:"fallback_provider,omitempty"`
+	FallbackModel    string         `json:"fallback_model,omitempty"`
+	FallbackReason   string         `json:"fallback_reason,omitempty"`
+	Fallbacks        []fallbackHop  `json:"fallbacks,omitempty"`
+	StartedAt        string         `json:"started_at"`
+	FinishedAt       string         `json:"finished_at"`
+	Error            string         `json:"error,omitempty"`
+	OutputTail       string         `json:"output_tail,omitempty"`
+	VerifyFailed     string         `json:"verify_failed,omitempty"`
+	PromptPath       string         `json:"prompt_path,omitempty"`
+	OutputPath       string         `json:"output_path,omitempty"`
+	VerifyPath       string         `json:"verify_path,omitempty"`
+	VerifyResults    []VerifyResult `json:"verify_results,omitempty"`
+	DiffStat         string         `json:"diff_stat,omitempty"`
+	HeadBefore       string         `json:"head_before,omitempty"`
+	HeadAfter        string         `json:"head_after,omitempty"`
+	Commits          []runCommit    `json:"commits,omitempty"`
+	Reverted         []runCommit    `json:"reverted,omitempty"`
+	Files            []fileChange   `json:"files,omitempty"`
+	Dirty            bool           `json:"dirty"`
+	Branch           string         `json:"branch,omitempty"`
+	LandedFrom       string         `json:"landed_from,omitempty"`
+	LandedTo         string         `json:"landed_to,omitempty"`
+	CommitSHA        string         `json:"commit_sha,omitempty"`
+	RollbackRef      string         `json:"rollback_ref,omitempty"`
+	RollbackError    string         `json:"rollback_error,omitempty"`
+	Learnings        int            `json:"learnings,omitempty"`
+}
+
+// VerifyResult records the outcome of one verify command in a run.
+// ExitCode is -1 when the command timed out or could not be started.
+type VerifyResult struct {
+	Cmd        string `json:"cmd"`
+	ExitCode   int    `json:"exit_code"`
+	Duration   string `json:"duration"`
+	OutputTail string `json:"output_tail,omitempty"`
+}
+
+// fallbackHop records one fallback step taken after a provider failure.
+// Reason is the failure that triggered the hop; Error is set if the hop
+// itself failed.
+type fallbackHop struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"`
+	Reason   string `json:"reason"`
+	Error    string `json:"error,omitempty"`
+}
+
+type listResult struct {
+	Instance string `json:"instance"`
+	Count    int    `json:"count"`
+	Tasks    []Task `json:"tasks"`
 }
 
 type runsResult struct {
@@ -104,21 +168,25 @@ type runsResult struct {
 }
 
 type taskInputRaw struct {
-	Title     string          `json:"title"`
-	Spec      string          `json:"spec"`
-	Verify    json.RawMessage `json:"verify"`
-	ModelHint string          `json:"model_hint"`
-	Priority  string          `json:"priority"`
-	Source    string          `json:"source"`
+	Title      string          `json:"title"`
+	Spec       string          `json:"spec"`
+	Verify     json.RawMessage `json:"verify"`
+	ModelHint  string          `json:"model_hint"`
+	Priority   string          `json:"priority"`
+	DependsOn  []string        `json:"depends_on"`
+	VerifyMode string          `json:"verify_mode"`
+	Source     string          `json:"source"`
 }
 
 type taskInput struct {
-	Title     string
-	Spec      string
-	Verify    []string
-	ModelHint string
-	Priority  string
-	Source    string
+	Title      string
+	Spec       string
+	Verify     []VerifyCommand
+	ModelHint  string
+	Priority   string
+	DependsOn  []string
+	VerifyMode string
+	Source     string
 }
 
 type stringList []string
@@ -151,14 +219,36 @@ func main() {
 		err = cmdAddBatch(args)
 	case "status":
 		err = cmdStatus(args)
+	case "list":
+		err = cmdList(args)
 	case "show":
 		err = cmdShow(args)
+	case "edit":
+		err = cmdEdit(args)
+	case "rm":
+		err = cmdRm(args)
+	case "move":
+		err = cmdMove(args)
+	case "archive":
+		err = cmdArchive(args)
 	case "reset":
 		err = cmdReset(args)
 	case "skip":
 		err = cmdSkip(args)
 	case "runs":
 		err = cmdRuns(args)
+	case "logs":
+		err = cmdLogs(args)
+	case "prompt":
+		err = cmdPrompt(args)
+	case "learnings":
+		err = cmdLearnings(args)
+	case "unlock":
+		err = cmdUnlock(args)
+	case "revert":
+		err = cmdRevert(args)
+	case "schema":
+		err = cmdSchema(args)
 	case "go":
 		err = cmdGo(args)
 	case "help", "-h", "--help":
@@ -180,14 +270,25 @@ func printUsage() {
 
 Usage:
   obliviate init <instance> [--workdir .]
-  obliviate add <instance> --title "..." --spec "..." --verify "cmd" --model "hint" [--json]
+  obliviate add <instance> --title "..." --spec "..." --verify "cmd" --model "hint" [--depends-on OB-001] [--verify-mode all] [--json]
   obliviate add-batch <instance> [--file tasks.json|tasks.jsonl] [--stdin] [--json]
   obliviate status [instance] [--json]
+  obliviate list <instance> [--status s[,s]] [--model hint] [--source src] [--search text] [--sort file|priority|updated|attempts] [--format table|csv|json] [--json]
   obliviate show <instance> <task-id> [--json]
-  obliviate reset <instance> <task-id> [--json]
-  obliviate skip <instance> <task-id> [--reason "..." ] [--json]
+  obliviate edit <instance> <task-id> [--title ...] [--spec ...] [--verify cmd]... [--model hint] [--priority p] [--depends-on id]... [--verify-mode m] [--json]
+  obliviate rm <instance> <task-id>... [--force] [--json]
+  obliviate move <instance> <task-id> (--before|--after) <task-id> [--json]
+  obliviate archive <instance> [--status done[,blocked]] [--json]
+  obliviate reset <instance> <task-id|OB-010..OB-020>... [--status s] [--error-contains text] [--model hint] [--dry-run] [--json]
+  obliviate skip <instance> <task-id|OB-010..OB-020>... [--status s] [--error-contains text] [--model hint] [--reason "..."] [--dry-run] [--json]
+  obliviate unlock <instance> [--force] [--json]
+  obliviate revert <instance> <task-id> [--reason "..."] [--dry-run] [--json]
   obliviate runs <instance> [--limit N] [--task-id OB-001] [--json]
-  obliviate go <instance> [--limit N] [--dry-run] [--require-commit] [--agent-timeout 15m] [--cooldown 10s] [--max-attempts 2] [--max-transient-retries 3] [--no-notify] [--json]`)
+  obliviate logs <instance> <run-id|task-id> [--follow] [--prompt] [--json]
+  obliviate prompt <instance> <task-id> [--prompt-budget 200000|50000t] [--json]
+  obliviate learnings <instance> [--global] [--dedupe] [--prune] [--json]
+  obliviate schema events
+  obliviate go <instance> [--limit N] [--parallel N] [--dry-run] [--require-commit] [--agent-timeout 15m] [--verify-timeout 2m] [--verify-mode first|all] [--prompt-budget 200000] [--cooldown 10s] [--max-attempts 2] [--max-transient-retries 3] [--priority-floor high] [--keep-runs 100] [--wait] [--auto-commit] [--commit-template tmpl] [--allow-state-commit] [--rollback-on-fail] [--branch-mode task|instance] [--target-branch main] [--merge-strategy ff|merge] [--stream] [--no-notify] [--json]`)
 	fmt.Println(`
 Exit codes:
   0  success
@@ -267,11 +368,14 @@ func cmdAdd(args []string) error {
 	title := fs.String("title", "", "task title")
 	spec := fs.String("spec", "", "task spec")
 	modelHint := fs.String("model", "", "model hint (codex, claude-sonnet, claude-opus, ...) ")
-	priority := fs.String("priority", "med", "priority")
+	priority := fs.String("priority", priorityMed, "priority (low|med|high)")
 	source := fs.String("source", "agent", "source")
 	jsonOut := fs.Bool("json", false, "emit machine-readable JSON")
 	var verify stringList
 	fs.Var(&verify, "verify", "verification command (repeatable)")
+	var dependsOn stringList
+	fs.Var(&dependsOn, "depends-on", "task id that must be done first (repeatable)")
+	verifyMode := fs.String("verify-mode", "", "verify mode for this task (first|all); default follows go --verify-mode")
 	if err := fs.Parse(args[1:]); err != nil {
 		return err
 	}
@@ -281,14 +385,24 @@ func cmdAdd(args []string) error {
 	if strings.TrimSpace(*modelHint) == "" {
 		return errors.New("model_hint is required (use --model to specify)")
 	}
+	normalizedPriority, err := normalizePriority(*priority)
+	if err != nil {
+		return err
+	}
+	normalizedVerifyMode, err := normalizeVerifyMode(*verifyMode)
+	if err != nil {
+		return err
+	}
 
 	task := taskInput{
-		Title:     *title,
-		Spec:      *spec,
-		Verify:    verify,
-		ModelHint: *modelHint,
-		Priority:  *priority,
-		Source:    *source,
+		Title:      *title,
+		Spec:       *spec,
+		Verify:     verifyCommands(verify),
+		ModelHint:  *modelHint,
+		Priority:   normalizedPriority,
+		DependsOn:  normalizeDependsOn(dependsOn),
+		VerifyMode: normalizedVerifyMode,
+		Source:     *source,
 	}
 	added, err := addTasks(instance, []taskInput{task})
 	if err != nil {
@@ -373,6 +487,8 @@ func cmdStatus(args []string) error {
 			return err
 		}
 		summary := summarizeStatus(instance, tasks)
+		summary.Lock, _ = lockStatus(filepath.Join(instDir, tasksLockName))
+		summary.Runner = runnerStatus(instDir)
 		if *jsonOut {
 			return printJSON(summary)
 		}
@@ -416,7 +532,10 @@ func cmdStatus(args []string) error {
 		if err != nil {
 			return err
 		}
-		all = append(all, summarizeStatus(instance, tasks))
+		summary := summarizeStatus(instance, tasks)
+		summary.Lock, _ = lockStatus(filepath.Join(stateDir, instance, tasksLockName))
+		summary.Runner = runnerStatus(filepath.Join(stateDir, instance))
+		all = append(all, summary)
 	}
 	if *jsonOut {
 		return printJSON(all)
@@ -427,6 +546,133 @@ func cmdStatus(args []string) error {
 	return nil
 }
 
+func cmdList(args []string) error {
+	const usage = "usage: obliviate list <instance> [--status s[,s]] [--model hint] [--source src] [--search text] [--sort file|priority|updated|attempts] [--format table|csv|json] [--json]"
+	if len(args) < 1 {
+		return errors.New(usage)
+	}
+	instance := args[0]
+
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	filters := addTaskFilterFlags(fs)
+	source := fs.String("source", "", "match tasks with this source (case-insensitive)")
+	search := fs.String("search", "", "match tasks whose id, title, spec, or last_error contains this text (case-insensitive)")
+	sortBy := fs.String("sort", "file", "order by file, priority, updated, or attempts")
+	format := fs.String("format", "table", "output format: table, csv, or json")
+	jsonOut := fs.Bool("json", false, "emit machine-readable JSON (same as --format json)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New(usage)
+	}
+	if *jsonOut {
+		*format = "json"
+	}
+	switch *format {
+	case "table", "csv", "json":
+	default:
+		return fmt.Errorf("format must be one of table, csv, json (got %q)", *format)
+	}
+	sel, err := newTaskSelector(nil, filters)
+	if err != nil {
+		return err
+	}
+	sel.Source = strings.TrimSpace(*source)
+	sel.Search = strings.TrimSpace(*search)
+
+	instDir, err := resolveInstanceDir(instance)
+	if err != nil {
+		return err
+	}
+	all, err := loadTasks(filepath.Join(instDir, "tasks.jsonl"))
+	if err != nil {
+		return err
+	}
+	idxs, err := selectTasks(all, sel, instance)
+	if err != nil {
+		return err
+	}
+	tasks := make([]Task, 0, len(idxs))
+	for _, i := range idxs {
+		tasks = append(tasks, all[i])
+	}
+	if err := sortTasks(tasks, *sortBy); err != nil {
+		return err
+	}
+
+	switch *format {
+	case "json":
+		return printJSON(listResult{Instance: instance, Count: len(tasks), Tasks: tasks})
+	case "csv":
+		return writeTasksCSV(os.Stdout, tasks)
+	}
+	if len(tasks) == 0 {
+		fmt.Printf("[%s] no tasks matched\n", instance)
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tPRIORITY\tMODEL\tATTEMPTS\tTITLE\tLAST ERROR")
+	for _, t := range tasks {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			t.ID, t.Status, orDash(t.Priority), orDash(t.ModelHint), t.Attempts,
+			truncateCell(t.Title, 40), orDash(truncateCell(t.LastError, 60)))
+	}
+	return tw.Flush()
+}
+
+// sortTasks orders tasks in place. Ties keep file order.
+func sortTasks(tasks []Task, by string) error {
+	var less func(a, b Task) bool
+	switch by {
+	case "file", "":
+		return nil
+	case "priority":
+		less = func(a, b Task) bool { return priorityRank(a.Priority) > priorityRank(b.Priority) }
+	case "updated":
+		less = func(a, b Task) bool { return a.UpdatedAt > b.UpdatedAt }
+	case "attempts":
+		less = func(a, b Task) bool { return a.Attempts > b.Attempts }
+	default:
+		return fmt.Errorf("sort must be one of file, priority, updated, attempts (got %q)", by)
+	}
+	sort.SliceStable(tasks, func(i, j int) bool { return less(tasks[i], tasks[j]) })
+	return nil
+}
+
+func writeTasksCSV(w io.Writer, tasks []Task) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"id", "status", "priority", "model_hint", "attempts", "source", "updated_at", "title", "last_error"}); err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		row := []string{t.ID, t.Status, t.Priority, t.ModelHint, strconv.Itoa(t.Attempts), t.Source, t.UpdatedAt, t.Title, t.LastError}
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// truncateCell collapses whitespace so a value fits on one table row and
+// cuts it to n runes.
+func truncateCell(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n-3]) + "..."
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
 func cmdShow(args []string) error {
 	if len(args) < 2 {
 		return errors.New("usage: obliviate show <instance> <task-id> [--json]")
@@ -459,16 +705,61 @@ func cmdShow(args []string) error {
 	if idx < 0 {
 		return fmt.Errorf("task %q not found in instance %q", taskID, instance)
 	}
+	runs, err := loadRuns(filepath.Join(instDir, "runs.jsonl"))
+	if err != nil {
+		return err
+	}
+	detail := taskDetail{Task: tasks[idx], Commits: taskCommits(runs, taskID)}
 
 	if *jsonOut {
-		return printJSON(tasks[idx])
+		return printJSON(detail)
+	}
+	if err := printJSON(detail.Task); err != nil {
+		return err
+	}
+	if len(detail.Commits) > 0 {
+		fmt.Println("\ncommits:")
+		for _, c := range detail.Commits {
+			fmt.Printf("  %s %s (%s, run %s)\n", shortSHA(c.SHA), c.Subject, c.Status, c.RunID)
+		}
 	}
-	return printJSON(tasks[idx])
+	return nil
 }
 
-func cmdReset(args []string) error {
+// taskDetail is what show prints: the task's own fields plus every commit
+// its attempts created.
+type taskDetail struct {
+	Task
+	Commits []taskCommit `json:"commits,omitempty"`
+}
+
+type taskCommit struct {
+	SHA     string `json:"sha"`
+	Subject string `json:"subject"`
+	RunID   string `json:"run_id"`
+	Status  string `json:"status"`
+}
+
+// taskCommits lists the commits recorded by taskID's runs, oldest first.
+// Status is the run's outcome, so commits from failed attempts can be told
+// apart from the ones that landed.
+func taskCommits(runs []RunLog, taskID string) []taskCommit {
+	var out []taskCommit
+	for _, r := range runs {
+		if r.TaskID != taskID {
+			continue
+		}
+		for _, c := range r.Commits {
+			out = append(out, taskCommit{SHA: c.SHA, Subject: c.Subject, RunID: r.RunID, Status: r.Status})
+		}
+	}
+	return out
+}
+
+func cmdEdit(args []string) error {
+	const usage = "usage: obliviate edit <instance> <task-id> [--title ...] [--spec ...] [--verify cmd]... [--model hint] [--priority p] [--depends-on id]... [--verify-mode m] [--json]"
 	if len(args) < 2 {
-		return errors.New("usage: obliviate reset <instance> <task-id> [--json]")
+		return errors.New(usage)
 	}
 	instance := args[0]
 	taskID := strings.TrimSpace(args[1])
@@ -476,26 +767,60 @@ func cmdReset(args []string) error {
 		return errors.New("task-id is required")
 	}
 
-	fs := flag.NewFlagSet("reset", flag.ContinueOnError)
+	fs := flag.NewFlagSet("edit", flag.ContinueOnError)
+	title := fs.String("title", "", "new title")
+	spec := fs.String("spec", "", "new spec")
+	modelHint := fs.String("model", "", "new model hint")
+	priority := fs.String("priority", "", "new priority (low|med|high)")
+	verifyMode := fs.String("verify-mode", "", "new verify mode (first|all)")
+	source := fs.String("source", "", "new source")
 	jsonOut := fs.Bool("json", false, "emit machine-readable JSON")
+	var verify stringList
+	fs.Var(&verify, "verify", "verification command (repeatable; replaces the whole list)")
+	var dependsOn stringList
+	fs.Var(&dependsOn, "depends-on", "task id that must be done first (repeatable; replaces the whole list)")
 	if err := fs.Parse(args[2:]); err != nil {
 		return err
 	}
 	if fs.NArg() > 0 {
-		return errors.New("usage: obliviate reset <instance> <task-id> [--json]")
+		return errors.New(usage)
 	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	delete(set, "json")
 
 	instDir, err := resolveInstanceDir(instance)
 	if err != nil {
 		return err
 	}
+	tasksPath := filepath.Join(instDir, "tasks.jsonl")
+
+	// Without field flags the task is edited in $EDITOR. That happens
+	// outside the lock; the save below refuses if the task changed meanwhile.
+	var edited *taskInputRaw
+	var editedFrom string
+	if len(set) == 0 {
+		tasks, err := loadTasks(tasksPath)
+		if err != nil {
+			return err
+		}
+		idx := findTaskIndex(tasks, taskID)
+		if idx < 0 {
+			return fmt.Errorf("task %q not found in instance %q", taskID, instance)
+		}
+		raw, err := editTaskInEditor(tasks[idx])
+		if err != nil {
+			return err
+		}
+		edited, editedFrom = &raw, tasks[idx].UpdatedAt
+	}
+
 	lockRelease, err := acquireInstanceLock(instDir)
 	if err != nil {
 		return err
 	}
 	defer lockRelease()
 
-	tasksPath := filepath.Join(instDir, "tasks.jsonl")
 	tasks, err := loadTasks(tasksPath)
 	if err != nil {
 		return err
@@ -505,39 +830,191 @@ func cmdReset(args []string) error {
 		return fmt.Errorf("task %q not found in instance %q", taskID, instance)
 	}
 
-	tasks[idx].Status = statusTodo
-	tasks[idx].Attempts = 0
-	tasks[idx].LastError = ""
-	tasks[idx].UpdatedAt = nowUTC()
-	if err := saveTasks(tasksPath, tasks); err != nil {
+	raw := editableTask(tasks[idx])
+	if edited != nil {
+		if tasks[idx].UpdatedAt != editedFrom {
+			return fmt.Errorf("task %s changed while it was being edited; run edit again", taskID)
+		}
+		raw = *edited
+	} else {
+		if set["title"] {
+			raw.Title = *title
+		}
+		if set["spec"] {
+			raw.Spec = *spec
+		}
+		if set["verify"] {
+			raw.Verify, _ = json.Marshal([]string(verify))
+		}
+		if set["model"] {
+			raw.ModelHint = *modelHint
+		}
+		if set["priority"] {
+			raw.Priority = *priority
+		}
+		if set["depends-on"] {
+			raw.DependsOn = dependsOn
+		}
+		if set["verify-mode"] {
+			raw.VerifyMode = *verifyMode
+		}
+		if set["source"] {
+			raw.Source = *source
+		}
+	}
+	in, err := normalizeInput(raw)
+	if err != nil {
+		return err
+	}
+
+	before := tasks[idx]
+	t := &tasks[idx]
+	t.Title = strings.TrimSpace(in.Title)
+	t.Spec = strings.TrimSpace(in.Spec)
+	t.Verify = in.Verify
+	t.ModelHint = in.ModelHint
+	t.Priority = in.Priority
+	t.DependsOn = in.DependsOn
+	t.VerifyMode = in.VerifyMode
+	t.Source = in.Source
+	if err := dropArchivedDependencies(instDir, tasks); err != nil {
 		return err
 	}
+	changed := changedTaskFields(before, *t)
+	if len(changed) > 0 {
+		if err := validateDependencies(tasks); err != nil {
+			return err
+		}
+		t.UpdatedAt = nowUTC()
+		if err := saveTasks(tasksPath, tasks); err != nil {
+			return err
+		}
+	}
 
 	if *jsonOut {
-		return printJSON(tasks[idx])
+		return printJSON(*t)
+	}
+	if len(changed) == 0 {
+		fmt.Printf("no changes to %s\n", t.ID)
+		return nil
 	}
-	fmt.Printf("reset %s -> todo\n", tasks[idx].ID)
+	fmt.Printf("edited %s: %s\n", t.ID, strings.Join(changed, ", "))
 	return nil
 }
 
-func cmdSkip(args []string) error {
+// editableTask returns the user-editable fields of t in add-batch input
+// form, so edits go through the same validation as new tasks.
+func editableTask(t Task) taskInputRaw {
+	verify, _ := json.Marshal(t.Verify)
+	return taskInputRaw{
+		Title:      t.Title,
+		Spec:       t.Spec,
+		Verify:     verify,
+		ModelHint:  t.ModelHint,
+		Priority:   t.Priority,
+		DependsOn:  t.DependsOn,
+		VerifyMode: t.VerifyMode,
+		Source:     t.Source,
+	}
+}
+
+// changedTaskFields lists the editable fields whose stored JSON differs
+// between a and b.
+func changedTaskFields(a, b Task) []string {
+	var ja, jb map[string]json.RawMessage
+	ba, _ := json.Marshal(a)
+	bb, _ := json.Marshal(b)
+	_ = json.Unmarshal(ba, &ja)
+	_ = json.Unmarshal(bb, &jb)
+	var changed []string
+	for _, name := range []string{"title", "spec", "verify", "model_hint", "priority", "depends_on", "verify_mode", "source"} {
+		if !bytes.Equal(ja[name], jb[name]) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// editTaskInEditor writes the task's editable fields to a temp file, opens
+// $VISUAL or $EDITOR on it, and parses the result.
+func editTaskInEditor(t Task) (taskInputRaw, error) {
+	editor := strings.TrimSpace(os.Getenv("VISUAL"))
+	if editor == "" {
+		editor = strings.TrimSpace(os.Getenv("EDITOR"))
+	}
+	if editor == "" {
+		editor = "vi"
+		if runtime.GOOS == "windows" {
+			editor = "notepad"
+		}
+	}
+
+	f, err := os.CreateTemp("", "obliviate-"+t.ID+"-*.json")
+	if err != nil {
+		return taskInputRaw{}, err
+	}
+	path := f.Name()
+	defer os.Remove(path)
+	b, _ := json.MarshalIndent(editableTask(t), "", "  ")
+	_, werr := f.Write(append(b, '\n'))
+	if cerr := f.Close(); werr == nil {
+		werr = cerr
+	}
+	if werr != nil {
+		return taskInputRaw{}, werr
+	}
+
+	parts := strings.Fields(editor)
+	cmd := exec.Command(parts[0], append(parts[1:], path)...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return taskInputRaw{}, fmt.Errorf("editor %q failed: %w", editor, err)
+	}
+	b, err = os.ReadFile(path)
+	if err != nil {
+		return taskInputRaw{}, err
+	}
+	var raw taskInputRaw
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return taskInputRaw{}, fmt.Errorf("edited task must be valid JSON: %w", err)
+	}
+	return raw, nil
+}
+
+const archiveFileName = "tasks.archive.jsonl"
+
+// splitTaskArgs separates leading task IDs from the flags that follow.
+func splitTaskArgs(args []string) (ids, rest []string) {
+	for i, a := range args {
+		if strings.HasPrefix(a, "-") {
+			return ids, args[i:]
+		}
+		if a = strings.TrimSpace(a); a != "" {
+			ids = append(ids, a)
+		}
+	}
+	return ids, nil
+}
+
+func cmdRm(args []string) error {
+	const usage = "usage: obliviate rm <instance> <task-id>... [--force] [--json]"
 	if len(args) < 2 {
-		return errors.New("usage: obliviate skip <instance> <task-id> [--reason \"...\"] [--json]")
+		return errors.New(usage)
 	}
 	instance := args[0]
-	taskID := strings.TrimSpace(args[1])
-	if taskID == "" {
+	ids, flagArgs := splitTaskArgs(args[1:])
+	if len(ids) == 0 {
 		return errors.New("task-id is required")
 	}
 
-	fs := flag.NewFlagSet("skip", flag.ContinueOnError)
-	reason := fs.String("reason", "", "human-readable skip reason")
+	fs := flag.NewFlagSet("rm", flag.ContinueOnError)
+	force := fs.Bool("force", false, "remove in_progress tasks and drop them from other tasks' depends_on")
 	jsonOut := fs.Bool("json", false, "emit machine-readable JSON")
-	if err := fs.Parse(args[2:]); err != nil {
+	if err := fs.Parse(flagArgs); err != nil {
 		return err
 	}
 	if fs.NArg() > 0 {
-		return errors.New("usage: obliviate skip <instance> <task-id> [--reason \"...\"] [--json]")
+		return errors.New(usage)
 	}
 
 	instDir, err := resolveInstanceDir(instance)
@@ -555,1124 +1032,5384 @@ func cmdSkip(args []string) error {
 	if err != nil {
 		return err
 	}
-	idx := findTaskIndex(tasks, taskID)
-	if idx < 0 {
-		return fmt.Errorf("task %q not found in instance %q", taskID, instance)
+	remove := map[string]bool{}
+	for _, id := range ids {
+		idx := findTaskIndex(tasks, id)
+		if idx < 0 {
+			return fmt.Errorf("task %q not found in instance %q", id, instance)
+		}
+		if tasks[idx].Status == statusInProgress && !*force {
+			return fmt.Errorf("task %s is in_progress; wait for its attempt to finish or use --force", id)
+		}
+		remove[id] = true
 	}
 
-	reasonText := strings.TrimSpace(*reason)
-	if reasonText == "" {
-		reasonText = "manually skipped"
+	kept := make([]Task, 0, len(tasks))
+	var removed []Task
+	for _, t := range tasks {
+		if remove[t.ID] {
+			removed = append(removed, t)
+		} else {
+			kept = append(kept, t)
+		}
 	}
-	tasks[idx].Status = statusBlocked
-	tasks[idx].LastError = "skipped: " + reasonText
-	tasks[idx].UpdatedAt = nowUTC()
-	if err := saveTasks(tasksPath, tasks); err != nil {
-		return err
+	for i := range kept {
+		deps := kept[i].DependsOn[:0:0]
+		for _, dep := range kept[i].DependsOn {
+			if !remove[dep] {
+				deps = append(deps, dep)
+				continue
+			}
+			if !*force {
+				return fmt.Errorf("cannot remove %s: %s depends on it (use --force to drop the dependency)", dep, kept[i].ID)
+			}
+		}
+		if len(deps) != len(kept[i].DependsOn) {
+			kept[i].DependsOn = deps
+			kept[i].UpdatedAt = nowUTC()
+		}
 	}
 
+	if err := recordRemovedTaskNumbers(instDir, removed); err != nil {
+		return err
+	}
+	if err := saveTasks(tasksPath, kept); err != nil {
+		return err
+	}
 	if *jsonOut {
-		return printJSON(tasks[idx])
+		return printJSON(removed)
+	}
+	for _, t := range removed {
+		fmt.Printf("removed %s (%s)\n", t.ID, t.Title)
 	}
-	fmt.Printf("skipped %s -> blocked (%s)\n", tasks[idx].ID, reasonText)
 	return nil
 }
 
-func cmdRuns(args []string) error {
-	if len(args) < 1 {
-		return errors.New("usage: obliviate runs <instance> [--limit N] [--task-id OB-001] [--json]")
+func cmdMove(args []string) error {
+	const usage = "usage: obliviate move <instance> <task-id> (--before|--after) <task-id> [--json]"
+	if len(args) < 2 {
+		return errors.New(usage)
 	}
 	instance := args[0]
+	taskID := strings.TrimSpace(args[1])
+	if taskID == "" {
+		return errors.New("task-id is required")
+	}
 
-	fs := flag.NewFlagSet("runs", flag.ContinueOnError)
-	limit := fs.Int("limit", 20, "number of most recent runs to return (0 = all)")
-	taskID := fs.String("task-id", "", "filter by task id")
-	jsonOut := fs.Bool("json", false, "emit machine-readable JSON")
-	if err := fs.Parse(args[1:]); err != nil {
+	fs := flag.NewFlagSet("move", flag.ContinueOnError)
+	before := fs.String("before", "", "place the task just before this task")
+	after := fs.String("after", "", "place the task just after this task")
+	jsonOut := fs.Bool("json", false, "emit the new task order as JSON")
+	if err := fs.Parse(args[2:]); err != nil {
 		return err
 	}
 	if fs.NArg() > 0 {
-		return errors.New("usage: obliviate runs <instance> [--limit N] [--task-id OB-001] [--json]")
+		return errors.New(usage)
 	}
-	if *limit < 0 {
-		return errors.New("limit must be >= 0")
+	anchor := strings.TrimSpace(*before)
+	if (anchor == "") == (strings.TrimSpace(*after) == "") {
+		return errors.New("exactly one of --before or --after is required")
+	}
+	if anchor == "" {
+		anchor = strings.TrimSpace(*after)
+	}
+	if anchor == taskID {
+		return errors.New("move target must be a different task")
 	}
 
 	instDir, err := resolveInstanceDir(instance)
 	if err != nil {
 		return err
 	}
-	p := filepath.Join(instDir, "runs.jsonl")
-	runs, err := loadRuns(p)
+	lockRelease, err := acquireInstanceLock(instDir)
 	if err != nil {
 		return err
 	}
-	filter := strings.TrimSpace(*taskID)
-	if filter != "" {
-		filtered := make([]RunLog, 0, len(runs))
-		for _, r := range runs {
-			if r.TaskID == filter {
-				filtered = append(filtered, r)
-			}
-		}
-		runs = filtered
+	defer lockRelease()
+
+	tasksPath := filepath.Join(instDir, "tasks.jsonl")
+	tasks, err := loadTasks(tasksPath)
+	if err != nil {
+		return err
 	}
-	if *limit > 0 && len(runs) > *limit {
-		runs = runs[len(runs)-*limit:]
+	idx := findTaskIndex(tasks, taskID)
+	if idx < 0 {
+		return fmt.Errorf("task %q not found in instance %q", taskID, instance)
 	}
-	if *jsonOut {
-		return printJSON(runsResult{
-			Instance: instance,
-			Count:    len(runs),
-			Runs:     runs,
-		})
+	if findTaskIndex(tasks, anchor) < 0 {
+		return fmt.Errorf("task %q not found in instance %q", anchor, instance)
 	}
-	if len(runs) == 0 {
-		fmt.Printf("[%s] no runs found\n", instance)
-		return nil
+
+	moved := tasks[idx]
+	tasks = append(tasks[:idx], tasks[idx+1:]...)
+	at := findTaskIndex(tasks, anchor)
+	if *before == "" {
+		at++
 	}
-	for _, r := range runs {
-		fmt.Printf("%s %s %s %s/%s\n", r.FinishedAt, r.TaskID, r.Status, r.Provider, r.Model)
+	tasks = append(tasks[:at], append([]Task{moved}, tasks[at:]...)...)
+	if err := saveTasks(tasksPath, tasks); err != nil {
+		return err
+	}
+
+	if *jsonOut {
+		order := make([]string, len(tasks))
+		for i, t := range tasks {
+			order[i] = t.ID
+		}
+		return printJSON(order)
+	}
+	where := "before"
+	if *before == "" {
+		where = "after"
 	}
+	fmt.Printf("moved %s %s %s\n", taskID, where, anchor)
 	return nil
 }
 
-func cmdGo(args []string) error {
+// writeArchive adds batch to the archive file in one atomic rewrite. Entries
+// already archived under the same IDs are replaced, so rerunning archive
+// after a crash between this write and saving tasks.jsonl leaves no
+// duplicates.
+func writeArchive(path string, batch []Task) error {
+	existing, err := loadTasks(path)
+	if err != nil {
+		return err
+	}
+	ids := make(map[string]bool, len(batch))
+	for _, t := range batch {
+		ids[t.ID] = true
+	}
+	all := make([]Task, 0, len(existing)+len(batch))
+	for _, t := range existing {
+		if !ids[t.ID] {
+			all = append(all, t)
+		}
+	}
+	return saveTasks(path, append(all, batch...))
+}
+
+func cmdArchive(args []string) error {
+	const usage = "usage: obliviate archive <instance> [--status done[,blocked]] [--json]"
 	if len(args) < 1 {
-		return errors.New("usage: obliviate go <instance> [--limit N] [--dry-run] [--require-commit] [--agent-timeout 15m] [--cooldown 10s] [--max-attempts 2] [--max-transient-retries 3]")
+		return errors.New(usage)
 	}
 	instance := args[0]
 
-	fs := flag.NewFlagSet("go", flag.ContinueOnError)
-	limit := fs.Int("limit", 0, "max tasks to process (0 = all)")
-	dryRun := fs.Bool("dry-run", false, "show what would run")
+	fs := flag.NewFlagSet("archive", flag.ContinueOnError)
+	statusList := fs.String("status", statusDone, "comma-separated statuses to archive (done, blocked, failed, todo)")
 	jsonOut := fs.Bool("json", false, "emit machine-readable JSON")
-	requireCommit := fs.Bool("require-commit", false, "require each successful task to create a new git commit")
-	flagAgentTimeout := fs.Duration("agent-timeout", agentTimeout, "override agent subprocess timeout")
-	cooldown := fs.Duration("cooldown", 10*time.Second, "sleep between tasks")
-	flagMaxAttempts := fs.Int("max-attempts", maxAttempts, "override max attempts per task")
-	maxTransientRetries := fs.Int("max-transient-retries", 3, "max backoff retries for transient provider failures per task")
-	noNotify := fs.Bool("no-notify", false, "disable notifyctl event emission on completion")
 	if err := fs.Parse(args[1:]); err != nil {
 		return err
 	}
+	if fs.NArg() > 0 {
+		return errors.New(usage)
+	}
+	statuses := map[string]bool{}
+	for _, s := range strings.Split(*statusList, ",") {
+		s = strings.ToLower(strings.TrimSpace(s))
+		switch s {
+		case statusDone, statusBlocked, statusFailed, statusTodo:
+			statuses[s] = true
+		default:
+			return fmt.Errorf("status must be one of done, blocked, failed, todo (got %q)", s)
+		}
+	}
 
 	instDir, err := resolveInstanceDir(instance)
 	if err != nil {
 		return err
 	}
-	meta, err := loadInstanceMeta(filepath.Join(instDir, "instance.json"))
+	lockRelease, err := acquireInstanceLock(instDir)
 	if err != nil {
 		return err
 	}
+	defer lockRelease()
 
-	home := filepath.Dir(filepath.Dir(instDir))
-	projectRoot := filepath.Dir(home)
-	workdir := resolveWorkdir(projectRoot, meta.Workdir)
 	tasksPath := filepath.Join(instDir, "tasks.jsonl")
-	runsPath := filepath.Join(instDir, "runs.jsonl")
-
-	// Set up signal-aware context for graceful shutdown.
-	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
-	defer stop()
-
-	// --- Stale in_progress recovery (under lock) ---
-	{
-		lockRelease, err := acquireInstanceLock(instDir)
-		if err != nil {
-			return err
-		}
-		tasks, err := loadTasks(tasksPath)
-		if err != nil {
-			lockRelease()
-			return err
-		}
-		recovered := false
-		for i := range tasks {
-			if tasks[i].Status == statusInProgress {
-				if !*jsonOut {
-					fmt.Printf("recovered stale in_progress task %s -> todo\n", tasks[i].ID)
-				}
-				tasks[i].Status = statusTodo
-				tasks[i].LastError = ""
-				tasks[i].UpdatedAt = nowUTC()
-				recovered = true
-			}
-		}
-		if recovered {
-			if err := saveTasks(tasksPath, tasks); err != nil {
-				lockRelease()
-				return err
-			}
+	tasks, err := loadTasks(tasksPath)
+	if err != nil {
+		return err
+	}
+	now := nowUTC()
+	archivedStatus := map[string]string{}
+	var kept, archived []Task
+	for _, t := range tasks {
+		if statuses[t.Status] {
+			t.ArchivedAt = now
+			archived = append(archived, t)
+			archivedStatus[t.ID] = t.Status
+		} else {
+			kept = append(kept, t)
 		}
-		lockRelease()
 	}
-
-	// Startup banner: count remaining work and print immediately.
-	{
-		tasks, err := loadTasks(tasksPath)
-		if err == nil {
-			todo, failed, done, blocked := 0, 0, 0, 0
-			for _, t := range tasks {
-				switch t.Status {
-				case statusTodo:
-					todo++
-				case statusFailed:
-					failed++
-				case statusDone:
-					done++
-				case statusBlocked:
-					blocked++
-				}
+	// Dependencies on archived done tasks are satisfied and can go; any
+	// other dependency on an archived task would strand its dependent.
+	for i := range kept {
+		deps := kept[i].DependsOn[:0:0]
+		for _, dep := range kept[i].DependsOn {
+			status, ok := archivedStatus[dep]
+			if !ok {
+				deps = append(deps, dep)
+				continue
 			}
-			remaining := todo + failed
-			if *jsonOut {
-				printJSON(map[string]any{
-					"event":     "started",
-					"instance":  instance,
-					"total":     len(tasks),
-					"remaining": remaining,
-					"done":      done,
-					"blocked":   blocked,
-					"timeout":   flagAgentTimeout.String(),
-					"cooldown":  cooldown.String(),
-				})
-			} else {
-				fmt.Printf("starting %s: %d remaining (%d todo, %d failed-retry), %d done, %d blocked, timeout=%s cooldown=%s\n",
-					instance, remaining, todo, failed, done, blocked, flagAgentTimeout.String(), cooldown.String())
+			if status != statusDone {
+				return fmt.Errorf("cannot archive %s (%s): %s depends on it", dep, status, kept[i].ID)
 			}
 		}
-	}
-
-	processed := 0
-	doneCount := 0
-	failedCount := 0
-	blockedCount := 0
-	taskIDs := make([]string, 0)
-	for {
-		// Check for shutdown between tasks.
-		if ctx.Err() != nil {
-			if !*jsonOut {
-				fmt.Println("interrupted, stopping loop")
-			}
-			break
+		if len(deps) != len(kept[i].DependsOn) {
+			kept[i].UpdatedAt = now
 		}
+		kept[i].DependsOn = deps
+	}
 
-		if *limit > 0 && processed >= *limit {
-			break
+	if len(archived) > 0 {
+		if err := writeArchive(filepath.Join(instDir, archiveFileName), archived); err != nil {
+			return err
 		}
-
-		// Acquire lock, reload tasks, find next runnable.
-		lockRelease, err := acquireInstanceLock(instDir)
-		if err != nil {
+		if err := recordRemovedTaskNumbers(instDir, archived); err != nil {
 			return err
 		}
-		tasks, err := loadTasks(tasksPath)
-		if err != nil {
-			lockRelease()
+		if err := saveTasks(tasksPath, kept); err != nil {
 			return err
 		}
+	}
 
-		idx := nextRunnableTaskIndex(tasks, *flagMaxAttempts)
-		if idx < 0 {
-			lockRelease()
-			break
-		}
-		t := tasks[idx]
+	if *jsonOut {
+		return printJSON(struct {
+			Instance string `json:"instance"`
+			Archived []Task `json:"archived"`
+			Live     int    `json:"live"`
+		}{Instance: instance, Archived: archived, Live: len(kept)})
+	}
+	fmt.Printf("archived %d task(s) to %s; %d live task(s) remain\n", len(archived), archiveFileName, len(kept))
+	return nil
+}
 
-		if *dryRun {
-			if !*jsonOut {
-				fmt.Printf("would run %s (%s)\n", t.ID, t.Title)
-			}
-			processed++
-			tasks[idx].Status = statusDone
-			taskIDs = append(taskIDs, t.ID)
-			_ = saveTasks(tasksPath, tasks)
-			lockRelease()
-			continue
-		}
+// taskSelector picks tasks for bulk commands. IDs and ranges are unioned;
+// the filters then narrow that set, or the whole queue when no IDs or
+// ranges were given.
+type taskSelector struct {
+	IDs           []string
+	Ranges        [][2]int
+	Statuses      map[string]bool
+	ErrorContains string
+	Model         string
+	Source        string
+	Search        string
+}
 
-		// Mark in_progress and save while locked.
-		start := nowUTC()
-		tasks[idx].Status = statusInProgress
-		tasks[idx].UpdatedAt = start
-		if err := saveTasks(tasksPath, tasks); err != nil {
-			lockRelease()
-			return err
-		}
-		// Release lock during agent execution.
-		lockRelease()
+type taskFilterFlags struct {
+	status        *string
+	errorContains *string
+	model         *string
+}
 
-		primaryProvider, primaryModel := routeModel(t.ModelHint)
-		if *jsonOut {
-			printJSON(map[string]any{
-				"event":    "task_start",
-				"task_id":  t.ID,
-				"title":    t.Title,
-				"provider": primaryProvider,
-				"model":    primaryModel,
-				"attempt":  t.Attempts + 1,
-			})
-		} else {
-			fmt.Printf("%s starting %s (%s) [%s/%s] attempt=%d\n", t.ID, t.Title, t.ModelHint, primaryProvider, primaryModel, t.Attempts+1)
-		}
+func addTaskFilterFlags(fs *flag.FlagSet) taskFilterFlags {
+	return taskFilterFlags{
+		status:        fs.String("status", "", "comma-separated statuses to match (todo, in_progress, done, blocked, failed)"),
+		errorContains: fs.String("error-contains", "", "match tasks whose last_error contains this text (case-insensitive)"),
+		model:         fs.String("model", "", "match tasks with this model hint (case-insensitive)"),
+	}
+}
 
-		prompt, err := buildExecutionPrompt(home, instance, t)
-		if err != nil {
-			return err
+// newTaskSelector parses task IDs, OB-010..OB-020 ranges, and filter flags.
+func newTaskSelector(refs []string, f taskFilterFlags) (taskSelector, error) {
+	sel := taskSelector{
+		ErrorContains: strings.TrimSpace(*f.errorContains),
+		Model:         strings.TrimSpace(*f.model),
+	}
+	for _, ref := range refs {
+		lo, hi, isRange := strings.Cut(ref, "..")
+		if !isRange {
+			sel.IDs = append(sel.IDs, ref)
+			continue
 		}
-
-		headBefore := ""
-		headBeforeErr := error(nil)
-		if *requireCommit {
-			headBefore, headBeforeErr = gitHead(workdir)
+		a, okA := taskNumber(strings.TrimSpace(lo))
+		b, okB := taskNumber(strings.TrimSpace(hi))
+		if !okA || !okB || a > b {
+			return taskSelector{}, fmt.Errorf("task range %q must be OB-<n>..OB-<m> with n <= m", ref)
+		}
+		sel.Ranges = append(sel.Ranges, [2]int{a, b})
+	}
+	if list := strings.TrimSpace(*f.status); list != "" {
+		sel.Statuses = map[string]bool{}
+		for _, s := range strings.Split(list, ",") {
+			s = strings.ToLower(strings.TrimSpace(s))
+			switch s {
+			case statusTodo, statusInProgress, statusDone, statusBlocked, statusFailed:
+				sel.Statuses[s] = true
+			default:
+				return taskSelector{}, fmt.Errorf("status must be one of todo, in_progress, done, blocked, failed (got %q)", s)
+			}
 		}
+	}
+	return sel, nil
+}
 
-		// Transient retry loop.
-		var provider, model, agentOut string
-		var execErr error
-		var fb *fallbackAttempt
-		transientRetries := 0
-		for {
-			provider, model, agentOut, execErr, fb = runAgentWithFallback(ctx, primaryProvider, primaryModel, workdir, prompt, *flagAgentTimeout)
+func (s taskSelector) empty() bool {
+	return len(s.IDs) == 0 && len(s.Ranges) == 0 && !s.filtered()
+}
 
-			// If interrupted during agent execution, bail out.
-			if ctx.Err() != nil {
-				break
-			}
+// single reports whether the selector names exactly one task and nothing
+// else, the pre-bulk form whose --json output is a single object.
+func (s taskSelector) single() bool {
+	return len(s.IDs) == 1 && len(s.Ranges) == 0 && !s.filtered()
+}
 
-			if execErr != nil {
-				reason := classifyProviderFailure(execErr, agentOut)
-				if isTransientFailure(reason) && transientRetries < *maxTransientRetries {
-					transientRetries++
-					backoff := 30 * time.Second * (1 << (transientRetries - 1))
-					if backoff > 120*time.Second {
-						backoff = 120 * time.Second
-					}
-					if !*jsonOut {
-						fmt.Printf("%s transient failure (%s), retry %d/%d after %s\n", t.ID, reason, transientRetries, *maxTransientRetries, backoff)
-					}
-					select {
-					case <-time.After(backoff):
-						continue
-					case <-ctx.Done():
-						break
-					}
-					if ctx.Err() != nil {
-						break
-					}
-				}
-			}
-			break
-		}
+func (s taskSelector) filtered() bool {
+	return len(s.Statuses) > 0 || s.ErrorContains != "" || s.Model != "" || s.Source != "" || s.Search != ""
+}
 
-		// Re-acquire lock to update task state.
-		lockRelease, err = acquireInstanceLock(instDir)
-		if err != nil {
-			return err
+// selectTasks returns the indexes of matching tasks in file order. Every
+// explicit ID must exist; ranges only cover the tasks that do.
+func selectTasks(tasks []Task, sel taskSelector, instance string) ([]int, error) {
+	named := map[string]bool{}
+	for _, id := range sel.IDs {
+		if findTaskIndex(tasks, id) < 0 {
+			return nil, fmt.Errorf("task %q not found in instance %q", id, instance)
 		}
-		// Reload tasks under lock (another process may have modified them).
-		tasks, err = loadTasks(tasksPath)
-		if err != nil {
-			lockRelease()
-			return err
-		}
-		// Re-find the task (index may have shifted).
-		idx = findTaskIndex(tasks, t.ID)
-		if idx < 0 {
-			// Task was removed while we were running; skip.
-			lockRelease()
-			processed++
-			taskIDs = append(taskIDs, t.ID)
+		named[id] = true
+	}
+	byRef := len(sel.IDs) > 0 || len(sel.Ranges) > 0
+	needle := strings.ToLower(sel.ErrorContains)
+	search := strings.ToLower(sel.Search)
+	var out []int
+	for i, t := range tasks {
+		if byRef && !named[t.ID] && !inTaskRanges(t.ID, sel.Ranges) {
 			continue
 		}
-
-		// If interrupted, reset task to todo and exit.
-		if ctx.Err() != nil {
-			tasks[idx].Status = statusTodo
-			tasks[idx].UpdatedAt = nowUTC()
-			_ = saveTasks(tasksPath, tasks)
-			lockRelease()
-			if !*jsonOut {
-				fmt.Printf("%s interrupted, reset to todo\n", t.ID)
-			}
-			break
-		}
-
-		run := RunLog{
-			TaskID:          t.ID,
-			Provider:        provider,
-			Model:           model,
-			PrimaryProvider: primaryProvider,
-			PrimaryModel:    primaryModel,
-			StartedAt:       start,
-			FinishedAt:      nowUTC(),
-			OutputTail:      tail(agentOut, 1000),
-		}
-		if fb != nil {
-			run.FallbackProvider = fb.FallbackProvider
-			run.FallbackModel = fb.FallbackModel
-			run.FallbackReason = fb.Reason
-		}
-
-		if execErr == nil {
-			var failedCmd string
-			failedOutput := ""
-			for _, v := range t.Verify {
-				out, verifyErr := runVerify(workdir, v, verifyTimeout)
-				if verifyErr != nil {
-					failedCmd = v
-					failedOutput = out + "\n" + verifyErr.Error()
-					break
-				}
-			}
-			if failedCmd != "" {
-				execErr = fmt.Errorf("verify failed: %s", failedCmd)
-				run.VerifyFailed = failedCmd
-				run.OutputTail = tail(run.OutputTail+"\n"+failedOutput, 1000)
-			}
+		if sel.Statuses != nil && !sel.Statuses[t.Status] {
+			continue
 		}
-
-		if execErr == nil && *requireCommit {
-			if headBeforeErr != nil {
-				execErr = fmt.Errorf("require-commit: resolve pre-task git head: %w", headBeforeErr)
-			} else {
-				headAfter, headAfterErr := gitHead(workdir)
-				if headAfterErr != nil {
-					execErr = fmt.Errorf("require-commit: resolve post-task git head: %w", headAfterErr)
-				} else if headAfter == headBefore {
-					execErr = errors.New("require-commit enabled: no new commit created")
-				}
-			}
+		if needle != "" && !strings.Contains(strings.ToLower(t.LastError), needle) {
+			continue
 		}
-
-		if execErr != nil {
-			tasks[idx].Attempts++
-			tasks[idx].LastError = execErr.Error()
-			tasks[idx].UpdatedAt = nowUTC()
-			if tasks[idx].Attempts >= *flagMaxAttempts {
-				tasks[idx].Status = statusBlocked
-				blockedCount++
-			} else {
-				tasks[idx].Status = statusFailed
-				failedCount++
-			}
-			run.Status = tasks[idx].Status
-			run.Error = execErr.Error()
-			if !*jsonOut {
-				fmt.Printf("%s %s -> %s: %s\n", t.ID, t.Title, tasks[idx].Status, execErr.Error())
-			}
-		} else {
-			tasks[idx].Status = statusDone
-			tasks[idx].UpdatedAt = nowUTC()
-			tasks[idx].LastError = ""
-			run.Status = statusDone
-			_ = appendLine(filepath.Join(instDir, "learnings.md"), fmt.Sprintf("- [%s] %s completed (%s)\n", nowUTC(), t.ID, t.Title))
-			doneCount++
-			if !*jsonOut {
-				fmt.Printf("%s %s -> done\n", t.ID, t.Title)
-			}
+		if sel.Model != "" && !strings.EqualFold(t.ModelHint, sel.Model) {
+			continue
 		}
-
-		if err := appendJSONLine(runsPath, run); err != nil {
-			lockRelease()
-			return err
+		if sel.Source != "" && !strings.EqualFold(t.Source, sel.Source) {
+			continue
 		}
-		if err := saveTasks(tasksPath, tasks); err != nil {
-			lockRelease()
-			return err
+		if search != "" && !taskContains(t, search) {
+			continue
 		}
-		lockRelease()
-
-		processed++
-		taskIDs = append(taskIDs, t.ID)
+		out = append(out, i)
+	}
+	return out, nil
+}
 
-		// Cooldown between tasks.
-		if *cooldown > 0 {
-			select {
-			case <-time.After(*cooldown):
-			case <-ctx.Done():
-			}
+// taskContains reports whether lowered text occurs in the task's ID,
+// title, spec, or last error.
+func taskContains(t Task, text string) bool {
+	for _, field := range []string{t.ID, t.Title, t.Spec, t.LastError} {
+		if strings.Contains(strings.ToLower(field), text) {
+			return true
 		}
 	}
+	return false
+}
 
-	if err := appendCycleSummaryLine(filepath.Join(instDir, "cycle.log"), instance, processed, doneCount, failedCount, blockedCount, taskIDs, *dryRun); err != nil {
-		return err
+func inTaskRanges(id string, ranges [][2]int) bool {
+	n, ok := taskNumber(id)
+	if !ok {
+		return false
 	}
-
-	if !*noNotify && !*dryRun && processed > 0 {
-		if err := emitNotification(instance, processed, doneCount, failedCount, blockedCount); err != nil {
-			// Non-fatal: log but don't fail the run.
-			if *jsonOut {
-				printJSON(map[string]any{"event": "notify_error", "error": err.Error()})
-			} else {
-				fmt.Fprintf(os.Stderr, "warning: notifyctl: %v\n", err)
-			}
+	for _, r := range ranges {
+		if n >= r[0] && n <= r[1] {
+			return true
 		}
 	}
-
-	if *jsonOut {
-		return printJSON(goResult{
-			Instance:  instance,
-			Processed: processed,
-			Done:      doneCount,
-			Failed:    failedCount,
-			Blocked:   blockedCount,
-			TaskIDs:   taskIDs,
-		})
-	}
-	fmt.Printf("processed %d task(s)\n", processed)
-	return nil
+	return false
 }
 
-func resolveProjectRootFromCWD() (string, error) {
-	wd, err := os.Getwd()
+// updateSelectedTasks applies fn to every selected task under one lock
+// acquisition and saves once. With dryRun nothing is written and the
+// matching tasks are returned unchanged.
+func updateSelectedTasks(instance string, sel taskSelector, dryRun bool, fn func(*Task)) ([]Task, error) {
+	instDir, err := resolveInstanceDir(instance)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return filepath.Clean(wd), nil
-}
+	lockRelease, err := acquireInstanceLock(instDir)
+	if err != nil {
+		return nil, err
+	}
+	defer lockRelease()
 
-func resolveProjectRootFromWorkdir(workdir string) (string, error) {
-	w := strings.TrimSpace(workdir)
-	if w == "" {
-		w = "."
+	tasksPath := filepath.Join(instDir, "tasks.jsonl")
+	tasks, err := loadTasks(tasksPath)
+	if err != nil {
+		return nil, err
 	}
-	if !filepath.IsAbs(w) {
-		cwd, err := resolveProjectRootFromCWD()
-		if err != nil {
-			return "", err
+	idxs, err := selectTasks(tasks, sel, instance)
+	if err != nil {
+		return nil, err
+	}
+	matched := make([]Task, 0, len(idxs))
+	if dryRun {
+		for _, i := range idxs {
+			matched = append(matched, tasks[i])
 		}
-		w = filepath.Join(cwd, w)
+		return matched, nil
 	}
-	w = filepath.Clean(w)
-	info, err := os.Stat(w)
-	if err != nil {
-		return "", err
+	now := nowUTC()
+	for _, i := range idxs {
+		fn(&tasks[i])
+		tasks[i].Runner = ""
+		tasks[i].UpdatedAt = now
+		matched = append(matched, tasks[i])
 	}
-	if !info.IsDir() {
-		return "", fmt.Errorf("workdir must be a directory: %s", w)
+	if len(idxs) > 0 {
+		if err := saveTasks(tasksPath, tasks); err != nil {
+			return nil, err
+		}
 	}
-	return w, nil
+	return matched, nil
 }
 
-func projectObliviateHome(projectRoot string) string {
-	return filepath.Join(projectRoot, ".obliviate")
-}
+// parseBulkTaskArgs splits `<instance> [ids|ranges]... [flags]` for reset
+// and skip. extra registers command-specific flags before parsing.
+func parseBulkTaskArgs(name, usage string, args []string, extra func(*flag.FlagSet)) (instance string, sel taskSelector, dryRun, jsonOut bool, err error) {
+	if len(args) < 2 {
+		return "", taskSelector{}, false, false, errors.New(usage)
+	}
+	instance = args[0]
+	refs, flagArgs := splitTaskArgs(args[1:])
 
-func projectStateDir(projectRoot string) string {
-	return filepath.Join(projectObliviateHome(projectRoot), "state")
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	filters := addTaskFilterFlags(fs)
+	dry := fs.Bool("dry-run", false, "list matching tasks without changing them")
+	jsonFlag := fs.Bool("json", false, "emit machine-readable JSON")
+	if extra != nil {
+		extra(fs)
+	}
+	if err := fs.Parse(flagArgs); err != nil {
+		return "", taskSelector{}, false, false, err
+	}
+	if fs.NArg() > 0 {
+		return "", taskSelector{}, false, false, errors.New(usage)
+	}
+	sel, err = newTaskSelector(refs, filters)
+	if err != nil {
+		return "", taskSelector{}, false, false, err
+	}
+	if sel.empty() {
+		return "", taskSelector{}, false, false, errors.New("task-id, range, or filter is required")
+	}
+	return instance, sel, *dry, *jsonFlag, nil
 }
 
-func projectInstanceDir(projectRoot, instance string) string {
-	return filepath.Join(projectStateDir(projectRoot), instance)
+func printBulkResult(sel taskSelector, tasks []Task, jsonOut bool, line func(Task) string) error {
+	if jsonOut {
+		if sel.single() && len(tasks) == 1 {
+			return printJSON(tasks[0])
+		}
+		return printJSON(tasks)
+	}
+	if len(tasks) == 0 {
+		fmt.Println("no tasks matched")
+		return nil
+	}
+	for _, t := range tasks {
+		fmt.Println(line(t))
+	}
+	return nil
 }
 
-func resolveStateDirFromCWD() (string, error) {
-	projectRoot, err := resolveProjectRootFromCWD()
+func cmdReset(args []string) error {
+	const usage = "usage: obliviate reset <instance> <task-id|OB-010..OB-020>... [--status s] [--error-contains text] [--model hint] [--dry-run] [--json]"
+	instance, sel, dryRun, jsonOut, err := parseBulkTaskArgs("reset", usage, args, nil)
 	if err != nil {
-		return "", err
+		return err
 	}
-	return projectStateDir(projectRoot), nil
+	tasks, err := updateSelectedTasks(instance, sel, dryRun, func(t *Task) {
+		t.Status = statusTodo
+		t.Attempts = 0
+		t.LastError = ""
+	})
+	if err != nil {
+		return err
+	}
+	return printBulkResult(sel, tasks, jsonOut, func(t Task) string {
+		if dryRun {
+			return fmt.Sprintf("would reset %s (%s) -> todo", t.ID, t.Status)
+		}
+		return fmt.Sprintf("reset %s -> todo", t.ID)
+	})
 }
 
-func resolveInstanceDir(instance string) (string, error) {
-	projectRoot, err := resolveProjectRootFromCWD()
+func cmdSkip(args []string) error {
+	const usage = "usage: obliviate skip <instance> <task-id|OB-010..OB-020>... [--status s] [--error-contains text] [--model hint] [--reason \"...\"] [--dry-run] [--json]"
+	var reason *string
+	instance, sel, dryRun, jsonOut, err := parseBulkTaskArgs("skip", usage, args, func(fs *flag.FlagSet) {
+		reason = fs.String("reason", "", "human-readable skip reason")
+	})
 	if err != nil {
-		return "", err
+		return err
 	}
-	instDir := projectInstanceDir(projectRoot, instance)
-	if _, err := os.Stat(filepath.Join(instDir, "instance.json")); err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return "", fmt.Errorf("instance %q is not initialized in %s (run obliviate init %s --workdir %s)", instance, projectRoot, instance, projectRoot)
-		}
-		return "", err
+	reasonText := strings.TrimSpace(*reason)
+	if reasonText == "" {
+		reasonText = "manually skipped"
 	}
-	return instDir, nil
+	tasks, err := updateSelectedTasks(instance, sel, dryRun, func(t *Task) {
+		t.Status = statusBlocked
+		t.LastError = "skipped: " + reasonText
+	})
+	if err != nil {
+		return err
+	}
+	return printBulkResult(sel, tasks, jsonOut, func(t Task) string {
+		if dryRun {
+			return fmt.Sprintf("would skip %s (%s) -> blocked (%s)", t.ID, t.Status, reasonText)
+		}
+		return fmt.Sprintf("skipped %s -> blocked (%s)", t.ID, reasonText)
+	})
 }
 
-func parseBatch(payload []byte) ([]taskInput, error) {
-	trimmed := strings.TrimSpace(string(payload))
-	if trimmed == "" {
-		return nil, nil
+func cmdPrompt(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: obliviate prompt <instance> <task-id> [--prompt-budget 200000|50000t] [--json]")
 	}
-	if strings.HasPrefix(trimmed, "[") {
-		var raws []taskInputRaw
-		if err := json.Unmarshal([]byte(trimmed), &raws); err != nil {
-			return nil, err
-		}
-		out := make([]taskInput, 0, len(raws))
-		for i, r := range raws {
-			t, err := normalizeInput(r)
-			if err != nil {
-				return nil, fmt.Errorf("item %d: %w", i+1, err)
-			}
-			out = append(out, t)
-		}
-		return out, nil
+	instance := args[0]
+	taskID := strings.TrimSpace(args[1])
+	if taskID == "" {
+		return errors.New("task-id is required")
 	}
 
-	s := bufio.NewScanner(strings.NewReader(trimmed))
-	lineNo := 0
-	out := make([]taskInput, 0)
-	for s.Scan() {
-		lineNo++
-		line := strings.TrimSpace(s.Text())
-		if line == "" {
-			continue
-		}
-		var raw taskInputRaw
-		if err := json.Unmarshal([]byte(line), &raw); err != nil {
-			return nil, fmt.Errorf("line %d: %w", lineNo, err)
-		}
-		t, err := normalizeInput(raw)
-		if err != nil {
-			return nil, fmt.Errorf("line %d: %w", lineNo, err)
-		}
-		out = append(out, t)
+	fs := flag.NewFlagSet("prompt", flag.ContinueOnError)
+	flagPromptBudget := fs.String("prompt-budget", strconv.Itoa(promptBudget), "max prompt size in bytes, or tokens with a t suffix (0 = unlimited)")
+	jsonOut := fs.Bool("json", false, "emit the prompt and size breakdown as machine-readable JSON")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: obliviate prompt <instance> <task-id> [--prompt-budget 200000|50000t] [--json]")
+	}
+	budget, err := parsePromptBudget(*flagPromptBudget)
+	if err != nil {
+		return err
 	}
-	return out, s.Err()
-}
 
-func normalizeInput(raw taskInputRaw) (taskInput, error) {
-	verify, err := parseVerify(raw.Verify)
+	instDir, err := resolveInstanceDir(instance)
 	if err != nil {
-		return taskInput{}, err
+		return err
 	}
-	if strings.TrimSpace(raw.Title) == "" || strings.TrimSpace(raw.Spec) == "" || len(verify) == 0 {
-		return taskInput{}, errors.New("title, spec, and verify are required")
+	tasks, err := loadTasks(filepath.Join(instDir, "tasks.jsonl"))
+	if err != nil {
+		return err
 	}
-	if strings.TrimSpace(raw.ModelHint) == "" {
-		return taskInput{}, errors.New("model_hint is required")
+	idx := findTaskIndex(tasks, taskID)
+	if idx < 0 {
+		return fmt.Errorf("task %q not found in instance %q", taskID, instance)
 	}
-	priority := strings.TrimSpace(raw.Priority)
-	if priority == "" {
-		priority = "med"
+	home := filepath.Dir(filepath.Dir(instDir))
+	tmpl, err := loadPromptTemplate(home, instDir)
+	if err != nil {
+		return err
 	}
-	source := strings.TrimSpace(raw.Source)
-	if source == "" {
-		source = "agent"
+	prompt, report, err := buildExecutionPrompt(home, instance, tasks[idx], budget, tmpl)
+	if err != nil {
+		return err
 	}
-	return taskInput{
-		Title:     raw.Title,
-		Spec:      raw.Spec,
-		Verify:    verify,
-		ModelHint: strings.TrimSpace(raw.ModelHint),
-		Priority:  priority,
-		Source:    source,
-	}, nil
+
+	if *jsonOut {
+		return printJSON(struct {
+			TaskID string `json:"task_id"`
+			Prompt string `json:"prompt"`
+			promptReport
+		}{TaskID: tasks[idx].ID, Prompt: prompt, promptReport: report})
+	}
+	// The prompt goes to stdout exactly as the agent receives it; the
+	// breakdown goes to stderr so the prompt can be piped cleanly.
+	fmt.Print(prompt)
+	fmt.Println()
+	printPromptReport(os.Stderr, report)
+	return nil
 }
 
-func parseVerify(raw json.RawMessage) ([]string, error) {
-	if len(bytes.TrimSpace(raw)) == 0 {
-		return nil, errors.New("verify is required")
+func printPromptReport(w io.Writer, r promptReport) {
+	budget := "unlimited"
+	if r.Budget > 0 {
+		budget = fmt.Sprintf("%d bytes", r.Budget)
 	}
-	var single string
-	if err := json.Unmarshal(raw, &single); err == nil {
-		single = strings.TrimSpace(single)
-		if single == "" {
-			return nil, errors.New("verify cannot be empty")
-		}
-		return []string{single}, nil
+	fmt.Fprintf(w, "\n--- prompt size: %d bytes (~%d tokens), budget %s", r.TotalBytes, r.ApproxTokens, budget)
+	if r.OverBudget {
+		fmt.Fprint(w, ", OVER BUDGET (untruncatable sections exceed it)")
 	}
-	var many []string
-	if err := json.Unmarshal(raw, &many); err != nil {
-		return nil, errors.New("verify must be a string or string array")
+	fmt.Fprintln(w, " ---")
+	if r.Template != "" {
+		fmt.Fprintf(w, "rendered with template %s; sections below are the inputs it received\n", r.Template)
 	}
-	out := make([]string, 0, len(many))
-	for _, v := range many {
-		v = strings.TrimSpace(v)
-		if v == "" {
-			continue
+	for _, s := range r.Sections {
+		note := ""
+		if s.Truncated {
+			note = fmt.Sprintf("  truncated from %d", s.OriginalBytes)
 		}
-		out = append(out, v)
-	}
-	if len(out) == 0 {
-		return nil, errors.New("verify cannot be empty")
+		fmt.Fprintf(w, "%-20s %8d bytes  ~%6d tokens%s\n", s.Name, s.Bytes, s.ApproxTokens, note)
 	}
-	return out, nil
 }
 
-func addTasks(instance string, inputs []taskInput) ([]Task, error) {
+// runStatusReverted marks the runs.jsonl entry written by revert.
+const runStatusReverted = "reverted"
+
+type revertResult struct {
+	Task       Task        `json:"task"`
+	Reverted   []runCommit `json:"reverted"`
+	Commits    []runCommit `json:"commits,omitempty"`
+	Dependents []string    `json:"dependents,omitempty"`
+	DryRun     bool        `json:"dry_run,omitempty"`
+}
+
+func cmdRevert(args []string) error {
+	const usage = "usage: obliviate revert <instance> <task-id> [--reason \"...\"] [--dry-run] [--json]"
+	if len(args) < 2 {
+		return errors.New(usage)
+	}
+	instance := args[0]
+	taskID := strings.TrimSpace(args[1])
+	if taskID == "" {
+		return errors.New("task-id is required")
+	}
+
+	fs := flag.NewFlagSet("revert", flag.ContinueOnError)
+	reason := fs.String("reason", "", "why the task is being reverted (recorded in last_error)")
+	dryRun := fs.Bool("dry-run", false, "list the commits that would be reverted")
+	jsonOut := fs.Bool("json", false, "emit machine-readable JSON")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New(usage)
+	}
+
 	instDir, err := resolveInstanceDir(instance)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	meta, err := loadInstanceMeta(filepath.Join(instDir, "instance.json"))
+	if err != nil {
+		return err
 	}
+	workdir := resolveWorkdir(filepath.Dir(filepath.Dir(filepath.Dir(instDir))), meta.Workdir)
+	// Hold the runner lease for the whole revert so no go loop can start
+	// an agent on the tree while it is rewritten.
+	lease, err := acquireRunnerLease(instDir, false, nil)
+	if err != nil {
+		if holder := runnerStatus(instDir); holder != nil {
+			return fmt.Errorf("a go runner is active for this instance (%s); stop it before reverting", holder)
+		}
+		return err
+	}
+	defer lease.release()
 	lockRelease, err := acquireInstanceLock(instDir)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer lockRelease()
 
-	p := filepath.Join(instDir, "tasks.jsonl")
-	tasks, err := loadTasks(p)
+	tasksPath := filepath.Join(instDir, "tasks.jsonl")
+	tasks, err := loadTasks(tasksPath)
+	if err != nil {
+		return err
+	}
+	idx := findTaskIndex(tasks, taskID)
+	if idx < 0 {
+		return fmt.Errorf("task %q not found in instance %q", taskID, instance)
+	}
+	if tasks[idx].Status != statusDone {
+		return fmt.Errorf("task %s must be done to revert (status %s)", taskID, tasks[idx].Status)
+	}
+	runsPath := filepath.Join(instDir, "runs.jsonl")
+	runs, err := loadRuns(runsPath)
+	if err != nil {
+		return err
+	}
+	commits, err := revertableCommits(workdir, runs, taskID)
+	if err != nil {
+		return err
+	}
+	if len(commits) == 0 {
+		return fmt.Errorf("no commits recorded for task %s; use reset to requeue it", taskID)
+	}
+	head, err := gitHead(workdir)
+	if err != nil {
+		return err
+	}
+	var dependents []string
+	for _, t := range tasks {
+		if t.Status == statusDone && slices.Contains(t.DependsOn, taskID) {
+			dependents = append(dependents, t.ID)
+		}
+	}
+
+	result := revertResult{Reverted: commits, Dependents: dependents, DryRun: *dryRun}
+	if *dryRun {
+		result.Task = tasks[idx]
+		return printRevertResult(result, *jsonOut)
+	}
+	if dirty, err := runGit(workdir, append([]string{"status", "--porcelain"}, gitFactsPathspec...)...); err != nil {
+		return err
+	} else if dirty != "" {
+		return fmt.Errorf("workdir %s has uncommitted changes; commit or discard them before reverting", workdir)
+	}
+
+	start := nowUTC()
+	created, err := revertCommits(workdir, head, commits)
+	if err != nil {
+		return err
+	}
+	headAfter, err := gitHead(workdir)
+	if err != nil {
+		return err
+	}
+
+	reasonText := strings.TrimSpace(*reason)
+	if reasonText == "" {
+		reasonText = "manually reverted"
+	}
+	shas := make([]string, len(commits))
+	for i, c := range commits {
+		shas[i] = shortSHA(c.SHA)
+	}
+	note := fmt.Sprintf("reverted: %s (%d commit(s): %s)", reasonText, len(commits), strings.Join(shas, ", "))
+	run := RunLog{
+		RunID:      newRunID(taskID),
+		TaskID:     taskID,
+		Status:     runStatusReverted,
+		StartedAt:  start,
+		FinishedAt: nowUTC(),
+		Error:      note,
+		HeadBefore: head,
+		HeadAfter:  headAfter,
+		Commits:    created,
+		Reverted:   commits,
+	}
+	tasks[idx].Status = statusTodo
+	tasks[idx].Attempts = 0
+	tasks[idx].LastError = note
+	tasks[idx].Runner = ""
+	tasks[idx].UpdatedAt = nowUTC()
+	if err := appendJSONLine(runsPath, run); err != nil {
+		return err
+	}
+	if err := saveTasks(tasksPath, tasks); err != nil {
+		return err
+	}
+	result.Task = tasks[idx]
+	result.Commits = created
+	return printRevertResult(result, *jsonOut)
+}
+
+// revertableCommits returns, oldest first, what taskID put on the branch
+// checked out in workdir since its last revert. A done run contributes the
+// range it landed, first-parent only so a merge commit stands for its whole
+// branch; runs recorded before landed ranges contribute their commits. A
+// failed run's commits count when nothing rolled them back, they are still
+// reachable from HEAD, and no done range already covers them. Every commit
+// of a done run must be reachable from HEAD.
+func revertableCommits(workdir string, runs []RunLog, taskID string) ([]runCommit, error) {
+	head, err := gitHead(workdir)
 	if err != nil {
 		return nil, err
 	}
-	next := nextTaskNumber(tasks)
-	now := nowUTC()
-	added := make([]Task, 0, len(inputs))
-	for _, in := range inputs {
-		id := fmt.Sprintf("OB-%03d", next)
-		next++
-		t := Task{
-			ID:        id,
-			Title:     strings.TrimSpace(in.Title),
-			Spec:      strings.TrimSpace(in.Spec),
-			Verify:    in.Verify,
-			Status:    statusTodo,
-			ModelHint: in.ModelHint,
-			Priority:  in.Priority,
-			Attempts:  0,
-			Source:    in.Source,
-			CreatedAt: now,
-			UpdatedAt: now,
+	var mine []RunLog
+	for _, r := range runs {
+		switch {
+		case r.TaskID != taskID:
+		case r.Status == runStatusReverted:
+			mine = nil
+		default:
+			mine = append(mine, r)
+		}
+	}
+	reachable := func(sha, from string) bool {
+		_, err := runGit(workdir, "merge-base", "--is-ancestor", sha, from)
+		return err == nil
+	}
+	landed := func(r RunLog) ([]runCommit, error) {
+		if r.LandedTo == "" {
+			return r.Commits, nil
+		}
+		out, err := runGit(workdir, "log", "--first-parent", "--reverse", "--format=%H%x1f%s", r.LandedFrom+".."+r.LandedTo)
+		if err != nil {
+			return nil, fmt.Errorf("run %s: read landed commits: %w", r.RunID, err)
+		}
+		return parseRunCommits(out), nil
+	}
+	covered := func(sha string) bool {
+		for _, r := range mine {
+			if r.Status == statusDone && r.LandedTo != "" && reachable(sha, r.LandedTo) && !reachable(sha, r.LandedFrom) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var commits []runCommit
+	for _, r := range mine {
+		switch r.Status {
+		case statusDone:
+			done, err := landed(r)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range done {
+				if !reachable(c.SHA, head) {
+					return nil, fmt.Errorf("commit %s from task %s is not on the checked-out branch (HEAD %s)", shortSHA(c.SHA), taskID, shortSHA(head))
+				}
+			}
+			commits = append(commits, done...)
+		case statusFailed, statusBlocked:
+			for _, c := range r.Commits {
+				if reachable(c.SHA, head) && !covered(c.SHA) {
+					commits = append(commits, c)
+				}
+			}
+		}
+	}
+	return commits, nil
+}
+
+// revertCommits reverts commits newest first, one revert commit each. On
+// any failure the in-progress revert is aborted and the branch is reset to
+// head, so either every commit is reverted or nothing changes.
+func revertCommits(workdir, head string, commits []runCommit) ([]runCommit, error) {
+	var created []runCommit
+	for i := len(commits) - 1; i >= 0; i-- {
+		c := commits[i]
+		args := []string{"revert", "--no-edit"}
+		if parents, err := runGit(workdir, "rev-list", "--parents", "-n", "1", c.SHA); err == nil && len(strings.Fields(parents)) > 2 {
+			args = append(args, "-m", "1")
+		}
+		if out, err := runGit(workdir, append(args, c.SHA)...); err != nil {
+			detail := abortConflicted(workdir, "revert", out)
+			if len(created) > 0 {
+				_, _ = runGit(workdir, "reset", "-q", "--keep", head)
+			}
+			return nil, fmt.Errorf("revert of %s (%s) failed: %s; nothing was changed", shortSHA(c.SHA), c.Subject, detail)
+		}
+		out, err := runGit(workdir, "log", "-1", "--format=%H%x1f%s")
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, parseRunCommits(out)...)
+	}
+	return created, nil
+}
+
+func printRevertResult(res revertResult, jsonOut bool) error {
+	if jsonOut {
+		return printJSON(res)
+	}
+	verb := "reverted"
+	if res.DryRun {
+		verb = "would revert"
+	}
+	fmt.Printf("%s %s: %d commit(s)\n", verb, res.Task.ID, len(res.Reverted))
+	for i := len(res.Reverted) - 1; i >= 0; i-- {
+		fmt.Printf("  %s %s\n", shortSHA(res.Reverted[i].SHA), res.Reverted[i].Subject)
+	}
+	if !res.DryRun {
+		fmt.Printf("%s -> todo\n", res.Task.ID)
+	}
+	for _, id := range res.Dependents {
+		fmt.Fprintf(os.Stderr, "warning: %s depends on %s and is still done\n", id, res.Task.ID)
+	}
+	return nil
+}
+
+func cmdUnlock(args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: obliviate unlock <instance> [--force] [--json]")
+	}
+	instance := args[0]
+
+	fs := flag.NewFlagSet("unlock", flag.ContinueOnError)
+	force := fs.Bool("force", false, "remove the lock file while it is held")
+	jsonOut := fs.Bool("json", false, "emit machine-readable JSON")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: obliviate unlock <instance> [--force] [--json]")
+	}
+
+	instDir, err := resolveInstanceDir(instance)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(instDir, tasksLockName)
+	holder, err := lockStatus(path)
+	if err != nil {
+		return err
+	}
+	removed := false
+	if holder != nil {
+		if !*force {
+			state := "live"
+			if holder.dead() {
+				state = "dead"
+			}
+			return fmt.Errorf("tasks lock is held by %s %s; use --force to remove it anyway", state, holder)
+		}
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		removed = true
+	}
+
+	if *jsonOut {
+		return printJSON(struct {
+			Instance string      `json:"instance"`
+			Removed  bool        `json:"removed"`
+			Holder   *lockHolder `json:"holder,omitempty"`
+		}{Instance: instance, Removed: removed, Holder: holder})
+	}
+	if !removed {
+		fmt.Printf("%s: tasks lock is free\n", instance)
+		return nil
+	}
+	fmt.Printf("%s: removed tasks lock held by %s\n", instance, holder)
+	return nil
+}
+
+func cmdLearnings(args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: obliviate learnings <instance> [--global] [--dedupe] [--prune] [--json]")
+	}
+	instance := args[0]
+
+	fs := flag.NewFlagSet("learnings", flag.ContinueOnError)
+	global := fs.Bool("global", false, "operate on global-learnings.md instead of the instance file")
+	dedupe := fs.Bool("dedupe", false, "drop entries whose text repeats an earlier entry")
+	prune := fs.Bool("prune", false, "drop auto-generated \"OB-xxx completed (...)\" lines")
+	jsonOut := fs.Bool("json", false, "emit machine-readable JSON")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: obliviate learnings <instance> [--global] [--dedupe] [--prune] [--json]")
+	}
+
+	instDir, err := resolveInstanceDir(instance)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(instDir, "learnings.md")
+	if *global {
+		path = filepath.Join(filepath.Dir(filepath.Dir(instDir)), "global-learnings.md")
+	}
+
+	var stats learningsStats
+	if *dedupe || *prune {
+		lockRelease, err := acquireInstanceLock(instDir)
+		if err != nil {
+			return err
+		}
+		defer lockRelease()
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	content := string(raw)
+	if *dedupe || *prune {
+		content, stats = compactLearnings(content, *dedupe, *prune)
+		if stats.Duplicates > 0 || stats.Pruned > 0 {
+			if err := writeFileAtomic(path, content); err != nil {
+				return err
+			}
+		}
+	} else {
+		_, stats = compactLearnings(content, false, false)
+	}
+
+	if *jsonOut {
+		return printJSON(struct {
+			Path string `json:"path"`
+			learningsStats
+			Lines []string `json:"lines"`
+		}{Path: path, learningsStats: stats, Lines: learningEntryLines(content)})
+	}
+	fmt.Print(content)
+	if *dedupe || *prune {
+		fmt.Printf("\n%s: %d entries (removed %d duplicate(s), pruned %d)\n", path, stats.Entries, stats.Duplicates, stats.Pruned)
+	}
+	return nil
+}
+
+func cmdLogs(args []string) error {
+	if len(args) < 2 {
+		return errors.New("usage: obliviate logs <instance> <run-id|task-id> [--follow] [--prompt] [--json]")
+	}
+	instance := args[0]
+	ref := strings.TrimSpace(args[1])
+	if ref == "" {
+		return errors.New("run-id or task-id is required")
+	}
+
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	follow := fs.Bool("follow", false, "stream output until the run finishes")
+	withPrompt := fs.Bool("prompt", false, "also print the prompt sent to the agent")
+	jsonOut := fs.Bool("json", false, "emit the run record as machine-readable JSON")
+	if err := fs.Parse(args[2:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: obliviate logs <instance> <run-id|task-id> [--follow] [--prompt] [--json]")
+	}
+
+	instDir, err := resolveInstanceDir(instance)
+	if err != nil {
+		return err
+	}
+	runID, err := resolveRunRef(instDir, ref)
+	if err != nil {
+		return err
+	}
+	dir := runArtifactDir(instDir, runID)
+
+	if *jsonOut {
+		run, err := loadRunRecord(instDir, runID)
+		if err != nil {
+			return err
+		}
+		return printJSON(run)
+	}
+
+	if *withPrompt {
+		fmt.Printf("=== prompt (%s) ===\n", runID)
+		if err := copyFileTo(os.Stdout, filepath.Join(dir, "prompt.md")); err != nil {
+			return err
+		}
+		fmt.Println()
+	}
+	if *follow {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		return followRunArtifacts(ctx, dir, runID, os.Stdout)
+	}
+	fmt.Printf("=== agent output (%s) ===\n", runID)
+	if err := copyFileTo(os.Stdout, filepath.Join(dir, "agent.log")); err != nil {
+		return err
+	}
+	if info, err := os.Stat(filepath.Join(dir, "verify.log")); err == nil && info.Size() > 0 {
+		fmt.Printf("\n=== verify (%s) ===\n", runID)
+		if err := copyFileTo(os.Stdout, filepath.Join(dir, "verify.log")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func cmdSchema(args []string) error {
+	if len(args) != 1 || args[0] != "events" {
+		return errors.New("usage: obliviate schema events")
+	}
+	return printJSON(eventsJSONSchema())
+}
+
+func cmdRuns(args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: obliviate runs <instance> [--limit N] [--task-id OB-001] [--json]")
+	}
+	instance := args[0]
+
+	fs := flag.NewFlagSet("runs", flag.ContinueOnError)
+	limit := fs.Int("limit", 20, "number of most recent runs to return (0 = all)")
+	taskID := fs.String("task-id", "", "filter by task id")
+	jsonOut := fs.Bool("json", false, "emit machine-readable JSON")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return errors.New("usage: obliviate runs <instance> [--limit N] [--task-id OB-001] [--json]")
+	}
+	if *limit < 0 {
+		return errors.New("limit must be >= 0")
+	}
+
+	instDir, err := resolveInstanceDir(instance)
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(instDir, "runs.jsonl")
+	runs, err := loadRuns(p)
+	if err != nil {
+		return err
+	}
+	filter := strings.TrimSpace(*taskID)
+	if filter != "" {
+		filtered := make([]RunLog, 0, len(runs))
+		for _, r := range runs {
+			if r.TaskID == filter {
+				filtered = append(filtered, r)
+			}
+		}
+		runs = filtered
+	}
+	if *limit > 0 && len(runs) > *limit {
+		runs = runs[len(runs)-*limit:]
+	}
+	if *jsonOut {
+		return printJSON(runsResult{
+			Instance: instance,
+			Count:    len(runs),
+			Runs:     runs,
+		})
+	}
+	if len(runs) == 0 {
+		fmt.Printf("[%s] no runs found\n", instance)
+		return nil
+	}
+	for _, r := range runs {
+		fmt.Printf("%s %s %s %s/%s %s\n", r.FinishedAt, r.TaskID, r.Status, r.Provider, r.Model, r.RunID)
+	}
+	return nil
+}
+
+func cmdGo(args []string) error {
+	if len(args) < 1 {
+		return errors.New("usage: obliviate go <instance> [--limit N] [--parallel N] [--dry-run] [--require-commit] [--agent-timeout 15m] [--verify-timeout 2m] [--verify-mode first|all] [--prompt-budget 200000] [--cooldown 10s] [--max-attempts 2] [--max-transient-retries 3] [--priority-floor high] [--wait] [--auto-commit] [--commit-template tmpl] [--allow-state-commit] [--rollback-on-fail] [--branch-mode task|instance] [--target-branch main] [--merge-strategy ff|merge]")
+	}
+	instance := args[0]
+
+	fs := flag.NewFlagSet("go", flag.ContinueOnError)
+	limit := fs.Int("limit", 0, "max tasks to process (0 = all)")
+	parallel := fs.Int("parallel", 1, "max agents to run concurrently, each in its own git worktree")
+	dryRun := fs.Bool("dry-run", false, "show what would run")
+	jsonOut := fs.Bool("json", false, "emit machine-readable JSON")
+	requireCommit := fs.Bool("require-commit", false, "require each successful task to create a new git commit")
+	flagAgentTimeout := fs.Duration("agent-timeout", agentTimeout, "override agent subprocess timeout")
+	cooldown := fs.Duration("cooldown", 10*time.Second, "sleep between tasks")
+	flagMaxAttempts := fs.Int("max-attempts", maxAttempts, "override max attempts per task")
+	maxTransientRetries := fs.Int("max-transient-retries", 3, "max backoff retries for transient provider failures per task")
+	noNotify := fs.Bool("no-notify", false, "disable notifyctl event emission on completion")
+	priorityFloor := fs.String("priority-floor", "", "only run tasks at or above this priority (low|med|high)")
+	keepRuns := fs.Int("keep-runs", runRetention, "run artifact directories to keep per instance (0 = keep all)")
+	flagPromptBudget := fs.String("prompt-budget", strconv.Itoa(promptBudget), "max prompt size in bytes, or tokens with a t suffix (0 = unlimited)")
+	flagVerifyMode := fs.String("verify-mode", verifyModeFirst, "run verify commands until the first failure (first) or run them all (all); a task's verify_mode wins")
+	flagVerifyTimeout := fs.Duration("verify-timeout", verifyTimeout, "default timeout for verify commands without their own timeout")
+	wait := fs.Bool("wait", false, "wait for another active go runner on this instance to finish instead of failing")
+	stream := fs.Bool("stream", false, "stream agent and verify output live, prefixed with the task id")
+	flagAutoCommit := fs.Bool("auto-commit", false, "after verify passes, stage the agent's changes and commit them")
+	commitTemplate := fs.String("commit-template", defaultCommitTemplate, "text/template for auto-commit messages; Obliviate-* trailers are appended")
+	allowStateCommit := fs.Bool("allow-state-commit", false, "let auto-commit include files under .obliviate/state")
+	rollbackOnFail := fs.Bool("rollback-on-fail", false, "restore the workdir after a failed or interrupted attempt, saving its work under refs/obliviate/")
+	branchMode := fs.String("branch-mode", "", "run each task on its own branch (task) or all tasks on one instance branch (instance)")
+	targetBranch := fs.String("target-branch", "", "branch that --branch-mode merges successful tasks into (default: the workdir's current branch)")
+	mergeStrategy := fs.String("merge-strategy", mergeStrategyFF, "how --branch-mode lands a task: ff (rebase, then fast-forward) or merge (merge commit)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if strings.TrimSpace(*priorityFloor) != "" {
+		floor, err := normalizePriority(*priorityFloor)
+		if err != nil {
+			return fmt.Errorf("priority-floor: %w", err)
+		}
+		*priorityFloor = floor
+	}
+	if *parallel < 1 {
+		return errors.New("parallel must be >= 1")
+	}
+	if mode, err := normalizeVerifyMode(*flagVerifyMode); err != nil {
+		return fmt.Errorf("verify-mode: %w", err)
+	} else if mode != "" {
+		*flagVerifyMode = mode
+	} else {
+		*flagVerifyMode = verifyModeFirst
+	}
+	budget, err := parsePromptBudget(*flagPromptBudget)
+	if err != nil {
+		return err
+	}
+	if *flagVerifyTimeout <= 0 {
+		return errors.New("verify-timeout must be > 0")
+	}
+	if *keepRuns < 0 {
+		return errors.New("keep-runs must be >= 0")
+	}
+	commitTmpl, err := parseCommitTemplate(*commitTemplate)
+	if err != nil {
+		return err
+	}
+	switch *branchMode {
+	case "", branchModeTask, branchModeInstance:
+	default:
+		return fmt.Errorf("branch-mode must be one of task, instance (got %q)", *branchMode)
+	}
+	switch *mergeStrategy {
+	case mergeStrategyFF, mergeStrategyMerge:
+	default:
+		return fmt.Errorf("merge-strategy must be one of ff, merge (got %q)", *mergeStrategy)
+	}
+	if *branchMode == branchModeInstance && *parallel > 1 {
+		return errors.New("branch-mode must be task when --parallel > 1; one instance branch cannot be checked out in several worktrees")
+	}
+
+	instDir, err := resolveInstanceDir(instance)
+	if err != nil {
+		return err
+	}
+	meta, err := loadInstanceMeta(filepath.Join(instDir, "instance.json"))
+	if err != nil {
+		return err
+	}
+
+	home := filepath.Dir(filepath.Dir(instDir))
+	projectRoot := filepath.Dir(home)
+	workdir := resolveWorkdir(projectRoot, meta.Workdir)
+	tasksPath := filepath.Join(instDir, "tasks.jsonl")
+	providers, err := loadProviderRegistry(home)
+	if err != nil {
+		return err
+	}
+	fallback, err := loadFallbackConfig(home, instDir)
+	if err != nil {
+		return err
+	}
+	promptTmpl, err := loadPromptTemplate(home, instDir)
+	if err != nil {
+		return err
+	}
+	stateRel, stateIgnored := "", false
+	if *flagAutoCommit && !*dryRun {
+		if stateRel, stateIgnored, err = stateDirRel(workdir, filepath.Dir(instDir)); err != nil {
+			return fmt.Errorf("auto-commit requires a git workdir: %w", err)
+		}
+	}
+	if *rollbackOnFail && !*dryRun {
+		if _, err := gitHead(workdir); err != nil {
+			return fmt.Errorf("rollback-on-fail requires a git workdir with at least one commit: %w", err)
+		}
+		if stateRel, stateIgnored, err = stateDirRel(workdir, filepath.Dir(instDir)); err != nil {
+			return err
+		}
+		// A hard reset would rewind tracked state files under the runner.
+		if stateRel != "" {
+			if tracked, err := runGit(workdir, "ls-files", "--", ":(top)"+stateRel); err == nil && tracked != "" {
+				return fmt.Errorf("rollback-on-fail: %s must be untracked (add it to .gitignore)", stateRel)
+			}
+		}
+	}
+	if *branchMode != "" && !*dryRun {
+		if _, err := gitHead(workdir); err != nil {
+			return fmt.Errorf("branch-mode requires a git workdir with at least one commit: %w", err)
+		}
+		if stateRel, stateIgnored, err = stateDirRel(workdir, filepath.Dir(instDir)); err != nil {
+			return err
+		}
+		current := currentBranch(workdir)
+		if *targetBranch == "" {
+			*targetBranch = current
+		}
+		if *targetBranch == "" {
+			return errors.New("branch-mode: --target-branch is required when the workdir HEAD is detached")
+		}
+		if !branchExists(workdir, *targetBranch) {
+			return fmt.Errorf("branch-mode: target branch %q not found", *targetBranch)
+		}
+	}
+	lease, err := acquireRunnerLease(instDir, *wait, func(holder lockHolder) {
+		if !*jsonOut {
+			fmt.Printf("waiting for active runner %s\n", holder)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	defer lease.release()
+	cfg := goConfig{
+		Instance:            instance,
+		InstDir:             instDir,
+		Home:                home,
+		Workdir:             workdir,
+		TasksPath:           tasksPath,
+		RunsPath:            filepath.Join(instDir, "runs.jsonl"),
+		JSON:                *jsonOut,
+		RequireCommit:       *requireCommit,
+		AgentTimeout:        *flagAgentTimeout,
+		MaxAttempts:         *flagMaxAttempts,
+		MaxTransientRetries: *maxTransientRetries,
+		Providers:           providers,
+		Fallback:            fallback,
+		KeepRuns:            *keepRuns,
+		VerifyTimeout:       *flagVerifyTimeout,
+		VerifyMode:          *flagVerifyMode,
+		PromptBudget:        budget,
+		PromptTemplate:      promptTmpl,
+		RunnerID:            lease.holder.ID,
+		Stream:              *stream,
+		AutoCommit:          *flagAutoCommit,
+		CommitTemplate:      commitTmpl,
+		AllowStateCommit:    *allowStateCommit,
+		RollbackOnFail:      *rollbackOnFail,
+		BranchMode:          *branchMode,
+		TargetBranch:        *targetBranch,
+		MergeStrategy:       *mergeStrategy,
+		StateRel:            stateRel,
+		StateIgnored:        stateIgnored,
+	}
+
+	// Switch branches only once the lease is held, so a runner that is
+	// refused never moves the workdir under the active one.
+	if *branchMode != "" && !*dryRun {
+		if current := currentBranch(workdir); current != *targetBranch {
+			if dirty, err := workdirDirty(workdir, cfg.stateExclude()); err != nil {
+				return err
+			} else if dirty != "" {
+				return fmt.Errorf("branch-mode: uncommitted changes on %s; commit or discard them before switching to %s", orDash(current), *targetBranch)
+			}
+			if _, err := runGit(workdir, "checkout", "-q", *targetBranch); err != nil {
+				return err
+			}
+		}
+	}
+
+	if *parallel > 1 && !*dryRun {
+		if _, err := gitHead(workdir); err != nil {
+			return fmt.Errorf("parallel mode requires a git workdir with at least one commit: %w", err)
+		}
+		// Drop bookkeeping for worktrees left behind by a killed run.
+		_, _ = runGit(workdir, "worktree", "prune")
+	}
+
+	// Set up signal-aware context for graceful shutdown.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	// --- Stale in_progress recovery (under lock) ---
+	// Holding the runner lease means no other runner is alive, so every
+	// in_progress task left by a different runner is orphaned.
+	{
+		lockRelease, err := acquireInstanceLock(instDir)
+		if err != nil {
+			return err
+		}
+		tasks, err := loadTasks(tasksPath)
+		if err != nil {
+			lockRelease()
+			return err
+		}
+		recovered := false
+		for i := range tasks {
+			if tasks[i].Status == statusInProgress && tasks[i].Runner != cfg.RunnerID {
+				if *jsonOut {
+					emitEvent(staleRecoveredEvent{eventEnvelope: newEnvelope(instance, "stale_recovered"), TaskID: tasks[i].ID, Runner: tasks[i].Runner})
+				} else {
+					fmt.Printf("recovered stale in_progress task %s -> todo\n", tasks[i].ID)
+				}
+				tasks[i].Status = statusTodo
+				tasks[i].Runner = ""
+				tasks[i].LastError = ""
+				tasks[i].UpdatedAt = nowUTC()
+				recovered = true
+			}
+		}
+		if recovered {
+			if err := saveTasks(tasksPath, tasks); err != nil {
+				lockRelease()
+				return err
+			}
+		}
+		lockRelease()
+	}
+
+	// Startup banner: count remaining work and print immediately.
+	{
+		tasks, err := loadTasks(tasksPath)
+		if err == nil {
+			todo, failed, done, blocked := 0, 0, 0, 0
+			for _, t := range tasks {
+				switch t.Status {
+				case statusTodo:
+					todo++
+				case statusFailed:
+					failed++
+				case statusDone:
+					done++
+				case statusBlocked:
+					blocked++
+				}
+			}
+			remaining := todo + failed
+			if *jsonOut {
+				emitEvent(startedEvent{
+					eventEnvelope: newEnvelope(instance, "started"),
+					Total:         len(tasks),
+					Remaining:     remaining,
+					Todo:          todo,
+					Failed:        failed,
+					Done:          done,
+					Blocked:       blocked,
+					Parallel:      *parallel,
+					Timeout:       flagAgentTimeout.String(),
+					Cooldown:      cooldown.String(),
+					DryRun:        *dryRun,
+				})
+			} else {
+				fmt.Printf("starting %s: %d remaining (%d todo, %d failed-retry), %d done, %d blocked, parallel=%d timeout=%s cooldown=%s\n",
+					instance, remaining, todo, failed, done, blocked, *parallel, flagAgentTimeout.String(), cooldown.String())
+			}
+		}
+	}
+
+	processed := 0
+	doneCount := 0
+	failedCount := 0
+	blockedCount := 0
+	taskIDs := make([]string, 0)
+	tally := func(res taskResult) {
+		processed++
+		taskIDs = append(taskIDs, res.TaskID)
+		switch res.Status {
+		case statusDone:
+			doneCount++
+		case statusFailed:
+			failedCount++
+		case statusBlocked:
+			blockedCount++
+		}
+	}
+
+	if *parallel > 1 && !*dryRun {
+		if err := runParallel(ctx, cfg, *parallel, *limit, *priorityFloor, *cooldown, tally); err != nil {
+			return err
+		}
+	} else {
+		for {
+			// Check for shutdown between tasks.
+			if ctx.Err() != nil {
+				if *jsonOut {
+					emitEvent(interruptedEvent{eventEnvelope: newEnvelope(instance, "interrupted")})
+				} else {
+					fmt.Println("interrupted, stopping loop")
+				}
+				break
+			}
+
+			if *limit > 0 && processed >= *limit {
+				break
+			}
+
+			t, ok, err := claimNextTask(cfg, *priorityFloor, *dryRun)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				break
+			}
+			if *dryRun {
+				if *jsonOut {
+					emitEvent(dryRunTaskEvent{eventEnvelope: newEnvelope(instance, "dry_run_task"), TaskID: t.ID, Title: t.Title})
+				} else {
+					fmt.Printf("would run %s (%s)\n", t.ID, t.Title)
+				}
+				processed++
+				taskIDs = append(taskIDs, t.ID)
+				continue
+			}
+
+			res, err := runTaskInWorkdir(ctx, cfg, t)
+			if err != nil {
+				return err
+			}
+			if res.Interrupted {
+				break
+			}
+			tally(res)
+
+			// Cooldown between tasks.
+			if *cooldown > 0 {
+				select {
+				case <-time.After(*cooldown):
+				case <-ctx.Done():
+				}
+			}
+		}
+	}
+
+	if err := appendCycleSummaryLine(filepath.Join(instDir, "cycle.log"), instance, processed, doneCount, failedCount, blockedCount, taskIDs, *dryRun); err != nil {
+		return err
+	}
+
+	if !*noNotify && !*dryRun && processed > 0 {
+		if err := emitNotification(instance, processed, doneCount, failedCount, blockedCount); err != nil {
+			// Non-fatal: log but don't fail the run.
+			if *jsonOut {
+				emitEvent(notifyErrorEvent{eventEnvelope: newEnvelope(instance, "notify_error"), Error: err.Error()})
+			} else {
+				fmt.Fprintf(os.Stderr, "warning: notifyctl: %v\n", err)
+			}
+		}
+	}
+
+	if *jsonOut {
+		emitEvent(finishedEvent{
+			eventEnvelope: newEnvelope(instance, "finished"),
+			Processed:     processed,
+			Done:          doneCount,
+			Failed:        failedCount,
+			Blocked:       blockedCount,
+			DryRun:        *dryRun,
+			TaskIDs:       taskIDs,
+		})
+		return nil
+	}
+	fmt.Printf("processed %d task(s)\n", processed)
+	return nil
+}
+
+// eventSchemaVersion is bumped whenever a go --json event changes shape in
+// a way consumers must handle (renamed or removed fields, changed types).
+const eventSchemaVersion = 1
+
+// eventEnvelope is embedded in every go --json event.
+type eventEnvelope struct {
+	Event         string `json:"event"`
+	TS            string `json:"ts"`
+	Instance      string `json:"instance"`
+	SchemaVersion int    `json:"schema_version"`
+}
+
+func newEnvelope(instance, event string) eventEnvelope {
+	return eventEnvelope{Event: event, TS: nowUTC(), Instance: instance, SchemaVersion: eventSchemaVersion}
+}
+
+type startedEvent struct {
+	eventEnvelope
+	Total     int    `json:"total"`
+	Remaining int    `json:"remaining"`
+	Todo      int    `json:"todo"`
+	Failed    int    `json:"failed"`
+	Done      int    `json:"done"`
+	Blocked   int    `json:"blocked"`
+	Parallel  int    `json:"parallel"`
+	Timeout   string `json:"timeout"`
+	Cooldown  string `json:"cooldown"`
+	DryRun    bool   `json:"dry_run"`
+}
+
+type staleRecoveredEvent struct {
+	eventEnvelope
+	TaskID string `json:"task_id"`
+	Runner string `json:"runner,omitempty"`
+}
+
+type dryRunTaskEvent struct {
+	eventEnvelope
+	TaskID string `json:"task_id"`
+	Title  string `json:"title"`
+}
+
+type taskStartEvent struct {
+	eventEnvelope
+	TaskID   string `json:"task_id"`
+	RunID    string `json:"run_id"`
+	Title    string `json:"title"`
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"`
+	Attempt  int    `json:"attempt"`
+}
+
+type agentOutputEvent struct {
+	eventEnvelope
+	TaskID string `json:"task_id"`
+	Source string `json:"source"`
+	Line   string `json:"line"`
+}
+
+type transientRetryEvent struct {
+	eventEnvelope
+	TaskID     string `json:"task_id"`
+	Reason     string `json:"reason"`
+	Retry      int    `json:"retry"`
+	MaxRetries int    `json:"max_retries"`
+	Backoff    string `json:"backoff"`
+}
+
+type fallbackEvent struct {
+	eventEnvelope
+	TaskID       string `json:"task_id"`
+	FromProvider string `json:"from_provider"`
+	FromModel    string `json:"from_model,omitempty"`
+	ToProvider   string `json:"to_provider"`
+	ToModel      string `json:"to_model,omitempty"`
+	Reason       string `json:"reason"`
+	Error        string `json:"error,omitempty"`
+}
+
+type verifyFailedEvent struct {
+	eventEnvelope
+	TaskID     string `json:"task_id"`
+	Command    string `json:"command"`
+	OutputTail string `json:"output_tail,omitempty"`
+}
+
+type taskFinishedEvent struct {
+	eventEnvelope
+	TaskID   string `json:"task_id"`
+	RunID    string `json:"run_id"`
+	Status   string `json:"status"`
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+	Commit   string `json:"commit,omitempty"`
+}
+
+type taskInterruptedEvent struct {
+	eventEnvelope
+	TaskID string `json:"task_id"`
+	RunID  string `json:"run_id"`
+}
+
+type taskRemovedEvent struct {
+	eventEnvelope
+	TaskID string `json:"task_id"`
+	RunID  string `json:"run_id"`
+}
+
+type interruptedEvent struct {
+	eventEnvelope
+}
+
+type notifyErrorEvent struct {
+	eventEnvelope
+	Error string `json:"error"`
+}
+
+type finishedEvent struct {
+	eventEnvelope
+	Processed int      `json:"processed"`
+	Done      int      `json:"done"`
+	Failed    int      `json:"failed"`
+	Blocked   int      `json:"blocked"`
+	DryRun    bool     `json:"dry_run"`
+	TaskIDs   []string `json:"task_ids,omitempty"`
+}
+
+// goEventTypes lists every event go --json can emit, in the order they
+// appear in the schema.
+var goEventTypes = []struct {
+	Name        string
+	Description string
+	Sample      any
+}{
+	{"started", "Loop started; counts reflect tasks.jsonl after stale recovery.", startedEvent{}},
+	{"stale_recovered", "A task left in_progress by a previous run was reset to todo.", staleRecoveredEvent{}},
+	{"dry_run_task", "A task that would run (go --dry-run only).", dryRunTaskEvent{}},
+	{"task_start", "An agent run for a task started.", taskStartEvent{}},
+	{"agent_output", "One line of agent or verify output (go --stream only).", agentOutputEvent{}},
+	{"transient_retry", "A transient provider failure will be retried after a backoff.", transientRetryEvent{}},
+	{"fallback", "A provider failed and the next provider in the fallback chain was tried.", fallbackEvent{}},
+	{"verify_failed", "A verify command failed.", verifyFailedEvent{}},
+	{"task_finished", "A task attempt was recorded as done, failed, or blocked.", taskFinishedEvent{}},
+	{"task_interrupted", "A running task was interrupted and reset to todo.", taskInterruptedEvent{}},
+	{"task_removed", "A task was removed from tasks.jsonl while it was running.", taskRemovedEvent{}},
+	{"interrupted", "The loop is stopping because of an interrupt.", interruptedEvent{}},
+	{"notify_error", "Emitting the completion notification failed (non-fatal).", notifyErrorEvent{}},
+	{"finished", "Loop finished; always the last event.", finishedEvent{}},
+}
+
+var eventMu sync.Mutex
+
+// emitEvent writes v as a single NDJSON line. Safe for concurrent use.
+func emitEvent(v any) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return
+	}
+	eventMu.Lock()
+	defer eventMu.Unlock()
+	_, _ = os.Stdout.Write(append(b, '\n'))
+}
+
+// eventsJSONSchema builds the JSON Schema for the go --json stream from the
+// event types themselves so the two cannot drift apart.
+func eventsJSONSchema() map[string]any {
+	defs := map[string]any{}
+	refs := make([]any, 0, len(goEventTypes))
+	for _, et := range goEventTypes {
+		props, required := structJSONSchema(reflect.TypeOf(et.Sample))
+		props["event"] = map[string]any{"const": et.Name}
+		props["schema_version"] = map[string]any{"const": eventSchemaVersion}
+		defs[et.Name] = map[string]any{
+			"type":                 "object",
+			"description":          et.Description,
+			"properties":           props,
+			"required":             required,
+			"additionalProperties": false,
+		}
+		refs = append(refs, map[string]any{"$ref": "#/$defs/" + et.Name})
+	}
+	return map[string]any{
+		"$schema":        "https://json-schema.org/draft/2020-12/schema",
+		"$id":            fmt.Sprintf("urn:obliviate:events:v%d", eventSchemaVersion),
+		"title":          "obliviate go --json event",
+		"description":    "Each line of `obliviate go --json` output is one of these objects.",
+		"schema_version": eventSchemaVersion,
+		"oneOf":          refs,
+		"$defs":          defs,
+	}
+}
+
+func structJSONSchema(t reflect.Type) (map[string]any, []string) {
+	props := map[string]any{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Anonymous {
+			p, r := structJSONSchema(f.Type)
+			for k, v := range p {
+				props[k] = v
+			}
+			required = append(required, r...)
+			continue
+		}
+		name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		props[name] = jsonSchemaType(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	sort.Strings(required)
+	return props, required
+}
+
+func jsonSchemaType(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int64:
+		return map[string]any{"type": "integer"}
+	case reflect.Slice:
+		return map[string]any{"type": "array", "items": jsonSchemaType(t.Elem())}
+	default:
+		return map[string]any{}
+	}
+}
+
+// goConfig carries the settings shared by every task attempt in one go run.
+type goConfig struct {
+	Instance            string
+	InstDir             string
+	Home                string
+	Workdir             string
+	TasksPath           string
+	RunsPath            string
+	JSON                bool
+	RequireCommit       bool
+	AgentTimeout        time.Duration
+	MaxAttempts         int
+	MaxTransientRetries int
+	Providers           providerRegistry
+	Fallback            fallbackConfig
+	KeepRuns            int
+	VerifyTimeout       time.Duration
+	VerifyMode          string
+	PromptBudget        int
+	PromptTemplate      *promptTemplate
+	RunnerID            string
+	Stream              bool
+	AutoCommit          bool
+	CommitTemplate      *template.Template
+	AllowStateCommit    bool
+	RollbackOnFail      bool
+	BranchMode          string
+	TargetBranch        string
+	MergeStrategy       string
+	// StateRel is the state directory relative to the repository top,
+	// which auto-commit and rollback leave alone.
+	StateRel     string
+	StateIgnored bool
+}
+
+// taskResult reports how a single task attempt ended. Status is empty when
+// the task vanished from tasks.jsonl while it was running.
+type taskResult struct {
+	TaskID      string
+	Status      string
+	Interrupted bool
+}
+
+// claimNextTask picks the next runnable task under the instance lock and
+// marks it in_progress (or done, for dry runs) before releasing the lock.
+func claimNextTask(cfg goConfig, priorityFloor string, dryRun bool) (Task, bool, error) {
+	lockRelease, err := acquireInstanceLock(cfg.InstDir)
+	if err != nil {
+		return Task{}, false, err
+	}
+	defer lockRelease()
+
+	tasks, err := loadTasks(cfg.TasksPath)
+	if err != nil {
+		return Task{}, false, err
+	}
+	if markBlockedDependents(tasks) {
+		if err := saveTasks(cfg.TasksPath, tasks); err != nil {
+			return Task{}, false, err
+		}
+	}
+
+	idx := nextRunnableTaskIndex(tasks, cfg.MaxAttempts, priorityFloor)
+	if idx < 0 {
+		return Task{}, false, nil
+	}
+	t := tasks[idx]
+	if dryRun {
+		tasks[idx].Status = statusDone
+		_ = saveTasks(cfg.TasksPath, tasks)
+		return t, true, nil
+	}
+
+	tasks[idx].Status = statusInProgress
+	tasks[idx].Runner = cfg.RunnerID
+	tasks[idx].UpdatedAt = nowUTC()
+	if err := saveTasks(cfg.TasksPath, tasks); err != nil {
+		return Task{}, false, err
+	}
+	return t, true, nil
+}
+
+// runTaskAttempt runs the agent for a claimed task in workdir, applies the
+// verify and commit gates, and records the outcome under the instance lock.
+// When integrate is non-nil it is called under that lock after the gates
+// pass; it returns the tip of the attempt's commits as they landed, which
+// differs from the original when they were rebased, and an error fails the
+// attempt. Rollback runs with the lock released, and so does park, when
+// non-nil: it sets a failed attempt's branch or leftovers aside and records
+// where in run.
+func runTaskAttempt(ctx context.Context, cfg goConfig, t Task, workdir string, integrate func() (string, error), park func(run *RunLog)) (taskResult, error) {
+	if cfg.AutoCommit {
+		if err := autoCommitClean(cfg, workdir); err != nil {
+			unclaimTask(cfg, t.ID)
+			return taskResult{}, fmt.Errorf("%s: %w", t.ID, err)
+		}
+	}
+	start := nowUTC()
+	primaryProvider, primaryModel := routeModel(cfg.Providers, t.ModelHint)
+	prompt, _, err := buildExecutionPrompt(cfg.Home, cfg.Instance, t, cfg.PromptBudget, cfg.PromptTemplate)
+	if err != nil {
+		return taskResult{}, err
+	}
+
+	run := RunLog{
+		RunID:           newRunID(t.ID),
+		TaskID:          t.ID,
+		PrimaryProvider: primaryProvider,
+		PrimaryModel:    primaryModel,
+		Branch:          t.Branch,
+		StartedAt:       start,
+	}
+	art, err := openRunArtifacts(cfg.InstDir, run.RunID, prompt)
+	if err != nil {
+		return taskResult{}, err
+	}
+	run.PromptPath, run.OutputPath, run.VerifyPath = art.PromptPath, art.OutputPath, art.VerifyPath
+	if cfg.JSON {
+		emitEvent(taskStartEvent{
+			eventEnvelope: newEnvelope(cfg.Instance, "task_start"),
+			TaskID:        t.ID,
+			RunID:         run.RunID,
+			Title:         t.Title,
+			Provider:      primaryProvider,
+			Model:         primaryModel,
+			Attempt:       t.Attempts + 1,
+		})
+	} else {
+		fmt.Printf("%s starting %s (%s) [%s/%s] attempt=%d\n", t.ID, t.Title, t.ModelHint, primaryProvider, primaryModel, t.Attempts+1)
+	}
+	defer func() {
+		art.Close()
+		_ = writeRunRecord(cfg.InstDir, run)
+	}()
+	var agentW, verifyW io.Writer = art.Output, art.Verify
+	if cfg.Stream {
+		agentLines := newLineWriter(func(line string) { emitOutputLine(cfg, t.ID, "agent", line) })
+		verifyLines := newLineWriter(func(line string) { emitOutputLine(cfg, t.ID, "verify", line) })
+		defer agentLines.Flush()
+		defer verifyLines.Flush()
+		agentW = io.MultiWriter(art.Output, agentLines)
+		verifyW = io.MultiWriter(art.Verify, verifyLines)
+	}
+
+	headBefore, headBeforeErr := gitHead(workdir)
+	var snap gitSnapshot
+	if cfg.RollbackOnFail {
+		if snap, err = snapshotWorkdir(workdir, cfg.stateExclude()); err != nil {
+			return taskResult{}, fmt.Errorf("%s: snapshot workdir: %w", t.ID, err)
+		}
+	}
+	rollback := func(reason string) {
+		if !cfg.RollbackOnFail {
+			return
+		}
+		ref := rollbackRef(workdir, cfg.Instance, t.ID, t.Attempts+1)
+		msg := fmt.Sprintf("obliviate: %s attempt %d (%s)\n\n%s\n\nObliviate-Instance: %s\nObliviate-Task: %s\nObliviate-Run: %s\n", t.ID, t.Attempts+1, t.Title, reason, cfg.Instance, t.ID, run.RunID)
+		saved, err := rollbackWorkdir(workdir, cfg.stateExclude(), snap, ref, msg)
+		run.RollbackRef = saved
+		if err != nil {
+			run.RollbackError = err.Error()
+			if !cfg.JSON {
+				fmt.Fprintf(os.Stderr, "%s: rollback: %v\n", t.ID, err)
+			}
+			return
+		}
+		if saved != "" && !cfg.JSON {
+			fmt.Printf("%s rolled back; work saved to %s\n", t.ID, saved)
+		}
+	}
+
+	// Transient retry loop.
+	var provider, model, agentOut string
+	var execErr error
+	var hops []fallbackHop
+	transientRetries := 0
+	for {
+		provider, model, agentOut, execErr, hops = runAgentWithFallback(ctx, cfg.Providers, cfg.Fallback, primaryProvider, primaryModel, workdir, prompt, cfg.AgentTimeout, agentW)
+
+		// If interrupted during agent execution, bail out.
+		if ctx.Err() != nil {
+			break
+		}
+
+		if execErr != nil {
+			reason := classifyProviderFailure(execErr, agentOut)
+			if isTransientFailure(reason) && transientRetries < cfg.MaxTransientRetries {
+				transientRetries++
+				backoff := 30 * time.Second * (1 << (transientRetries - 1))
+				if backoff > 120*time.Second {
+					backoff = 120 * time.Second
+				}
+				if cfg.JSON {
+					emitEvent(transientRetryEvent{
+						eventEnvelope: newEnvelope(cfg.Instance, "transient_retry"),
+						TaskID:        t.ID,
+						Reason:        reason,
+						Retry:         transientRetries,
+						MaxRetries:    cfg.MaxTransientRetries,
+						Backoff:       backoff.String(),
+					})
+				} else {
+					fmt.Printf("%s transient failure (%s), retry %d/%d after %s\n", t.ID, reason, transientRetries, cfg.MaxTransientRetries, backoff)
+				}
+				fmt.Fprintf(agentW, "\n[obliviate transient retry %d/%d after %s: %s]\n", transientRetries, cfg.MaxTransientRetries, backoff, reason)
+				select {
+				case <-time.After(backoff):
+					continue
+				case <-ctx.Done():
+					break
+				}
+				if ctx.Err() != nil {
+					break
+				}
+			}
+		}
+		break
+	}
+
+	run.Provider = provider
+	run.Model = model
+	run.OutputTail = tail(agentOut, 1000)
+	if len(hops) > 0 {
+		last := hops[len(hops)-1]
+		run.FallbackProvider = last.Provider
+		run.FallbackModel = last.Model
+		run.FallbackReason = hops[0].Reason
+		run.Fallbacks = hops
+	}
+	fromProvider, fromModel := primaryProvider, primaryModel
+	for _, hop := range hops {
+		if cfg.JSON {
+			emitEvent(fallbackEvent{
+				eventEnvelope: newEnvelope(cfg.Instance, "fallback"),
+				TaskID:        t.ID,
+				FromProvider:  fromProvider,
+				FromModel:     fromModel,
+				ToProvider:    hop.Provider,
+				ToModel:       hop.Model,
+				Reason:        hop.Reason,
+				Error:         hop.Error,
+			})
+		} else {
+			fmt.Printf("%s fallback %s -> %s (%s)\n", t.ID, providerLabel(fromProvider, fromModel), providerLabel(hop.Provider, hop.Model), hop.Reason)
+		}
+		fromProvider, fromModel = hop.Provider, hop.Model
+	}
+
+	if execErr == nil && ctx.Err() == nil {
+		mode := t.VerifyMode
+		if mode == "" {
+			mode = cfg.VerifyMode
+		}
+		var failed []string
+		failedOutput := ""
+		for _, v := range t.Verify {
+			fmt.Fprintf(verifyW, "$ %s\n", v.Cmd)
+			verifyStart := time.Now()
+			out, verifyErr := runVerify(workdir, v, cfg.VerifyTimeout, verifyW)
+			writeVerifyResult(verifyW, out, verifyErr)
+			result := VerifyResult{
+				Cmd:      v.Cmd,
+				ExitCode: verifyExitCode(verifyErr),
+				Duration: time.Since(verifyStart).Round(time.Millisecond).String(),
+			}
+			if verifyErr != nil {
+				result.OutputTail = tail(out+"\n"+verifyErr.Error(), 1000)
+				failed = append(failed, v.Cmd)
+				failedOutput += out + "\n" + verifyErr.Error() + "\n"
+				if cfg.JSON {
+					emitEvent(verifyFailedEvent{
+						eventEnvelope: newEnvelope(cfg.Instance, "verify_failed"),
+						TaskID:        t.ID,
+						Command:       v.Cmd,
+						OutputTail:    result.OutputTail,
+					})
+				}
+			}
+			run.VerifyResults = append(run.VerifyResults, result)
+			if verifyErr != nil && mode != verifyModeAll {
+				break
+			}
+		}
+		switch {
+		case len(failed) == 1:
+			execErr = fmt.Errorf("verify failed: %s", failed[0])
+		case len(failed) > 1:
+			execErr = fmt.Errorf("verify failed (%d of %d): %s", len(failed), len(t.Verify), quoteList(failed))
+		}
+		if len(failed) > 0 {
+			run.VerifyFailed = failed[0]
+			run.OutputTail = tail(run.OutputTail+"\n"+failedOutput, 1000)
+		}
+	}
+
+	if execErr == nil && ctx.Err() == nil && cfg.AutoCommit {
+		sha, err := autoCommit(cfg, workdir, commitTemplateData{Instance: cfg.Instance, Task: t, RunID: run.RunID, Provider: provider, Model: model})
+		if err != nil {
+			execErr = err
+		} else if sha != "" {
+			run.CommitSHA = sha
+			if !cfg.JSON {
+				fmt.Printf("%s committed %s\n", t.ID, shortSHA(sha))
+			}
+		}
+	}
+
+	if execErr == nil && cfg.RequireCommit {
+		if headBeforeErr != nil {
+			execErr = fmt.Errorf("require-commit: resolve pre-task git head: %w", headBeforeErr)
+		} else {
+			headAfter, headAfterErr := gitHead(workdir)
+			if headAfterErr != nil {
+				execErr = fmt.Errorf("require-commit: resolve post-task git head: %w", headAfterErr)
+			} else if headAfter == headBefore {
+				execErr = errors.New("require-commit enabled: no new commit created")
+			}
+		}
+	}
+
+	if headBeforeErr == nil {
+		run.DiffStat = diffSummary(workdir, headBefore)
+		recordGitFacts(&run, workdir, headBefore)
+	}
+
+	// Decide once whether the attempt was interrupted: after integration
+	// has landed the work, a late signal must not roll it back.
+	interrupted := ctx.Err() != nil
+
+	// Integrate under the lock so parallel workers land one at a time. A
+	// task removed while it ran is not integrated.
+	removed := false
+	if !interrupted {
+		lockRelease, err := acquireInstanceLock(cfg.InstDir)
+		if err != nil {
+			return taskResult{}, err
+		}
+		tasks, err := loadTasks(cfg.TasksPath)
+		if err != nil {
+			lockRelease()
+			return taskResult{}, err
+		}
+		removed = findTaskIndex(tasks, t.ID) < 0
+		if !removed && execErr == nil && integrate != nil {
+			from, _ := cfg.targetTip()
+			var head string
+			head, execErr = integrate()
+			if to, err := cfg.targetTip(); execErr == nil && err == nil && from != "" && to != from {
+				run.LandedFrom, run.LandedTo = from, to
+			}
+			// A rebase rewrites the attempt's commits; the tip is the last one.
+			if head != "" && len(run.Commits) > 0 && head != run.Commits[len(run.Commits)-1].SHA {
+				run.Commits = landedCommits(cfg.Workdir, head, run.Commits)
+				run.HeadAfter = head
+			}
+			if run.CommitSHA != "" && head != "" {
+				run.CommitSHA = head
+			}
+		}
+		lockRelease()
+	}
+	if execErr != nil {
+		// Gate or integration failures leave the commit out of the workdir.
+		run.CommitSHA = ""
+	}
+	// Roll back before taking the lock again; the git cleanup can be slow
+	// and other commands would wait on it.
+	switch {
+	case interrupted:
+		rollback("interrupted")
+	case removed:
+		rollback("task removed while it ran")
+	case execErr != nil:
+		rollback(execErr.Error())
+	}
+	if park != nil && !interrupted && (removed || execErr != nil) {
+		park(&run)
+	}
+
+	// Re-acquire lock to update task state.
+	lockRelease, err := acquireInstanceLock(cfg.InstDir)
+	if err != nil {
+		return taskResult{}, err
+	}
+	defer lockRelease()
+	// Reload tasks under lock (another process may have modified them).
+	tasks, err := loadTasks(cfg.TasksPath)
+	if err != nil {
+		return taskResult{}, err
+	}
+	// Re-find the task (index may have shifted).
+	idx := findTaskIndex(tasks, t.ID)
+	if idx < 0 {
+		// Task was removed while we were running; skip.
+		run.FinishedAt = nowUTC()
+		if cfg.JSON {
+			emitEvent(taskRemovedEvent{eventEnvelope: newEnvelope(cfg.Instance, "task_removed"), TaskID: t.ID, RunID: run.RunID})
+		}
+		return taskResult{TaskID: t.ID}, nil
+	}
+	tasks[idx].Runner = ""
+	if t.Branch != "" {
+		tasks[idx].Branch = run.Branch
+		tasks[idx].BranchTarget = t.BranchTarget
+		tasks[idx].MergeStrategy = t.MergeStrategy
+	}
+
+	// If interrupted, reset task to todo and exit.
+	if interrupted {
+		run.Status = "interrupted"
+		run.FinishedAt = nowUTC()
+		tasks[idx].Status = statusTodo
+		tasks[idx].UpdatedAt = nowUTC()
+		_ = saveTasks(cfg.TasksPath, tasks)
+		if cfg.JSON {
+			emitEvent(taskInterruptedEvent{eventEnvelope: newEnvelope(cfg.Instance, "task_interrupted"), TaskID: t.ID, RunID: run.RunID})
+		} else {
+			fmt.Printf("%s interrupted, reset to todo\n", t.ID)
+		}
+		return taskResult{TaskID: t.ID, Interrupted: true}, nil
+	}
+	run.FinishedAt = nowUTC()
+
+	if entries := parseLearnings(agentOut); len(entries) > 0 {
+		run.Learnings = len(entries)
+		if err := recordLearnings(cfg.Home, cfg.Instance, t.ID, entries); err != nil && !cfg.JSON {
+			fmt.Fprintf(os.Stderr, "%s: record learnings: %v\n", t.ID, err)
+		}
+	}
+
+	if execErr != nil {
+		tasks[idx].Attempts++
+		tasks[idx].LastError = execErr.Error()
+		tasks[idx].UpdatedAt = nowUTC()
+		if tasks[idx].Attempts >= cfg.MaxAttempts {
+			tasks[idx].Status = statusBlocked
+		} else {
+			tasks[idx].Status = statusFailed
+		}
+		run.Status = tasks[idx].Status
+		run.Error = execErr.Error()
+		if !cfg.JSON {
+			fmt.Printf("%s %s -> %s: %s\n", t.ID, t.Title, tasks[idx].Status, execErr.Error())
+		}
+	} else {
+		tasks[idx].Status = statusDone
+		tasks[idx].UpdatedAt = nowUTC()
+		tasks[idx].LastError = ""
+		run.Status = statusDone
+		// Without integration the work landed where the agent made it.
+		if integrate == nil && run.HeadAfter != run.HeadBefore && run.HeadBefore != "" {
+			run.LandedFrom, run.LandedTo = run.HeadBefore, run.HeadAfter
+		}
+		if !cfg.JSON {
+			fmt.Printf("%s %s -> done\n", t.ID, t.Title)
+		}
+	}
+
+	if err := appendJSONLine(cfg.RunsPath, run); err != nil {
+		return taskResult{}, err
+	}
+	if err := saveTasks(cfg.TasksPath, tasks); err != nil {
+		return taskResult{}, err
+	}
+	if cfg.JSON {
+		emitEvent(taskFinishedEvent{
+			eventEnvelope: newEnvelope(cfg.Instance, "task_finished"),
+			TaskID:        t.ID,
+			RunID:         run.RunID,
+			Status:        run.Status,
+			Provider:      run.Provider,
+			Model:         run.Model,
+			Attempts:      tasks[idx].Attempts,
+			Error:         run.Error,
+			Commit:        run.CommitSHA,
+		})
+	}
+	if cfg.KeepRuns > 0 {
+		_ = pruneRunArtifacts(cfg.InstDir, cfg.KeepRuns)
+	}
+	return taskResult{TaskID: t.ID, Status: run.Status}, nil
+}
+
+// runParallel keeps up to n task attempts running at once, each inside its
+// own git worktree. Tasks are claimed one at a time under the instance lock,
+// so dependency and priority ordering still apply to every launch.
+func runParallel(ctx context.Context, cfg goConfig, n, limit int, priorityFloor string, cooldown time.Duration, tally func(taskResult)) error {
+	type workerResult struct {
+		res taskResult
+		err error
+	}
+	results := make(chan workerResult)
+	active := 0
+	launched := 0
+	var firstErr error
+	stopping := false
+
+	collect := func() {
+		r := <-results
+		active--
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			stopping = true
+			return
+		}
+		if r.res.Interrupted {
+			stopping = true
+			return
+		}
+		tally(r.res)
+	}
+
+	for {
+		if ctx.Err() != nil && !stopping {
+			if cfg.JSON {
+				emitEvent(interruptedEvent{eventEnvelope: newEnvelope(cfg.Instance, "interrupted")})
+			} else {
+				fmt.Println("interrupted, waiting for running tasks to stop")
+			}
+			stopping = true
+		}
+		if stopping || (limit > 0 && launched >= limit) {
+			break
+		}
+		if active >= n {
+			collect()
+			continue
+		}
+
+		t, ok, err := claimNextTask(cfg, priorityFloor, false)
+		if err != nil {
+			firstErr = err
+			break
+		}
+		if !ok {
+			if active == 0 {
+				break
+			}
+			// A running task may unblock dependents once it finishes.
+			collect()
+			continue
+		}
+
+		active++
+		launched++
+		go func(t Task) {
+			res, err := runTaskInWorktree(ctx, cfg, t)
+			results <- workerResult{res: res, err: err}
+		}(t)
+
+		if cooldown > 0 {
+			select {
+			case <-time.After(cooldown):
+			case <-ctx.Done():
+			}
+		}
+	}
+	for active > 0 {
+		collect()
+	}
+	return firstErr
+}
+
+// runTaskInWorktree runs one task attempt in a fresh detached worktree and,
+// once its gates pass, rebases the new commits onto the workdir's current
+// HEAD and fast-forwards the workdir to them. The worktree is always removed.
+func runTaskInWorktree(ctx context.Context, cfg goConfig, t Task) (taskResult, error) {
+	branch := taskBranchName(cfg.BranchMode, cfg.Instance, t.ID)
+	wt, base, err := createTaskWorktree(cfg.Workdir, cfg.Instance, t.ID, branch)
+	if err != nil {
+		unclaimTask(cfg, t.ID)
+		return taskResult{}, fmt.Errorf("%s: create worktree: %w", t.ID, err)
+	}
+	defer removeTaskWorktree(cfg.Workdir, wt)
+
+	var park func(run *RunLog)
+	if branch != "" {
+		t.Branch, t.BranchTarget, t.MergeStrategy = branch, cfg.TargetBranch, cfg.MergeStrategy
+		park = func(run *RunLog) { parkTaskBranch(cfg, t, wt, run) }
+	}
+	return runTaskAttempt(ctx, cfg, t, wt, func() (string, error) {
+		if branch != "" && cfg.MergeStrategy == mergeStrategyMerge {
+			return mergeWorktreeBranch(cfg.Workdir, wt, branch, branchMergeMessage(cfg.Instance, t, branch))
+		}
+		return integrateWorktree(cfg.Workdir, wt, base)
+	}, park)
+}
+
+// runTaskInWorkdir runs one attempt in the workdir itself. Under
+// --branch-mode it first switches to the task's branch and, once the gates
+// pass, lands that branch on the target. In task mode a failed branch is
+// kept under its attempt's name and the workdir goes back to the target; in
+// instance mode a failed attempt's uncommitted leftovers are saved to a ref.
+// Either way the next task starts on a clean tree.
+func runTaskInWorkdir(ctx context.Context, cfg goConfig, t Task) (taskResult, error) {
+	if cfg.BranchMode == "" {
+		return runTaskAttempt(ctx, cfg, t, cfg.Workdir, nil, nil)
+	}
+	branch := taskBranchName(cfg.BranchMode, cfg.Instance, t.ID)
+	if err := checkoutTaskBranch(cfg.Workdir, cfg.stateExclude(), branch, cfg.TargetBranch); err != nil {
+		unclaimTask(cfg, t.ID)
+		return taskResult{}, fmt.Errorf("%s: %w", t.ID, err)
+	}
+	t.Branch, t.BranchTarget, t.MergeStrategy = branch, cfg.TargetBranch, cfg.MergeStrategy
+	park := func(run *RunLog) { parkInstanceLeftovers(cfg, t, run) }
+	if cfg.BranchMode == branchModeTask {
+		park = func(run *RunLog) { parkTaskBranch(cfg, t, cfg.Workdir, run) }
+	}
+	res, err := runTaskAttempt(ctx, cfg, t, cfg.Workdir, func() (string, error) {
+		return mergeTaskBranch(cfg.Workdir, cfg.stateExclude(), branch, cfg.TargetBranch, cfg.MergeStrategy, branchMergeMessage(cfg.Instance, t, branch))
+	}, park)
+	if err == nil && res.Interrupted && cfg.BranchMode == branchModeTask {
+		if dirty, dirtyErr := workdirDirty(cfg.Workdir, cfg.stateExclude()); dirtyErr == nil && dirty == "" {
+			_, _ = runGit(cfg.Workdir, "checkout", "-q", cfg.TargetBranch)
+		}
+	}
+	return res, err
+}
+
+func leftoversMessage(instance string, t Task) string {
+	return fmt.Sprintf("WIP %s: uncommitted changes left by a failed attempt\n\nObliviate-Instance: %s\nObliviate-Task: %s\n", t.ID, instance, t.ID)
+}
+
+// parkTaskBranch sets a failed task branch aside in dir, where it is
+// checked out, and records the name it was kept under on run.
+func parkTaskBranch(cfg goConfig, t Task, dir string, run *RunLog) {
+	kept, err := parkBranch(cfg.Workdir, dir, cfg.stateExclude(), t.Branch, cfg.TargetBranch, t.Attempts+1, leftoversMessage(cfg.Instance, t))
+	if err != nil {
+		if !cfg.JSON {
+			fmt.Fprintf(os.Stderr, "%s: set aside %s: %v\n", t.ID, t.Branch, err)
+		}
+		return
+	}
+	run.Branch = kept
+	if kept != "" && !cfg.JSON {
+		fmt.Printf("%s failed attempt kept on %s\n", t.ID, kept)
+	}
+}
+
+// parkInstanceLeftovers saves what a failed attempt left uncommitted on the
+// instance branch to a ref, so the next task does not inherit it.
+func parkInstanceLeftovers(cfg goConfig, t Task, run *RunLog) {
+	ref := rollbackRef(cfg.Workdir, cfg.Instance, t.ID, t.Attempts+1)
+	saved, err := saveLeftovers(cfg.Workdir, cfg.stateExclude(), ref, leftoversMessage(cfg.Instance, t))
+	if err != nil {
+		if !cfg.JSON {
+			fmt.Fprintf(os.Stderr, "%s: save leftovers: %v\n", t.ID, err)
+		}
+		return
+	}
+	if saved != "" {
+		run.RollbackRef = saved
+		if !cfg.JSON {
+			fmt.Printf("%s left uncommitted changes; saved to %s\n", t.ID, saved)
+		}
+	}
+}
+
+// parkBranch sets a failed task branch aside so the task's next attempt
+// starts from target instead of building on unverified work. Uncommitted
+// leftovers are committed to the branch first, then it is renamed to
+// <branch>-attempt-<n>: git cannot hold refs both at a branch name and below
+// it, so the attempt cannot live under <branch>/. A branch with nothing
+// beyond target is deleted and "" returned. The workdir ends up on target; a
+// worktree (dir != workdir) is detached.
+func parkBranch(workdir, dir, stateExclude, branch, target string, attempt int, message string) (string, error) {
+	if current := currentBranch(dir); current != branch {
+		return "", fmt.Errorf("expected %s checked out, found %s", branch, orDash(current))
+	}
+	if _, err := commitLeftovers(dir, stateExclude, message); err != nil {
+		return "", err
+	}
+	leave := []string{"checkout", "-q", target}
+	if dir != workdir {
+		leave = []string{"checkout", "-q", "--detach"}
+	}
+	if _, err := runGit(dir, leave...); err != nil {
+		return "", err
+	}
+	if _, err := runGit(workdir, "merge-base", "--is-ancestor", branch, target); err == nil {
+		_, err = runGit(workdir, "branch", "-q", "-D", branch)
+		return "", err
+	}
+	kept := fmt.Sprintf("%s-attempt-%d", branch, attempt)
+	for i := 2; branchExists(workdir, kept); i++ {
+		kept = fmt.Sprintf("%s-attempt-%d-%d", branch, attempt, i)
+	}
+	if _, err := runGit(workdir, "branch", "-m", branch, kept); err != nil {
+		return "", err
+	}
+	return kept, nil
+}
+
+// saveLeftovers moves uncommitted changes in workdir, outside the state
+// directory, into a commit on top of HEAD stored under ref, and cleans the
+// tree. It returns "" when there was nothing to save.
+func saveLeftovers(workdir, stateExclude, ref, message string) (string, error) {
+	dirty, err := workdirDirty(workdir, stateExclude)
+	if err != nil || dirty == "" {
+		return "", err
+	}
+	head, err := gitHead(workdir)
+	if err != nil {
+		return "", err
+	}
+	tree, err := workingTree(workdir, stateExclude)
+	if err != nil {
+		return "", err
+	}
+	commit, err := runGit(workdir, "commit-tree", tree, "-p", head, "-m", message)
+	if err != nil {
+		return "", err
+	}
+	if _, err := runGit(workdir, "update-ref", ref, commit); err != nil {
+		return "", err
+	}
+	if _, err := runGit(workdir, "reset", "-q", "--hard"); err != nil {
+		return ref, err
+	}
+	if _, err := runGit(workdir, append([]string{"clean", "-fdq"}, stateExcludePathspec(stateExclude)...)...); err != nil {
+		return ref, err
+	}
+	return ref, nil
+}
+
+// commitLeftovers commits whatever is uncommitted in workdir, outside the
+// state directory, to the checked-out branch. Hooks are skipped: the commit
+// only keeps a failed attempt's work for inspection. It returns "" when the
+// tree was clean.
+func commitLeftovers(workdir, stateExclude, message string) (string, error) {
+	dirty, err := workdirDirty(workdir, stateExclude)
+	if err != nil || dirty == "" {
+		return "", err
+	}
+	if _, err := runGit(workdir, append([]string{"add", "-A"}, stateExcludePathspec(stateExclude)...)...); err != nil {
+		return "", err
+	}
+	if _, err := runGit(workdir, "commit", "-q", "--no-verify", "-m", message); err != nil {
+		return "", err
+	}
+	return gitHead(workdir)
+}
+
+// unclaimTask hands a claimed task back to todo when its attempt could not
+// start, so a later run can pick it up again.
+func unclaimTask(cfg goConfig, taskID string) {
+	lockRelease, err := acquireInstanceLock(cfg.InstDir)
+	if err != nil {
+		return
+	}
+	defer lockRelease()
+	tasks, err := loadTasks(cfg.TasksPath)
+	if err != nil {
+		return
+	}
+	if idx := findTaskIndex(tasks, taskID); idx >= 0 {
+		tasks[idx].Status = statusTodo
+		tasks[idx].Runner = ""
+		tasks[idx].UpdatedAt = nowUTC()
+		_ = saveTasks(cfg.TasksPath, tasks)
+	}
+}
+
+// createTaskWorktree adds a worktree at the workdir's current HEAD and
+// returns its path and base commit. The worktree is detached unless branch
+// is set; an existing branch is checked out as is, with its merge base as
+// the base. Worktrees live outside the project tree so agents in the main
+// workdir never stage them.
+func createTaskWorktree(workdir, instance, taskID, branch string) (string, string, error) {
+	base, err := gitHead(workdir)
+	if err != nil {
+		return "", "", err
+	}
+	parent := filepath.Join(os.TempDir(), "obliviate-worktrees", instance)
+	if err := ensureDir(parent); err != nil {
+		return "", "", err
+	}
+	wt := filepath.Join(parent, fmt.Sprintf("%s-%d", taskID, time.Now().UnixNano()))
+	args := []string{"worktree", "add", "--detach", wt, base}
+	if branch != "" {
+		if branchExists(workdir, branch) {
+			if base, err = runGit(workdir, "merge-base", base, branch); err != nil {
+				return "", "", err
+			}
+			args = []string{"worktree", "add", wt, branch}
+		} else {
+			args = []string{"worktree", "add", "-b", branch, wt, base}
+		}
+	}
+	if _, err := runGit(workdir, args...); err != nil {
+		return "", "", err
+	}
+	return wt, base, nil
+}
+
+func removeTaskWorktree(workdir, wt string) {
+	if _, err := runGit(workdir, "worktree", "remove", "--force", wt); err != nil {
+		_ = os.RemoveAll(wt)
+		_, _ = runGit(workdir, "worktree", "prune")
+	}
+}
+
+// integrateWorktree brings the commits made in wt since base onto the
+// workdir and returns the workdir's new HEAD, or "" when there was nothing
+// to bring over. If the workdir moved on meanwhile, the commits are rebased
+// first; a conflicting rebase is aborted and reported with the conflicting
+// paths.
+func integrateWorktree(workdir, wt, base string) (string, error) {
+	dirty, err := runGit(wt, "status", "--porcelain")
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(dirty) != "" {
+		return "", errors.New("parallel: agent left uncommitted changes in its worktree; changes must be committed to be merged")
+	}
+	head, err := gitHead(wt)
+	if err != nil {
+		return "", err
+	}
+	if head == base {
+		return "", nil
+	}
+
+	target, err := gitHead(workdir)
+	if err != nil {
+		return "", err
+	}
+	if target != base {
+		if out, err := runGit(wt, "rebase", target); err != nil {
+			return "", fmt.Errorf("merge conflict rebasing onto %s: %s", shortSHA(target), abortConflicted(wt, "rebase", out))
+		}
+		if head, err = gitHead(wt); err != nil {
+			return "", err
+		}
+	}
+	if _, err := runGit(workdir, "merge", "--ff-only", head); err != nil {
+		return "", fmt.Errorf("fast-forward workdir to %s: %w", shortSHA(head), err)
+	}
+	return head, nil
+}
+
+const defaultCommitTemplate = "{{.Task.ID}}: {{.Task.Title}}"
+
+// commitTemplateData is what go --commit-template renders against.
+type commitTemplateData struct {
+	Instance string
+	Task     Task
+	RunID    string
+	Provider string
+	Model    string
+}
+
+// parseCommitTemplate parses and trial-renders a commit message template
+// so mistakes fail at go startup rather than after a task's verify passes.
+func parseCommitTemplate(text string) (*template.Template, error) {
+	t, err := template.New("commit").Funcs(promptTemplateFuncs).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("commit-template: %w", err)
+	}
+	sample := commitTemplateData{Instance: "sample", Task: Task{ID: "OB-000", Title: "sample", Status: statusTodo}, RunID: "OB-000-sample", Provider: "codex"}
+	if _, err := renderCommitMessage(t, sample); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// renderCommitMessage renders the subject and body and appends the
+// Obliviate-* trailers that tie the commit back to its task and run.
+func renderCommitMessage(t *template.Template, data commitTemplateData) (string, error) {
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("commit-template: %w", err)
+	}
+	msg := strings.TrimSpace(b.String())
+	if msg == "" {
+		return "", errors.New("commit-template must render a non-empty message")
+	}
+	trailers := []string{
+		"Obliviate-Instance: " + data.Instance,
+		"Obliviate-Task: " + data.Task.ID,
+		"Obliviate-Title: " + strings.Join(strings.Fields(data.Task.Title), " "),
+	}
+	if label := providerLabel(data.Provider, data.Model); label != "" {
+		trailers = append(trailers, "Obliviate-Model: "+label)
+	}
+	trailers = append(trailers, "Obliviate-Run: "+data.RunID)
+	return msg + "\n\n" + strings.Join(trailers, "\n") + "\n", nil
+}
+
+// autoCommit stages everything the agent left in workdir and commits it
+// with the rendered message, returning the new HEAD, or "" when there was
+// nothing to commit. The state directory is kept out of the commit unless
+// cfg.AllowStateCommit is set; state files the agent staged itself make
+// the commit fail instead of being committed.
+func autoCommit(cfg goConfig, workdir string, data commitTemplateData) (string, error) {
+	guardState := cfg.StateRel != "" && !cfg.AllowStateCommit
+	exclude := ""
+	if guardState {
+		exclude = cfg.stateExclude()
+	}
+	if _, err := runGit(workdir, append([]string{"add", "-A"}, stateExcludePathspec(exclude)...)...); err != nil {
+		return "", fmt.Errorf("auto-commit: %w", err)
+	}
+	staged, err := runGit(workdir, "diff", "--cached", "--name-only")
+	if err != nil {
+		return "", fmt.Errorf("auto-commit: %w", err)
+	}
+	if staged == "" {
+		return "", nil
+	}
+	if guardState {
+		var state []string
+		for _, f := range strings.Split(staged, "\n") {
+			if f == cfg.StateRel || strings.HasPrefix(f, cfg.StateRel+"/") {
+				state = append(state, f)
+			}
+		}
+		if len(state) > 0 {
+			return "", fmt.Errorf("auto-commit: refusing to commit obliviate state files %s; unstage them or pass --allow-state-commit", quoteList(state))
+		}
+	}
+	msg, err := renderCommitMessage(cfg.CommitTemplate, data)
+	if err != nil {
+		return "", err
+	}
+	if _, err := runGit(workdir, "commit", "-q", "--cleanup=whitespace", "-m", msg); err != nil {
+		return "", fmt.Errorf("auto-commit: %w", err)
+	}
+	return gitHead(workdir)
+}
+
+// autoCommitClean refuses to start an auto-committed attempt on a dirty
+// tree: autoCommit stages everything, so edits that were already there
+// would be committed as the agent's work.
+func autoCommitClean(cfg goConfig, workdir string) error {
+	dirty, err := workdirDirty(workdir, cfg.stateExclude())
+	if err != nil {
+		return fmt.Errorf("auto-commit: %w", err)
+	}
+	if dirty != "" {
+		return fmt.Errorf("auto-commit: uncommitted changes in %s before the task started; commit or stash them so they are not committed as the agent's work:\n%s", workdir, dirty)
+	}
+	return nil
+}
+
+// stateDirRel returns the state directory relative to the top of the git
+// repository containing workdir, or "" when it lies outside the repository,
+// and whether git ignores it.
+func stateDirRel(workdir, stateDir string) (string, bool, error) {
+	top, err := runGit(workdir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", false, err
+	}
+	if resolved, err := filepath.EvalSymlinks(top); err == nil {
+		top = resolved
+	}
+	if resolved, err := filepath.EvalSymlinks(stateDir); err == nil {
+		stateDir = resolved
+	}
+	rel, err := filepath.Rel(filepath.Clean(top), stateDir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false, nil
+	}
+	rel = filepath.ToSlash(rel)
+	_, notIgnored := runGit(top, "check-ignore", "-q", "--no-index", rel+"/")
+	return rel, notIgnored == nil, nil
+}
+
+// targetTip is the commit a task's work lands on: the target branch under
+// --branch-mode, otherwise the workdir's HEAD.
+func (cfg goConfig) targetTip() (string, error) {
+	if cfg.TargetBranch != "" {
+		return runGit(cfg.Workdir, "rev-parse", "--verify", "-q", "refs/heads/"+cfg.TargetBranch)
+	}
+	return gitHead(cfg.Workdir)
+}
+
+// stateExclude is the state directory to exclude from `git add`. Git
+// rejects exclude pathspecs that name an ignored path, and `add -A` skips
+// ignored files anyway, so an ignored state directory needs none.
+func (cfg goConfig) stateExclude() string {
+	if cfg.StateIgnored {
+		return ""
+	}
+	return cfg.StateRel
+}
+
+// gitSnapshot is a workdir's state before an attempt, kept so
+// --rollback-on-fail can put it back. Tree is "" when the workdir was
+// clean; otherwise it holds the working files, untracked ones included,
+// and Index the index as it was staged.
+type gitSnapshot struct {
+	Head  string
+	Index string
+	Tree  string
+}
+
+// stateExcludePathspec returns the pathspec arguments that restrict a git
+// command to workdir while leaving the state directory out.
+func stateExcludePathspec(stateRel string) []string {
+	spec := []string{"--", "."}
+	if stateRel != "" {
+		spec = append(spec, ":(top,exclude)"+stateRel)
+	}
+	return spec
+}
+
+// workingTree stages everything in workdir but the state directory and
+// returns the resulting tree. The caller restores the index.
+func workingTree(workdir, stateRel string) (string, error) {
+	if _, err := runGit(workdir, append([]string{"add", "-A"}, stateExcludePathspec(stateRel)...)...); err != nil {
+		return "", err
+	}
+	return runGit(workdir, "write-tree")
+}
+
+func snapshotWorkdir(workdir, stateRel string) (gitSnapshot, error) {
+	head, err := gitHead(workdir)
+	if err != nil {
+		return gitSnapshot{}, err
+	}
+	index, err := runGit(workdir, "write-tree")
+	if err != nil {
+		return gitSnapshot{}, err
+	}
+	tree, err := workingTree(workdir, stateRel)
+	if _, resetErr := runGit(workdir, "read-tree", index); err == nil {
+		err = resetErr
+	}
+	if err != nil {
+		return gitSnapshot{}, err
+	}
+	snap := gitSnapshot{Head: head, Index: index}
+	if headTree, err := runGit(workdir, "rev-parse", head+"^{tree}"); err != nil {
+		return gitSnapshot{}, err
+	} else if tree != headTree || index != headTree {
+		snap.Tree = tree
+	}
+	return snap, nil
+}
+
+// rollbackRef returns the first unused refs/obliviate/<instance>/<task>/<n>
+// ref for an attempt; a task reset and retried keeps its earlier refs.
+func rollbackRef(workdir, instance, taskID string, attempt int) string {
+	ref := fmt.Sprintf("refs/obliviate/%s/%s/%d", instance, taskID, attempt)
+	for i := 2; ; i++ {
+		if _, err := runGit(workdir, "rev-parse", "--verify", "-q", ref); err != nil {
+			return ref
+		}
+		ref = fmt.Sprintf("refs/obliviate/%s/%s/%d-%d", instance, taskID, attempt, i)
+	}
+}
+
+// rollbackWorkdir saves what a failed attempt left in workdir, commits and
+// uncommitted edits alike, as a commit under ref, then restores the
+// snapshot. It returns "" for ref when the attempt changed nothing.
+func rollbackWorkdir(workdir, stateRel string, snap gitSnapshot, ref, message string) (string, error) {
+	head, err := gitHead(workdir)
+	if err != nil {
+		return "", err
+	}
+	tree, err := workingTree(workdir, stateRel)
+	if err != nil {
+		return "", err
+	}
+	before := snap.Tree
+	if before == "" {
+		before, _ = runGit(workdir, "rev-parse", snap.Head+"^{tree}")
+	}
+	if head == snap.Head && tree == before {
+		if _, err := runGit(workdir, "read-tree", snap.Index); err != nil {
+			return "", err
+		}
+		return "", nil
+	}
+	commit, err := runGit(workdir, "commit-tree", tree, "-p", head, "-m", message)
+	if err != nil {
+		return "", err
+	}
+	if _, err := runGit(workdir, "update-ref", ref, commit); err != nil {
+		return "", err
+	}
+	if _, err := runGit(workdir, "reset", "-q", "--hard", snap.Head); err != nil {
+		return ref, err
+	}
+	if _, err := runGit(workdir, append([]string{"clean", "-fdq"}, stateExcludePathspec(stateRel)...)...); err != nil {
+		return ref, err
+	}
+	if snap.Tree != "" {
+		if _, err := runGit(workdir, "read-tree", "-u", "--reset", snap.Tree); err != nil {
+			return ref, err
+		}
+		if _, err := runGit(workdir, "read-tree", snap.Index); err != nil {
+			return ref, err
+		}
+	}
+	return ref, nil
+}
+
+const (
+	branchModeTask     = "task"
+	branchModeInstance = "instance"
+	mergeStrategyFF    = "ff"
+	mergeStrategyMerge = "merge"
+)
+
+// taskBranchName is the branch a task runs on under --branch-mode. The
+// instance branch sits under the same prefix as task branches, so it needs
+// a leaf name of its own: git cannot hold both obliviate/<instance> and
+// obliviate/<instance>/OB-001.
+func taskBranchName(mode, instance, taskID string) string {
+	switch mode {
+	case branchModeTask:
+		return "obliviate/" + instance + "/" + taskID
+	case branchModeInstance:
+		return "obliviate/" + instance + "/queue"
+	}
+	return ""
+}
+
+func branchMergeMessage(instance string, t Task, branch string) string {
+	return fmt.Sprintf("Merge %s: %s\n\nObliviate-Instance: %s\nObliviate-Task: %s\n", branch, strings.Join(strings.Fields(t.Title), " "), instance, t.ID)
+}
+
+func branchExists(workdir, branch string) bool {
+	_, err := runGit(workdir, "rev-parse", "--verify", "-q", "refs/heads/"+branch)
+	return err == nil
+}
+
+func currentBranch(workdir string) string {
+	branch, _ := runGit(workdir, "symbolic-ref", "--short", "-q", "HEAD")
+	return branch
+}
+
+// workdirDirty lists uncommitted changes in workdir outside the state
+// directory, in `git status --porcelain` form.
+func workdirDirty(workdir, stateExclude string) (string, error) {
+	return runGit(workdir, append([]string{"status", "--porcelain"}, stateExcludePathspec(stateExclude)...)...)
+}
+
+// checkoutTaskBranch switches workdir to branch, creating it from target
+// when it does not exist yet. Failed attempts are renamed away, so an
+// existing branch is one an interrupted attempt left; it is reused.
+func checkoutTaskBranch(workdir, stateExclude, branch, target string) error {
+	current := currentBranch(workdir)
+	if current == branch {
+		return nil
+	}
+	dirty, err := workdirDirty(workdir, stateExclude)
+	if err != nil {
+		return err
+	}
+	if dirty != "" {
+		return fmt.Errorf("branch-mode: uncommitted changes on %s; commit or discard them before switching to %s, or run with --rollback-on-fail", orDash(current), branch)
+	}
+	if branchExists(workdir, branch) {
+		_, err = runGit(workdir, "checkout", "-q", branch)
+	} else {
+		_, err = runGit(workdir, "checkout", "-q", "-b", branch, target)
+	}
+	return err
+}
+
+// abortConflicted aborts a failed rebase or merge in dir and returns the
+// conflicting paths, or the tail of git's output when there were none.
+func abortConflicted(dir, op, out string) string {
+	conflicts, _ := runGit(dir, "diff", "--name-only", "--diff-filter=U")
+	_, _ = runGit(dir, op, "--abort")
+	if files := strings.Join(strings.Fields(conflicts), ", "); files != "" {
+		return files
+	}
+	return tail(strings.TrimSpace(out), 300)
+}
+
+// mergeTaskBranch lands the checked-out branch on target and leaves target
+// checked out. ff rebases the branch onto target first so the fast-forward
+// always applies; merge records a merge commit. On conflict the rebase or
+// merge is aborted and the branch is checked out again, intact. It returns
+// the tip of the branch's commits as they ended up on target.
+func mergeTaskBranch(workdir, stateExclude, branch, target, strategy, message string) (string, error) {
+	dirty, err := workdirDirty(workdir, stateExclude)
+	if err != nil {
+		return "", err
+	}
+	if dirty != "" {
+		return "", fmt.Errorf("branch-mode: agent left uncommitted changes on %s; changes must be committed to be merged (see --auto-commit)", branch)
+	}
+	if strategy == mergeStrategyFF {
+		if out, err := runGit(workdir, "rebase", "-q", target); err != nil {
+			return "", fmt.Errorf("merge conflict rebasing %s onto %s: %s", branch, target, abortConflicted(workdir, "rebase", out))
+		}
+	}
+	tip, err := gitHead(workdir)
+	if err != nil {
+		return "", err
+	}
+	if _, err := runGit(workdir, "checkout", "-q", target); err != nil {
+		return "", err
+	}
+	if strategy == mergeStrategyFF {
+		_, err = runGit(workdir, "merge", "-q", "--ff-only", branch)
+	} else if _, ancestorErr := runGit(workdir, "merge-base", "--is-ancestor", tip, "HEAD"); ancestorErr != nil {
+		var out string
+		if out, err = runGit(workdir, "merge", "-q", "--no-ff", "-m", message, branch); err != nil {
+			err = fmt.Errorf("merge conflict merging %s into %s: %s", branch, target, abortConflicted(workdir, "merge", out))
+		}
+	}
+	if err != nil {
+		_, _ = runGit(workdir, "checkout", "-q", branch)
+		return "", err
+	}
+	return tip, nil
+}
+
+// mergeWorktreeBranch merges a parallel task's branch into the workdir's
+// checked-out target with a merge commit and returns the branch tip.
+func mergeWorktreeBranch(workdir, wt, branch, message string) (string, error) {
+	dirty, err := runGit(wt, "status", "--porcelain")
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(dirty) != "" {
+		return "", errors.New("parallel: agent left uncommitted changes in its worktree; changes must be committed to be merged")
+	}
+	tip, err := gitHead(wt)
+	if err != nil {
+		return "", err
+	}
+	if _, err := runGit(workdir, "merge-base", "--is-ancestor", tip, "HEAD"); err == nil {
+		return "", nil
+	}
+	if out, err := runGit(workdir, "merge", "-q", "--no-ff", "-m", message, branch); err != nil {
+		return "", fmt.Errorf("merge conflict merging %s: %s", branch, abortConflicted(workdir, "merge", out))
+	}
+	return tip, nil
+}
+
+func resolveProjectRootFromCWD() (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Clean(wd), nil
+}
+
+func resolveProjectRootFromWorkdir(workdir string) (string, error) {
+	w := strings.TrimSpace(workdir)
+	if w == "" {
+		w = "."
+	}
+	if !filepath.IsAbs(w) {
+		cwd, err := resolveProjectRootFromCWD()
+		if err != nil {
+			return "", err
+		}
+		w = filepath.Join(cwd, w)
+	}
+	w = filepath.Clean(w)
+	info, err := os.Stat(w)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("workdir must be a directory: %s", w)
+	}
+	return w, nil
+}
+
+func projectObliviateHome(projectRoot string) string {
+	return filepath.Join(projectRoot, ".obliviate")
+}
+
+func projectStateDir(projectRoot string) string {
+	return filepath.Join(projectObliviateHome(projectRoot), "state")
+}
+
+func projectInstanceDir(projectRoot, instance string) string {
+	return filepath.Join(projectStateDir(projectRoot), instance)
+}
+
+func resolveStateDirFromCWD() (string, error) {
+	projectRoot, err := resolveProjectRootFromCWD()
+	if err != nil {
+		return "", err
+	}
+	return projectStateDir(projectRoot), nil
+}
+
+func resolveInstanceDir(instance string) (string, error) {
+	projectRoot, err := resolveProjectRootFromCWD()
+	if err != nil {
+		return "", err
+	}
+	instDir := projectInstanceDir(projectRoot, instance)
+	if _, err := os.Stat(filepath.Join(instDir, "instance.json")); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", fmt.Errorf("instance %q is not initialized in %s (run obliviate init %s --workdir %s)", instance, projectRoot, instance, projectRoot)
+		}
+		return "", err
+	}
+	return instDir, nil
+}
+
+func parseBatch(payload []byte) ([]taskInput, error) {
+	trimmed := strings.TrimSpace(string(payload))
+	if trimmed == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(trimmed, "[") {
+		var raws []taskInputRaw
+		if err := json.Unmarshal([]byte(trimmed), &raws); err != nil {
+			return nil, err
+		}
+		out := make([]taskInput, 0, len(raws))
+		for i, r := range raws {
+			t, err := normalizeInput(r)
+			if err != nil {
+				return nil, fmt.Errorf("item %d: %w", i+1, err)
+			}
+			out = append(out, t)
+		}
+		return out, nil
+	}
+
+	s := bufio.NewScanner(strings.NewReader(trimmed))
+	lineNo := 0
+	out := make([]taskInput, 0)
+	for s.Scan() {
+		lineNo++
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		var raw taskInputRaw
+		if err := json.Unmarshal([]byte(line), &raw); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		t, err := normalizeInput(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		out = append(out, t)
+	}
+	return out, s.Err()
+}
+
+func normalizeInput(raw taskInputRaw) (taskInput, error) {
+	verify, err := parseVerify(raw.Verify)
+	if err != nil {
+		return taskInput{}, err
+	}
+	if strings.TrimSpace(raw.Title) == "" || strings.TrimSpace(raw.Spec) == "" || len(verify) == 0 {
+		return taskInput{}, errors.New("title, spec, and verify are required")
+	}
+	if strings.TrimSpace(raw.ModelHint) == "" {
+		return taskInput{}, errors.New("model_hint is required")
+	}
+	priority, err := normalizePriority(raw.Priority)
+	if err != nil {
+		return taskInput{}, err
+	}
+	verifyMode, err := normalizeVerifyMode(raw.VerifyMode)
+	if err != nil {
+		return taskInput{}, err
+	}
+	source := strings.TrimSpace(raw.Source)
+	if source == "" {
+		source = "agent"
+	}
+	return taskInput{
+		Title:      raw.Title,
+		Spec:       raw.Spec,
+		Verify:     verify,
+		ModelHint:  strings.TrimSpace(raw.ModelHint),
+		Priority:   priority,
+		DependsOn:  normalizeDependsOn(raw.DependsOn),
+		VerifyMode: verifyMode,
+		Source:     source,
+	}, nil
+}
+
+// normalizeVerifyMode lowercases m and checks it against first|all. An
+// empty value is kept so the go loop's --verify-mode applies.
+func normalizeVerifyMode(m string) (string, error) {
+	m = strings.ToLower(strings.TrimSpace(m))
+	switch m {
+	case "", verifyModeFirst, verifyModeAll:
+		return m, nil
+	default:
+		return "", errors.New("verify_mode must be one of first, all")
+	}
+}
+
+// normalizePriority lowercases p and checks it against low|med|high.
+// An empty value defaults to med.
+func normalizePriority(p string) (string, error) {
+	p = strings.ToLower(strings.TrimSpace(p))
+	switch p {
+	case "":
+		return priorityMed, nil
+	case priorityLow, priorityMed, priorityHigh:
+		return p, nil
+	default:
+		return "", fmt.Errorf("priority must be one of low, med, high (got %q)", p)
+	}
+}
+
+// priorityRank orders priorities for scheduling; unknown or legacy values
+// rank as med.
+func priorityRank(p string) int {
+	switch strings.ToLower(strings.TrimSpace(p)) {
+	case priorityHigh:
+		return 2
+	case priorityLow:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// normalizeDependsOn trims dependency IDs and drops blanks and duplicates
+// while keeping the declared order.
+func normalizeDependsOn(ids []string) []string {
+	out := make([]string, 0, len(ids))
+	seen := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		out = append(out, id)
+	}
+	if len(out) == 0 {
+		return nil
+	}
+	return out
+}
+
+// VerifyCommand is one verify gate. In JSON it is either a plain command
+// string or an object with per-command overrides; commands without
+// overrides are written back as plain strings so existing files round-trip.
+type VerifyCommand struct {
+	Cmd     string            `json:"cmd"`
+	Timeout string            `json:"timeout,omitempty"`
+	Cwd     string            `json:"cwd,omitempty"`
+	Env     map[string]string `json:"env,omitempty"`
+}
+
+// verifyCommandObject avoids recursing into VerifyCommand's JSON methods.
+type verifyCommandObject VerifyCommand
+
+func (v VerifyCommand) MarshalJSON() ([]byte, error) {
+	if v.Timeout == "" && v.Cwd == "" && len(v.Env) == 0 {
+		return json.Marshal(v.Cmd)
+	}
+	return json.Marshal(verifyCommandObject(v))
+}
+
+func (v *VerifyCommand) UnmarshalJSON(b []byte) error {
+	var cmd string
+	if err := json.Unmarshal(b, &cmd); err == nil {
+		*v = VerifyCommand{Cmd: cmd}
+		return nil
+	}
+	var obj verifyCommandObject
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return errors.New("verify entry must be a string or {cmd, timeout, cwd, env} object")
+	}
+	*v = VerifyCommand(obj)
+	return nil
+}
+
+// verifyCommands wraps plain command strings, as given by --verify flags.
+func verifyCommands(cmds []string) []VerifyCommand {
+	out := make([]VerifyCommand, 0, len(cmds))
+	for _, c := range cmds {
+		out = append(out, VerifyCommand{Cmd: c})
+	}
+	return out
+}
+
+func normalizeVerifyCommand(v VerifyCommand) (VerifyCommand, error) {
+	v.Cmd = strings.TrimSpace(v.Cmd)
+	v.Timeout = strings.TrimSpace(v.Timeout)
+	v.Cwd = strings.TrimSpace(v.Cwd)
+	if v.Cmd == "" {
+		return v, errors.New("verify cmd cannot be empty")
+	}
+	if v.Timeout != "" {
+		d, err := time.ParseDuration(v.Timeout)
+		if err != nil || d <= 0 {
+			return v, fmt.Errorf("verify timeout must be a positive duration like 8m (got %q)", v.Timeout)
+		}
+	}
+	return v, nil
+}
+
+func parseVerify(raw json.RawMessage) ([]VerifyCommand, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, errors.New("verify is required")
+	}
+	var single VerifyCommand
+	if err := json.Unmarshal(raw, &single); err == nil {
+		if strings.TrimSpace(single.Cmd) == "" {
+			return nil, errors.New("verify cannot be empty")
+		}
+		v, err := normalizeVerifyCommand(single)
+		if err != nil {
+			return nil, err
+		}
+		return []VerifyCommand{v}, nil
+	}
+	var many []VerifyCommand
+	if err := json.Unmarshal(raw, &many); err != nil {
+		return nil, errors.New("verify must be a string, an object, or an array of them")
+	}
+	out := make([]VerifyCommand, 0, len(many))
+	for _, v := range many {
+		if strings.TrimSpace(v.Cmd) == "" {
+			continue
+		}
+		v, err := normalizeVerifyCommand(v)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	if len(out) == 0 {
+		return nil, errors.New("verify cannot be empty")
+	}
+	return out, nil
+}
+
+func addTasks(instance string, inputs []taskInput) ([]Task, error) {
+	instDir, err := resolveInstanceDir(instance)
+	if err != nil {
+		return nil, err
+	}
+	lockRelease, err := acquireInstanceLock(instDir)
+	if err != nil {
+		return nil, err
+	}
+	defer lockRelease()
+
+	p := filepath.Join(instDir, "tasks.jsonl")
+	tasks, err := loadTasks(p)
+	if err != nil {
+		return nil, err
+	}
+	next := nextTaskNumber(tasks)
+	if meta, err := loadInstanceMeta(filepath.Join(instDir, "instance.json")); err == nil && meta.LastTaskNumber >= next {
+		next = meta.LastTaskNumber + 1
+	}
+	now := nowUTC()
+	for _, in := range inputs {
+		id := fmt.Sprintf("OB-%03d", next)
+		next++
+		t := Task{
+			ID:         id,
+			Title:      strings.TrimSpace(in.Title),
+			Spec:       strings.TrimSpace(in.Spec),
+			Verify:     in.Verify,
+			Status:     statusTodo,
+			ModelHint:  in.ModelHint,
+			Priority:   in.Priority,
+			DependsOn:  in.DependsOn,
+			VerifyMode: in.VerifyMode,
+			Attempts:   0,
+			Source:     in.Source,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+		tasks = append(tasks, t)
+	}
+	if err := dropArchivedDependencies(instDir, tasks); err != nil {
+		return nil, err
+	}
+	if err := validateDependencies(tasks); err != nil {
+		return nil, err
+	}
+	if err := saveTasks(p, tasks); err != nil {
+		return nil, err
+	}
+	return append([]Task(nil), tasks[len(tasks)-len(inputs):]...), nil
+}
+
+func nextTaskNumber(tasks []Task) int {
+	maxN := 0
+	for _, t := range tasks {
+		if n, ok := taskNumber(t.ID); ok && n > maxN {
+			maxN = n
+		}
+	}
+	return maxN + 1
+}
+
+func taskNumber(id string) (int, bool) {
+	if !strings.HasPrefix(id, "OB-") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(id, "OB-"))
+	return n, err == nil
+}
+
+// recordRemovedTaskNumbers raises the instance's LastTaskNumber to cover
+// tasks leaving tasks.jsonl, keeping their IDs from being handed out again.
+func recordRemovedTaskNumbers(instDir string, removed []Task) error {
+	path := filepath.Join(instDir, "instance.json")
+	meta, err := loadInstanceMeta(path)
+	if err != nil {
+		return err
+	}
+	maxN := meta.LastTaskNumber
+	for _, t := range removed {
+		if n, ok := taskNumber(t.ID); ok && n > maxN {
+			maxN = n
+		}
+	}
+	if maxN == meta.LastTaskNumber {
+		return nil
+	}
+	meta.LastTaskNumber = maxN
+	b, _ := json.MarshalIndent(meta, "", "  ")
+	return writeFileAtomic(path, string(b)+"\n")
+}
+
+// dropArchivedDependencies removes depends_on entries that point at tasks
+// archived as done, since those are satisfied. The archive is only read if
+// some dependency is missing from tasks. Other unknown IDs are left for
+// validateDependencies to report.
+func dropArchivedDependencies(instDir string, tasks []Task) error {
+	known := taskStatusByID(tasks)
+	var archived map[string]string
+	for i := range tasks {
+		if len(tasks[i].DependsOn) == 0 {
+			continue
+		}
+		kept := tasks[i].DependsOn[:0:0]
+		for _, dep := range tasks[i].DependsOn {
+			if _, ok := known[dep]; !ok {
+				if archived == nil {
+					old, err := loadTasks(filepath.Join(instDir, archiveFileName))
+					if err != nil {
+						return err
+					}
+					archived = taskStatusByID(old)
+				}
+				if status, ok := archived[dep]; ok {
+					if status != statusDone {
+						return fmt.Errorf("depends_on must not reference archived task %s (archived as %s)", dep, status)
+					}
+					continue
+				}
+			}
+			kept = append(kept, dep)
+		}
+		tasks[i].DependsOn = kept
+	}
+	return nil
+}
+
+func loadTasks(path string) ([]Task, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []Task{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	tasks := make([]Task, 0)
+	s := bufio.NewScanner(f)
+	lineNo := 0
+	for s.Scan() {
+		lineNo++
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		var t Task
+		if err := json.Unmarshal([]byte(line), &t); err != nil {
+			return nil, fmt.Errorf("tasks parse line %d: %w", lineNo, err)
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, s.Err()
+}
+
+func findTaskIndex(tasks []Task, taskID string) int {
+	for i := range tasks {
+		if tasks[i].ID == taskID {
+			return i
+		}
+	}
+	return -1
+}
+
+func loadRuns(path string) ([]RunLog, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return []RunLog{}, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	runs := make([]RunLog, 0)
+	s := bufio.NewScanner(f)
+	lineNo := 0
+	for s.Scan() {
+		lineNo++
+		line := strings.TrimSpace(s.Text())
+		if line == "" {
+			continue
+		}
+		var r RunLog
+		if err := json.Unmarshal([]byte(line), &r); err != nil {
+			return nil, fmt.Errorf("runs parse line %d: %w", lineNo, err)
+		}
+		runs = append(runs, r)
+	}
+	return runs, s.Err()
+}
+
+func saveTasks(path string, tasks []Task) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	enc.SetEscapeHTML(false)
+	for _, t := range tasks {
+		if err := enc.Encode(t); err != nil {
+			f.Close()
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func loadInstanceMeta(path string) (InstanceMeta, error) {
+	var m InstanceMeta
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	err = json.Unmarshal(b, &m)
+	return m, err
+}
+
+// nextRunnableTaskIndex picks the highest-priority runnable task. Within a
+// priority, todo tasks run before failed retries, then file (creation) order.
+// Tasks ranked below priorityFloor are ignored; an empty floor allows all.
+func nextRunnableTaskIndex(tasks []Task, maxAttempts int, priorityFloor string) int {
+	statuses := taskStatusByID(tasks)
+	floor := -1
+	if priorityFloor != "" {
+		floor = priorityRank(priorityFloor)
+	}
+	best := -1
+	bestRank, bestRetry := 0, false
+	for i := range tasks {
+		t := tasks[i]
+		retry := false
+		switch {
+		case t.Status == statusTodo:
+		case t.Status == statusFailed && t.Attempts < maxAttempts:
+			retry = true
+		default:
+			continue
+		}
+		rank := priorityRank(t.Priority)
+		if rank < floor || !dependenciesDone(t, statuses) {
+			continue
+		}
+		if best < 0 || rank > bestRank || (rank == bestRank && bestRetry && !retry) {
+			best, bestRank, bestRetry = i, rank, retry
+		}
+	}
+	return best
+}
+
+func taskStatusByID(tasks []Task) map[string]string {
+	statuses := make(map[string]string, len(tasks))
+	for _, t := range tasks {
+		statuses[t.ID] = t.Status
+	}
+	return statuses
+}
+
+func dependenciesDone(t Task, statuses map[string]string) bool {
+	for _, dep := range t.DependsOn {
+		if statuses[dep] != statusDone {
+			return false
+		}
+	}
+	return true
+}
+
+// validateDependencies rejects depends_on references to unknown task IDs
+// and dependency cycles across the full task list.
+func validateDependencies(tasks []Task) error {
+	byID := make(map[string]int, len(tasks))
+	for i, t := range tasks {
+		byID[t.ID] = i
+	}
+	for _, t := range tasks {
+		for _, dep := range t.DependsOn {
+			if _, ok := byID[dep]; !ok {
+				return fmt.Errorf("depends_on must reference existing tasks: %s -> %s is unknown", t.ID, dep)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(tasks))
+	var path []string
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visiting:
+			start := 0
+			for j, id := range path {
+				if id == tasks[i].ID {
+					start = j
+					break
+				}
+			}
+			cycle := append(append([]string{}, path[start:]...), tasks[i].ID)
+			return fmt.Errorf("depends_on must be acyclic: %s", strings.Join(cycle, " -> "))
+		case visited:
+			return nil
+		}
+		state[i] = visiting
+		path = append(path, tasks[i].ID)
+		for _, dep := range tasks[i].DependsOn {
+			if err := visit(byID[dep]); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+	for i := range tasks {
+		if err := visit(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const blockedDependencyPrefix = "waiting on blocked dependency"
+
+// markBlockedDependents annotates runnable tasks whose upstream chain contains
+// a blocked task, and clears that note once the upstream is no longer blocked.
+// A task's own last_error is never replaced by the note. It returns true when
+// any task was changed.
+func markBlockedDependents(tasks []Task) bool {
+	byID := make(map[string]int, len(tasks))
+	for i, t := range tasks {
+		byID[t.ID] = i
+	}
+	// blockedBy memoizes the first blocked task reachable upstream of each task.
+	blockedBy := make(map[string]string, len(tasks))
+	var find func(id string, seen map[string]bool) string
+	find = func(id string, seen map[string]bool) string {
+		if v, ok := blockedBy[id]; ok {
+			return v
+		}
+		if seen[id] {
+			return ""
+		}
+		seen[id] = true
+		i, ok := byID[id]
+		if !ok {
+			return ""
+		}
+		found := ""
+		for _, dep := range tasks[i].DependsOn {
+			j, ok := byID[dep]
+			if !ok {
+				continue
+			}
+			if tasks[j].Status == statusBlocked {
+				found = dep
+				break
+			}
+			if up := find(dep, seen); up != "" {
+				found = up
+				break
+			}
+		}
+		blockedBy[id] = found
+		return found
+	}
+
+	changed := false
+	for i := range tasks {
+		if tasks[i].Status != statusTodo && tasks[i].Status != statusFailed {
+			continue
+		}
+		upstream := find(tasks[i].ID, map[string]bool{})
+		noted := strings.HasPrefix(tasks[i].LastError, blockedDependencyPrefix)
+		switch {
+		case upstream != "":
+			if tasks[i].LastError != "" && !noted {
+				continue
+			}
+			msg := fmt.Sprintf("%s %s", blockedDependencyPrefix, upstream)
+			if tasks[i].LastError != msg {
+				tasks[i].LastError = msg
+				tasks[i].UpdatedAt = nowUTC()
+				changed = true
+			}
+		case noted:
+			tasks[i].LastError = ""
+			tasks[i].UpdatedAt = nowUTC()
+			changed = true
+		}
+	}
+	return changed
+}
+
+// Prompt section truncation modes: keepAll sections are never cut,
+// keepHead keeps the start of the text, keepTail keeps the end (the newest
+// entries of append-only files such as learnings).
+const (
+	keepAll  = "all"
+	keepHead = "head"
+	keepTail = "tail"
+)
+
+// promptSection is one block of the execution prompt. When the prompt is
+// over budget, sections with the highest Priority number are cut first.
+type promptSection struct {
+	Name     string
+	Heading  string
+	Body     string
+	Priority int
+	Keep     string
+}
+
+func (s promptSection) render() string {
+	if s.Heading == "" {
+		return s.Body
+	}
+	return "## " + s.Heading + "\n" + s.Body
+}
+
+type promptSectionSize struct {
+	Name          string `json:"name"`
+	Bytes         int    `json:"bytes"`
+	OriginalBytes int    `json:"original_bytes"`
+	ApproxTokens  int    `json:"approx_tokens"`
+	Truncated     bool   `json:"truncated,omitempty"`
+}
+
+// promptReport describes how a prompt was assembled against its budget.
+// Budget 0 means unlimited. With a template, Sections still describe the
+// trimmed section bodies handed to it.
+type promptReport struct {
+	Budget       int                 `json:"budget_bytes"`
+	TotalBytes   int                 `json:"total_bytes"`
+	ApproxTokens int                 `json:"approx_tokens"`
+	OverBudget   bool                `json:"over_budget,omitempty"`
+	Template     string              `json:"template,omitempty"`
+	Sections     []promptSectionSize `json:"sections"`
+}
+
+// bytesPerToken is the rough ratio used to convert token budgets and
+// report token estimates.
+const bytesPerToken = 4
+
+func approxTokens(n int) int { return (n + bytesPerToken - 1) / bytesPerToken }
+
+// parsePromptBudget reads a budget in bytes ("200000") or tokens
+// ("50000t"). 0 disables the budget.
+func parsePromptBudget(v string) (int, error) {
+	v = strings.ToLower(strings.TrimSpace(v))
+	mult := 1
+	if strings.HasSuffix(v, "t") {
+		v, mult = strings.TrimSuffix(v, "t"), bytesPerToken
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, errors.New("prompt-budget must be a non-negative byte count or token count with a t suffix (e.g. 50000t)")
+	}
+	return n * mult, nil
+}
+
+// buildExecutionPrompt assembles the prompt for task within budget. With a
+// prompt template the same budget-trimmed section bodies are handed to the
+// template instead of being joined in the default layout.
+func buildExecutionPrompt(home, instance string, task Task, budget int, tmpl *promptTemplate) (string, promptReport, error) {
+	skill, _ := readText(filepath.Join(home, "SKILL.md"))
+	globalPrompt, _ := readText(filepath.Join(home, "global-prompt.md"))
+	instDir := filepath.Join(home, "state", instance)
+	promptMD, _ := readText(filepath.Join(instDir, "prompt.md"))
+	specMD, _ := readText(filepath.Join(instDir, "spec.md"))
+	instLearn, _ := readText(filepath.Join(instDir, "learnings.md"))
+	globalLearn, _ := readText(filepath.Join(home, "global-learnings.md"))
+	runs, _ := loadRuns(filepath.Join(instDir, "runs.jsonl"))
+	meta, _ := loadInstanceMeta(filepath.Join(instDir, "instance.json"))
+
+	taskJSON, _ := json.MarshalIndent(task, "", "  ")
+	sections := []promptSection{
+		{Name: "intro", Body: "You are running inside Obliviate's fresh-context task loop. Complete exactly one task.", Keep: keepAll},
+		{Name: "skill", Heading: "SKILL.md", Body: skill, Priority: 6, Keep: keepHead},
+		{Name: "global_prompt", Heading: "Global Prompt", Body: globalPrompt, Priority: 3, Keep: keepHead},
+		{Name: "instance_prompt", Heading: "Instance Prompt", Body: promptMD, Priority: 1, Keep: keepHead},
+		{Name: "spec", Heading: "Feature Spec", Body: specMD, Keep: keepAll},
+		{Name: "global_learnings", Heading: "Global Learnings", Body: globalLearn, Priority: 5, Keep: keepTail},
+		{Name: "instance_learnings", Heading: "Instance Learnings", Body: instLearn, Priority: 4, Keep: keepTail},
+		{Name: "task", Heading: "Current Task (JSON)", Body: string(taskJSON), Keep: keepAll},
+	}
+	if previous := previousAttemptsSection(runs, task.ID, previousAttemptsBudget); previous != "" {
+		sections = append(sections, promptSection{Name: "previous_attempts", Heading: "Previous Attempts", Body: previous, Priority: 2, Keep: keepHead})
+	}
+	sections = append(sections, promptSection{
+		Name:    "output_requirements",
+		Heading: "Output Requirements",
+		Body:    defaultOutputRequirements,
+		Keep:    keepAll,
+	})
+	prompt, fitted, report := assemblePrompt(sections, budget)
+	if tmpl == nil {
+		return prompt, report, nil
+	}
+
+	data := promptTemplateData{
+		Instance:           instance,
+		Meta:               meta,
+		Task:               task,
+		Default:            prompt,
+		OutputRequirements: defaultOutputRequirements,
+	}
+	for _, s := range fitted {
+		switch s.Name {
+		case "skill":
+			data.Files.Skill = s.Body
+		case "global_prompt":
+			data.Files.GlobalPrompt = s.Body
+		case "instance_prompt":
+			data.Files.InstancePrompt = s.Body
+		case "spec":
+			data.Files.Spec = s.Body
+		case "global_learnings":
+			data.Files.GlobalLearnings = s.Body
+		case "instance_learnings":
+			data.Files.InstanceLearnings = s.Body
+		case "previous_attempts":
+			data.PreviousAttempts = s.Body
+		}
+	}
+	for _, r := range runs {
+		if r.TaskID == task.ID {
+			data.Runs = append(data.Runs, r)
+		}
+	}
+	rendered, err := tmpl.render(data)
+	if err != nil {
+		return "", promptReport{}, err
+	}
+	report.Template = tmpl.Path
+	report.TotalBytes = len(rendered)
+	report.ApproxTokens = approxTokens(len(rendered))
+	report.OverBudget = budget > 0 && len(rendered) > budget
+	return rendered, report, nil
+}
+
+const defaultOutputRequirements = "- Implement the task\n- Run verify commands\n- Commit changes with a clear message\n- End your final answer with non-obvious learnings, one per line, inside a <learnings> tag pair; prefix a line with [promote] if it applies project-wide\n- If blocked, explain exact blocker and failing command"
+
+// promptTemplate is a parsed prompt.tmpl. The instance's
+// state/<instance>/prompt.tmpl wins over the global .obliviate/prompt.tmpl.
+type promptTemplate struct {
+	Path string
+	tmpl *template.Template
+}
+
+// promptTemplateData is what prompt.tmpl is rendered with. File contents
+// and PreviousAttempts are already trimmed to the prompt budget; Default
+// is the prompt the built-in layout would produce.
+type promptTemplateData struct {
+	Instance           string
+	Meta               InstanceMeta
+	Task               Task
+	Files              promptFiles
+	PreviousAttempts   string
+	Runs               []RunLog
+	Default            string
+	OutputRequirements string
+}
+
+type promptFiles struct {
+	Skill             string
+	GlobalPrompt      string
+	InstancePrompt    string
+	Spec              string
+	GlobalLearnings   string
+	InstanceLearnings string
+}
+
+var promptTemplateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.MarshalIndent(v, "", "  ")
+		return string(b), err
+	},
+	"tail":      func(n int, s string) string { return tail(s, n) },
+	"lastLines": lastLines,
+	"trim":      strings.TrimSpace,
+	"join":      func(sep string, items []string) string { return strings.Join(items, sep) },
+	"indent": func(n int, s string) string {
+		pad := strings.Repeat(" ", n)
+		return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+	},
+}
+
+// lastLines returns the last n lines of s.
+func lastLines(n int, s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	if n < 0 || len(lines) <= n {
+		return strings.Join(lines, "\n")
+	}
+	return strings.Join(lines[len(lines)-n:], "\n")
+}
+
+// loadPromptTemplate parses the instance or global prompt.tmpl, returning
+// nil when neither exists. It also renders the template once against a
+// placeholder task so unknown fields and functions are reported before any
+// agent runs.
+func loadPromptTemplate(home, instDir string) (*promptTemplate, error) {
+	for _, path := range []string{filepath.Join(instDir, "prompt.tmpl"), filepath.Join(home, "prompt.tmpl")} {
+		raw, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		t, err := template.New(filepath.Base(path)).Funcs(promptTemplateFuncs).Option("missingkey=error").Parse(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("prompt template %s: %w", path, err)
+		}
+		pt := &promptTemplate{Path: path, tmpl: t}
+		sample := promptTemplateData{
+			Instance: filepath.Base(instDir),
+			Task:     Task{ID: "OB-000", Title: "sample", Verify: verifyCommands([]string{"true"}), Status: statusTodo},
+			Runs:     []RunLog{{TaskID: "OB-000", Status: statusFailed}},
+		}
+		if _, err := pt.render(sample); err != nil {
+			return nil, err
+		}
+		return pt, nil
+	}
+	return nil, nil
+}
+
+func (p *promptTemplate) render(data promptTemplateData) (string, error) {
+	var b strings.Builder
+	if err := p.tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("prompt template %s: %w", p.Path, err)
+	}
+	return b.String(), nil
+}
+
+const promptSeparator = "\n\n"
+
+// assemblePrompt joins sections and, when budget > 0 and the result is too
+// large, trims truncatable sections from the highest Priority number down
+// until it fits. keepAll sections are never cut, so the prompt can still
+// end up over budget; the report says so. The trimmed sections are
+// returned alongside the prompt.
+func assemblePrompt(sections []promptSection, budget int) (string, []promptSection, promptReport) {
+	sections = append([]promptSection(nil), sections...)
+	rendered := make([]string, len(sections))
+	original := make([]int, len(sections))
+	total := 0
+	for i, s := range sections {
+		rendered[i] = s.render()
+		original[i] = len(rendered[i])
+		total += original[i]
+	}
+	total += len(promptSeparator) * max(len(sections)-1, 0)
+
+	if budget > 0 && total > budget {
+		order := make([]int, 0, len(sections))
+		for i, s := range sections {
+			if s.Keep != keepAll {
+				order = append(order, i)
+			}
+		}
+		sort.SliceStable(order, func(a, b int) bool { return sections[order[a]].Priority > sections[order[b]].Priority })
+		for _, i := range order {
+			over := total - budget
+			if over <= 0 {
+				break
+			}
+			s := &sections[i]
+			bodyBudget := len(s.Body) - over
+			if s.Keep == keepTail {
+				s.Body = truncateLinesKeepTail(s.Body, bodyBudget)
+			} else {
+				s.Body = truncateBytes(s.Body, bodyBudget)
+			}
+			next := s.render()
+			total -= len(rendered[i]) - len(next)
+			rendered[i] = next
+		}
+	}
+
+	report := promptReport{Budget: budget, TotalBytes: total, ApproxTokens: approxTokens(total), OverBudget: budget > 0 && total > budget}
+	for i, s := range sections {
+		report.Sections = append(report.Sections, promptSectionSize{
+			Name:          s.Name,
+			Bytes:         len(rendered[i]),
+			OriginalBytes: original[i],
+			ApproxTokens:  approxTokens(len(rendered[i])),
+			Truncated:     len(rendered[i]) != original[i],
+		})
+	}
+	return strings.Join(rendered, promptSeparator), sections, report
+}
+
+// truncateLinesKeepTail drops whole lines from the start of s until it fits
+// in n bytes, noting how many were dropped.
+func truncateLinesKeepTail(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	lines := strings.SplitAfter(s, "\n")
+	kept := 0
+	size := 0
+	for i := len(lines) - 1; i >= 0; i-- {
+		marker := fmt.Sprintf("[... %d older line(s) truncated ...]\n", i)
+		if size+len(lines[i])+len(marker) > n {
+			break
+		}
+		size += len(lines[i])
+		kept++
+	}
+	dropped := len(lines) - kept
+	marker := fmt.Sprintf("[... %d older line(s) truncated ...]\n", dropped)
+	if len(marker) > n {
+		return ""
+	}
+	return marker + strings.Join(lines[dropped:], "")
+}
+
+// previousAttemptsSection summarizes the task's failed attempts since it
+// was last done, newest first: error, failing verify gates with their
+// output tails, and the diff the attempt left behind. Attempts are added
+// whole until budget bytes are used; older ones are counted, not shown.
+func previousAttemptsSection(runs []RunLog, taskID string, budget int) string {
+	var attempts []RunLog
+	for _, r := range runs {
+		if r.TaskID != taskID {
+			continue
+		}
+		switch r.Status {
+		case statusDone:
+			attempts = attempts[:0]
+		case statusFailed, statusBlocked, runStatusReverted:
+			attempts = append(attempts, r)
+		}
+	}
+	if len(attempts) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	shown := 0
+	for i := len(attempts) - 1; i >= 0; i-- {
+		block := formatAttempt(i+1, attempts[i])
+		if b.Len()+len(block) > budget {
+			if shown == 0 {
+				b.WriteString(truncateBytes(block, budget))
+				shown++
+			}
+			break
+		}
+		b.WriteString(block)
+		shown++
+	}
+	if omitted := len(attempts) - shown; omitted > 0 {
+		fmt.Fprintf(&b, "(%d older attempt(s) omitted)\n", omitted)
+	}
+	return strings.TrimSpace(b.String())
+}
+
+func formatAttempt(n int, r RunLog) string {
+	var b strings.Builder
+	if label := providerLabel(r.Provider, r.Model); label != "" {
+		fmt.Fprintf(&b, "### Attempt %d (%s, %s via %s)\n", n, r.RunID, r.Status, label)
+	} else {
+		fmt.Fprintf(&b, "### Attempt %d (%s, %s)\n", n, r.RunID, r.Status)
+	}
+	if r.Error != "" {
+		fmt.Fprintf(&b, "Error: %s\n", r.Error)
+	}
+	failedGates := 0
+	for _, v := range r.VerifyResults {
+		if v.ExitCode == 0 {
+			continue
+		}
+		failedGates++
+		fmt.Fprintf(&b, "Verify failed: `%s` (exit %d, %s)\n", v.Cmd, v.ExitCode, v.Duration)
+		if out := strings.TrimSpace(v.OutputTail); out != "" {
+			fmt.Fprintf(&b, "```\n%s\n```\n", tail(out, 800))
+		}
+	}
+	if failedGates == 0 && strings.TrimSpace(r.OutputTail) != "" {
+		// Older runs only kept a combined tail of agent and verify output.
+		fmt.Fprintf(&b, "Output tail:\n```\n%s\n```\n", tail(strings.TrimSpace(r.OutputTail), 800))
+	}
+	if r.DiffStat != "" {
+		fmt.Fprintf(&b, "Changes left by this attempt:\n```\n%s\n```\n", tail(r.DiffStat, 800))
+	}
+	if r.RollbackRef != "" {
+		fmt.Fprintf(&b, "These changes were rolled back; inspect them with `git show %s`.\n", r.RollbackRef)
+	}
+	return b.String() + "\n"
+}
+
+// truncateBytes cuts s to at most n bytes on a rune boundary, marking the
+// cut.
+func truncateBytes(s string, n int) string {
+	const marker = "\n...[truncated]\n"
+	if len(s) <= n {
+		return s
+	}
+	if n <= len(marker) {
+		return ""
+	}
+	cut := n - len(marker)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + marker
+}
+
+const (
+	promptViaStdin = "stdin"
+	promptViaFile  = "file"
+	promptViaArg   = "arg"
+)
+
+// ProviderDef describes how to launch one agent CLI. Args may contain the
+// placeholders {{workdir}}, {{model}}, {{prompt}}, {{prompt_file}}, and
+// {{model_flag}}; the last expands to ModelFlag plus the model, or to nothing
+// when no model is selected, and is appended if absent from Args.
+type ProviderDef struct {
+	Name      string            `json:"name"`
+	Command   string            `json:"command"`
+	Args      []string          `json:"args,omitempty"`
+	Prompt    string            `json:"prompt,omitempty"`
+	ModelFlag string            `json:"model_flag,omitempty"`
+	Env       map[string]string `json:"env,omitempty"`
+	Fallback  *providerRef      `json:"fallback,omitempty"`
+}
+
+type providerRef struct {
+	Provider string `json:"provider"`
+	Model    string `json:"model,omitempty"`
+}
+
+type providersFile struct {
+	Default   string        `json:"default,omitempty"`
+	Providers []ProviderDef `json:"providers"`
+}
+
+// providerRegistry holds the built-in providers plus any defined in
+// .obliviate/providers.json, which override built-ins with the same name.
+type providerRegistry struct {
+	Default   string
+	Providers map[string]ProviderDef
+}
+
+func builtinProviders() []ProviderDef {
+	return []ProviderDef{
+		{
+			Name:    "claude",
+			Command: "claude",
+			Args: []string{
+				"-p",
+				"--output-format", "text",
+				"--permission-mode", "bypassPermissions",
+				"--dangerously-skip-permissions",
+				"--no-session-persistence",
+				"--disallowedTools", "AskUserQuestion,EnterPlanMode",
+				"{{model_flag}}",
+			},
+			Prompt:    promptViaStdin,
+			ModelFlag: "--model",
+			// Claude variants fall back to codex.
+			Fallback: &providerRef{Provider: "codex"},
+		},
+		{
+			Name:    "codex",
+			Command: "codex",
+			Args: []string{
+				"exec",
+				"--cd", "{{workdir}}",
+				"--skip-git-repo-check",
+				"--dangerously-bypass-approvals-and-sandbox",
+				"{{model_flag}}",
+				"-",
+			},
+			Prompt:    promptViaStdin,
+			ModelFlag: "--model",
+			// Cost guardrail: codex falls back to sonnet, never opus.
+			Fallback: &providerRef{Provider: "claude", Model: "sonnet"},
+		},
+	}
+}
+
+func defaultProviderRegistry() providerRegistry {
+	reg := providerRegistry{Default: "codex", Providers: map[string]ProviderDef{}}
+	for _, p := range builtinProviders() {
+		reg.Providers[p.Name] = p
+	}
+	return reg
+}
+
+// loadProviderRegistry merges <home>/providers.json over the built-in
+// providers. A missing file yields the built-ins unchanged.
+func loadProviderRegistry(home string) (providerRegistry, error) {
+	reg := defaultProviderRegistry()
+	path := filepath.Join(home, "providers.json")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return reg, nil
+		}
+		return reg, err
+	}
+	var file providersFile
+	if err := json.Unmarshal(b, &file); err != nil {
+		return reg, fmt.Errorf("providers.json: %w", err)
+	}
+	for i, p := range file.Providers {
+		p.Name = strings.ToLower(strings.TrimSpace(p.Name))
+		if p.Name == "" {
+			return reg, fmt.Errorf("providers.json: provider %d: name is required", i+1)
+		}
+		if strings.TrimSpace(p.Command) == "" {
+			return reg, fmt.Errorf("providers.json: provider %q: command is required", p.Name)
+		}
+		p.Prompt = strings.ToLower(strings.TrimSpace(p.Prompt))
+		switch p.Prompt {
+		case "":
+			p.Prompt = promptViaStdin
+		case promptViaStdin, promptViaFile, promptViaArg:
+		default:
+			return reg, fmt.Errorf("providers.json: provider %q: prompt must be stdin, file, or arg", p.Name)
+		}
+		reg.Providers[p.Name] = p
+	}
+	if d := strings.ToLower(strings.TrimSpace(file.Default)); d != "" {
+		reg.Default = d
+	}
+	if _, ok := reg.Providers[reg.Default]; !ok {
+		return reg, fmt.Errorf("providers.json: default provider %q must be defined", reg.Default)
+	}
+	for name, p := range reg.Providers {
+		if p.Fallback == nil {
+			continue
+		}
+		if _, ok := reg.Providers[p.Fallback.Provider]; !ok {
+			return reg, fmt.Errorf("providers.json: provider %q: fallback provider %q must be defined", name, p.Fallback.Provider)
+		}
+	}
+	return reg, nil
+}
+
+// routeModel maps a task's model hint to a provider and model. Hints of the
+// form "<provider>:<model>" or "<provider>-<model>" select any registered
+// provider directly; anything else goes through the built-in heuristics.
+func routeModel(reg providerRegistry, hint string) (provider, model string) {
+	h := strings.ToLower(strings.TrimSpace(hint))
+	if h == "" {
+		return reg.Default, ""
+	}
+	if name, m, ok := strings.Cut(h, ":"); ok {
+		if _, known := reg.Providers[name]; known && name != "claude" {
+			return name, strings.TrimSpace(m)
+		}
+	}
+	// Longer names first so "aider-pro" wins over "aider".
+	names := make([]string, 0, len(reg.Providers))
+	for name := range reg.Providers {
+		if name != "claude" && name != "codex" {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(names[i]) != len(names[j]) {
+			return len(names[i]) > len(names[j])
+		}
+		return names[i] < names[j]
+	})
+	for _, name := range names {
+		if h == name {
+			return name, ""
+		}
+		if m, ok := strings.CutPrefix(h, name+"-"); ok {
+			return name, m
+		}
+	}
+
+	if strings.Contains(h, "opus") {
+		return "claude", "opus"
+	}
+	if strings.Contains(h, "sonnet") {
+		return "claude", "sonnet"
+	}
+	if strings.Contains(h, "haiku") {
+		return "claude", "haiku"
+	}
+	if strings.HasPrefix(h, "claude") {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) == 2 {
+			return "claude", normalizeClaudeModel(parts[1])
+		}
+		return "claude", normalizeClaudeModel(h)
+	}
+	if strings.HasPrefix(h, "codex") || strings.HasPrefix(h, "gpt") || strings.HasPrefix(h, "o") {
+		if h == "codex" {
+			return "codex", ""
+		}
+		return "codex", h
+	}
+	return reg.Default, ""
+}
+
+func normalizeClaudeModel(m string) string {
+	m = strings.ToLower(strings.TrimSpace(m))
+	m = strings.TrimPrefix(m, "claude-")
+	return m
+}
+
+func resolveWorkdir(projectRoot, configured string) string {
+	w := strings.TrimSpace(configured)
+	if w == "" {
+		return filepath.Clean(projectRoot)
+	}
+	if filepath.IsAbs(w) {
+		return filepath.Clean(w)
+	}
+	return filepath.Clean(filepath.Join(projectRoot, w))
+}
+
+// fallbackChain is an ordered list of model hints to try after the primary
+// fails. Reasons, when set, restricts which failure reasons trigger it.
+type fallbackChain struct {
+	Steps   []string `json:"steps"`
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+// fallbackConfig is read from .obliviate/fallback.json and overlaid by
+// state/<instance>/fallback.json. Chains are keyed by model hint
+// ("claude-opus", "codex", ...); a provider-only key covers all its models.
+type fallbackConfig struct {
+	Enabled *bool                    `json:"enabled,omitempty"`
+	Reasons []string                 `json:"reasons,omitempty"`
+	Chains  map[string]fallbackChain `json:"chains,omitempty"`
+}
+
+var providerFailureReasons = []string{"rate_limit", "quota", "billing", "model_unavailable", "provider_unavailable", "auth"}
+
+// loadFallbackConfig merges the global and instance fallback files. Instance
+// values replace global ones field by field; chains are merged per key.
+func loadFallbackConfig(home, instDir string) (fallbackConfig, error) {
+	merged := fallbackConfig{Chains: map[string]fallbackChain{}}
+	for _, path := range []string{filepath.Join(home, "fallback.json"), filepath.Join(instDir, "fallback.json")} {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return merged, err
+		}
+		var c fallbackConfig
+		if err := json.Unmarshal(b, &c); err != nil {
+			return merged, fmt.Errorf("%s: %w", path, err)
+		}
+		if err := validateFallbackReasons(c.Reasons); err != nil {
+			return merged, fmt.Errorf("%s: %w", path, err)
+		}
+		for key, chain := range c.Chains {
+			if err := validateFallbackReasons(chain.Reasons); err != nil {
+				return merged, fmt.Errorf("%s: chain %q: %w", path, key, err)
+			}
+			merged.Chains[strings.ToLower(strings.TrimSpace(key))] = chain
+		}
+		if c.Enabled != nil {
+			merged.Enabled = c.Enabled
+		}
+		if c.Reasons != nil {
+			merged.Reasons = c.Reasons
+		}
+	}
+	return merged, nil
+}
+
+func validateFallbackReasons(reasons []string) error {
+	for _, r := range reasons {
+		if !containsString(providerFailureReasons, r) {
+			return fmt.Errorf("fallback reason must be one of %s (got %q)", strings.Join(providerFailureReasons, ", "), r)
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, v string) bool {
+	for _, s := range list {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveFallbackChain returns the hops to try after provider/model failed
+// with reason. A configured chain for provider:model wins over one for the
+// provider alone; without either, the registry's single-hop fallback applies.
+func resolveFallbackChain(reg providerRegistry, cfg fallbackConfig, provider, model, reason string) []providerRef {
+	if cfg.Enabled != nil && !*cfg.Enabled {
+		return nil
+	}
+	chain, ok := lookupFallbackChain(reg, cfg, provider, model)
+	if !fallbackReasonAllowed(cfg, chain, reason) {
+		return nil
+	}
+	if !ok {
+		p, ok := reg.Providers[provider]
+		if !ok || p.Fallback == nil {
+			return nil
+		}
+		return []providerRef{*p.Fallback}
+	}
+	hops := make([]providerRef, 0, len(chain.Steps))
+	for _, step := range chain.Steps {
+		p, m := routeModel(reg, step)
+		if p == provider && m == model {
+			continue
+		}
+		hops = append(hops, providerRef{Provider: p, Model: m})
+	}
+	return hops
+}
+
+// fallbackReasonAllowed reports whether reason may trigger the next hop
+// under both the top-level reasons and the chain's own.
+func fallbackReasonAllowed(cfg fallbackConfig, chain fallbackChain, reason string) bool {
+	if cfg.Reasons != nil && !containsString(cfg.Reasons, reason) {
+		return false
+	}
+	return chain.Reasons == nil || containsString(chain.Reasons, reason)
+}
+
+// lookupFallbackChain finds the chain for provider/model: a key spelling it
+// exactly ("provider:model" or "provider-model") wins, then the first key in
+// sorted order that routes to it, then a chain keyed by the bare provider.
+func lookupFallbackChain(reg providerRegistry, cfg fallbackConfig, provider, model string) (fallbackChain, bool) {
+	if model != "" {
+		for _, key := range []string{provider + ":" + model, provider + "-" + model} {
+			if c, ok := cfg.Chains[key]; ok {
+				return c, true
+			}
+		}
+	}
+	keys := make([]string, 0, len(cfg.Chains))
+	for key := range cfg.Chains {
+		if key != provider {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if p, m := routeModel(reg, key); p == provider && m == model {
+			return cfg.Chains[key], true
+		}
+	}
+	c, ok := cfg.Chains[provider]
+	return c, ok
+}
+
+// runAgentWithFallback runs the primary provider and, on a provider-level
+// failure, walks the configured fallback chain until a hop succeeds, a hop
+// fails for a reason that does not allow further fallback, or the chain ends.
+// Every hop taken is returned in order.
+func runAgentWithFallback(ctx context.Context, reg providerRegistry, fbCfg fallbackConfig, primaryProvider, primaryModel, workdir, prompt string, timeout time.Duration, transcript io.Writer) (provider, model, output string, err error, hops []fallbackHop) {
+	out, runErr := runAgent(ctx, reg, primaryProvider, primaryModel, workdir, prompt, timeout, transcript)
+	if runErr == nil {
+		return primaryProvider, primaryModel, out, nil, nil
+	}
+	reason := classifyProviderFailure(runErr, out)
+	if reason == "" {
+		return primaryProvider, primaryModel, out, runErr, nil
+	}
+	chain := resolveFallbackChain(reg, fbCfg, primaryProvider, primaryModel, reason)
+	if len(chain) == 0 {
+		return primaryProvider, primaryModel, out, runErr, nil
+	}
+	// Later hops stay under the reasons of the chain that was picked.
+	picked, _ := lookupFallbackChain(reg, fbCfg, primaryProvider, primaryModel)
+
+	provider, model, output = primaryProvider, primaryModel, out
+	errs := []string{fmt.Sprintf("%s failed (%s): %v", providerLabel(primaryProvider, primaryModel), reason, runErr)}
+	for _, next := range chain {
+		if ctx.Err() != nil {
+			break
+		}
+		hop := fallbackHop{Provider: next.Provider, Model: next.Model, Reason: reason}
+		if transcript != nil {
+			fmt.Fprintf(transcript, "\n\n[obliviate fallback -> %s]\n", providerLabel(next.Provider, next.Model))
+		}
+		out, runErr = runAgent(ctx, reg, next.Provider, next.Model, workdir, prompt, timeout, transcript)
+		provider, model = next.Provider, next.Model
+		output = strings.TrimSpace(output + "\n\n[obliviate fallback -> " + providerLabel(next.Provider, next.Model) + "]\n" + out)
+		if runErr == nil {
+			hops = append(hops, hop)
+			return provider, model, output, nil, hops
+		}
+		hop.Error = runErr.Error()
+		hops = append(hops, hop)
+		reason = classifyProviderFailure(runErr, out)
+		errs = append(errs, fmt.Sprintf("%s failed (%s): %v", providerLabel(next.Provider, next.Model), reasonOrUnknown(reason), runErr))
+		if reason == "" || !fallbackReasonAllowed(fbCfg, picked, reason) {
+			break
+		}
+	}
+	return provider, model, output, errors.New("fallback chain exhausted: " + strings.Join(errs, "; ")), hops
+}
+
+func providerLabel(provider, model string) string {
+	if model == "" {
+		return provider
+	}
+	return provider + "/" + model
+}
+
+func reasonOrUnknown(reason string) string {
+	if reason == "" {
+		return "unclassified"
+	}
+	return reason
+}
+
+func classifyProviderFailure(err error, output string) string {
+	if err == nil {
+		return ""
+	}
+	msg := strings.ToLower(err.Error() + "\n" + output)
+	// Broader contains-any pass for common provider-level failures.
+	containsAny := func(keys ...string) bool {
+		for _, k := range keys {
+			if strings.Contains(msg, k) {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case containsAny("rate limit", "rate-limited", "too many requests", "429"):
+		return "rate_limit"
+	case containsAny("usage limit", "quota", "daily limit", "weekly limit", "monthly limit"):
+		return "quota"
+	case containsAny("billing", "payment", "insufficient credits"):
+		return "billing"
+	case containsAny("model", "not exist", "not have access", "unknown model"):
+		return "model_unavailable"
+	case containsAny("temporarily unavailable", "service unavailable", "overloaded"):
+		return "provider_unavailable"
+	case containsAny("auth", "unauthorized", "forbidden", "login required"):
+		return "auth"
+	default:
+		return ""
+	}
+}
+
+func isTransientFailure(reason string) bool {
+	return reason == "rate_limit" || reason == "provider_unavailable"
+}
+
+func killProcessTree(p *os.Process) error {
+	if runtime.GOOS == "windows" {
+		kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(p.Pid))
+		if err := kill.Run(); err != nil {
+			return p.Kill()
+		}
+		return nil
+	}
+	return p.Kill()
+}
+
+// runAgent runs one provider to completion and returns its combined output.
+// When transcript is non-nil the output is also copied to it as it arrives.
+func runAgent(parentCtx context.Context, reg providerRegistry, provider, model, workdir, prompt string, timeout time.Duration, transcript io.Writer) (string, error) {
+	def, ok := reg.Providers[provider]
+	if !ok {
+		return "", fmt.Errorf("provider %q not found in registry", provider)
+	}
+
+	ctx, cancel := context.WithTimeout(parentCtx, timeout)
+	defer cancel()
+
+	promptFile := ""
+	if def.Prompt == promptViaFile {
+		f, err := os.CreateTemp("", "obliviate-prompt-*.md")
+		if err != nil {
+			return "", err
+		}
+		promptFile = f.Name()
+		defer os.Remove(promptFile)
+		_, werr := f.WriteString(prompt)
+		if cerr := f.Close(); werr == nil {
+			werr = cerr
+		}
+		if werr != nil {
+			return "", werr
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, def.Command, expandProviderArgs(def, model, workdir, prompt, promptFile)...)
+	if def.Prompt == promptViaStdin {
+		cmd.Stdin = strings.NewReader(prompt)
+	}
+	if len(def.Env) > 0 {
+		env := os.Environ()
+		for k, v := range def.Env {
+			env = append(env, k+"="+os.ExpandEnv(v))
+		}
+		cmd.Env = env
+	}
+
+	cmd.Dir = workdir
+	cmd.WaitDelay = 10 * time.Second
+	cmd.Cancel = func() error { return killProcessTree(cmd.Process) }
+	var out bytes.Buffer
+	var w io.Writer = &out
+	if transcript != nil {
+		w = io.MultiWriter(&out, transcript)
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err := cmd.Run()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return out.String(), fmt.Errorf("agent timed out after %s: %w", timeout, err)
+	}
+	return out.String(), err
+}
+
+// expandProviderArgs fills in a provider's argument template. The prompt
+// file path and prompt text are appended when their delivery mode is
+// selected but the template has no placeholder for them.
+func expandProviderArgs(def ProviderDef, model, workdir, prompt, promptFile string) []string {
+	args := make([]string, 0, len(def.Args)+3)
+	sawModel, sawPromptFile, sawPrompt := false, false, false
+	modelArgs := func() []string {
+		if model == "" || def.ModelFlag == "" {
+			return nil
+		}
+		return []string{def.ModelFlag, model}
+	}
+	for _, a := range def.Args {
+		if a == "{{model_flag}}" {
+			sawModel = true
+			args = append(args, modelArgs()...)
+			continue
+		}
+		if strings.Contains(a, "{{prompt_file}}") {
+			sawPromptFile = true
+		}
+		if strings.Contains(a, "{{prompt}}") {
+			sawPrompt = true
+		}
+		a = strings.ReplaceAll(a, "{{workdir}}", workdir)
+		a = strings.ReplaceAll(a, "{{model}}", model)
+		a = strings.ReplaceAll(a, "{{prompt_file}}", promptFile)
+		a = strings.ReplaceAll(a, "{{prompt}}", prompt)
+		args = append(args, a)
+	}
+	if !sawModel {
+		args = append(args, modelArgs()...)
+	}
+	if def.Prompt == promptViaFile && !sawPromptFile {
+		args = append(args, promptFile)
+	}
+	if def.Prompt == promptViaArg && !sawPrompt {
+		args = append(args, prompt)
+	}
+	return args
+}
+
+// resolveShell returns the shell binary and its "run command" flag.
+// Prefers bash for consistent cross-platform behaviour, falls back to
+// cmd.exe on Windows or sh on Unix.
+func resolveShell() (string, string) {
+	if p, err := exec.LookPath("bash"); err == nil {
+		return p, "-c"
+	}
+	if runtime.GOOS == "windows" {
+		// Common Git-for-Windows / MSYS2 locations not always in PATH.
+		for _, candidate := range []string{
+			filepath.Join(os.Getenv("ProgramFiles"), "Git", "bin", "bash.exe"),
+			filepath.Join(os.Getenv("ProgramFiles(x86)"), "Git", "bin", "bash.exe"),
+			filepath.Join(os.Getenv("LocalAppData"), "Programs", "Git", "bin", "bash.exe"),
+			`C:\msys64\usr\bin\bash.exe`,
+		} {
+			if _, err := os.Stat(candidate); err == nil {
+				return candidate, "-c"
+			}
+		}
+		return "cmd", "/c"
+	}
+	return "sh", "-c"
+}
+
+// quoteList renders items as a comma-separated list of quoted strings, so
+// shell commands containing separators stay readable.
+func quoteList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, s := range items {
+		quoted[i] = strconv.Quote(s)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// verifyExitCode maps a runVerify error to the command's exit code, or -1
+// when the command never exited on its own (timeout, failed to start).
+func verifyExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && !strings.HasPrefix(err.Error(), "verify timed out") {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// runVerify runs one verify command through the shell, honoring its
+// timeout, cwd (relative to workdir), and env overrides; defaultTimeout
+// applies when the command sets none. When stream is non-nil the output is
+// also copied to it as it arrives.
+func runVerify(workdir string, v VerifyCommand, defaultTimeout time.Duration, stream io.Writer) (string, error) {
+	timeout := defaultTimeout
+	if v.Timeout != "" {
+		d, err := time.ParseDuration(v.Timeout)
+		if err != nil {
+			return "", fmt.Errorf("verify timeout must be a duration: %w", err)
+		}
+		timeout = d
+	}
+	dir := workdir
+	if v.Cwd != "" {
+		dir = resolveWorkdir(workdir, v.Cwd)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	shell, flag := resolveShell()
+	cmd := exec.CommandContext(ctx, shell, flag, v.Cmd)
+	cmd.Dir = dir
+	if len(v.Env) > 0 {
+		env := os.Environ()
+		for k, val := range v.Env {
+			env = append(env, k+"="+os.ExpandEnv(val))
+		}
+		cmd.Env = env
+	}
+	cmd.WaitDelay = 10 * time.Second
+	cmd.Cancel = func() error { return killProcessTree(cmd.Process) }
+	var out bytes.Buffer
+	var w io.Writer = &out
+	if stream != nil {
+		w = io.MultiWriter(&out, stream)
+	}
+	cmd.Stdout = w
+	cmd.Stderr = w
+	err := cmd.Run()
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return out.String(), fmt.Errorf("verify timed out after %s: %w", timeout, err)
+	}
+	return out.String(), err
+}
+
+// runCommit is one commit an attempt created.
+type runCommit struct {
+	SHA     string `json:"sha"`
+	Subject string `json:"subject"`
+}
+
+// fileChange is one path an attempt changed relative to its starting HEAD.
+// Binary files have no line counts; untracked files are new files the
+// attempt did not add to git.
+type fileChange struct {
+	Path       string `json:"path"`
+	Insertions int    `json:"insertions"`
+	Deletions  int    `json:"deletions"`
+	Binary     bool   `json:"binary,omitempty"`
+	Untracked  bool   `json:"untracked,omitempty"`
+}
+
+// gitFactsPathspec limits git facts to the workdir minus obliviate's own
+// files, matching diffSummary.
+var gitFactsPathspec = []string{"--", ".", ":(exclude).obliviate"}
+
+// recordGitFacts fills run's head_after, commits, files, and dirty fields
+// from what the attempt did to workdir since base.
+func recordGitFacts(run *RunLog, workdir, base string) {
+	run.HeadBefore = base
+	head, err := gitHead(workdir)
+	if err != nil {
+		return
+	}
+	run.HeadAfter = head
+	if head != base {
+		if out, err := runGit(workdir, "log", "--reverse", "--format=%H%x1f%s", base+".."+head); err == nil {
+			run.Commits = parseRunCommits(out)
 		}
-		tasks = append(tasks, t)
-		added = append(added, t)
 	}
-	if err := saveTasks(p, tasks); err != nil {
-		return nil, err
+	if out, err := runGit(workdir, append([]string{"diff", "--numstat", base}, gitFactsPathspec...)...); err == nil {
+		run.Files = parseNumstat(out)
 	}
-	return added, nil
-}
-
-func nextTaskNumber(tasks []Task) int {
-	maxN := 0
-	for _, t := range tasks {
-		if strings.HasPrefix(t.ID, "OB-") {
-			n, err := strconv.Atoi(strings.TrimPrefix(t.ID, "OB-"))
-			if err == nil && n > maxN {
-				maxN = n
+	if out, err := runGit(workdir, append([]string{"ls-files", "--others", "--exclude-standard"}, gitFactsPathspec...)...); err == nil {
+		for _, f := range strings.Split(out, "\n") {
+			if f != "" {
+				run.Files = append(run.Files, fileChange{Path: f, Untracked: true})
 			}
 		}
 	}
-	return maxN + 1
+	if out, err := runGit(workdir, append([]string{"status", "--porcelain"}, gitFactsPathspec...)...); err == nil {
+		run.Dirty = out != ""
+	}
 }
 
-func loadTasks(path string) ([]Task, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return []Task{}, nil
+func parseRunCommits(out string) []runCommit {
+	var commits []runCommit
+	for _, line := range strings.Split(out, "\n") {
+		sha, subject, ok := strings.Cut(line, "\x1f")
+		if ok {
+			commits = append(commits, runCommit{SHA: sha, Subject: subject})
 		}
-		return nil, err
 	}
-	defer f.Close()
+	return commits
+}
 
-	tasks := make([]Task, 0)
-	s := bufio.NewScanner(f)
-	lineNo := 0
-	for s.Scan() {
-		lineNo++
-		line := strings.TrimSpace(s.Text())
-		if line == "" {
+func parseNumstat(out string) []fileChange {
+	var files []fileChange
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.SplitN(line, "\t", 3)
+		if len(fields) != 3 {
 			continue
 		}
-		var t Task
-		if err := json.Unmarshal([]byte(line), &t); err != nil {
-			return nil, fmt.Errorf("tasks parse line %d: %w", lineNo, err)
+		fc := fileChange{Path: fields[2]}
+		if fields[0] == "-" {
+			fc.Binary = true
+		} else {
+			fc.Insertions, _ = strconv.Atoi(fields[0])
+			fc.Deletions, _ = strconv.Atoi(fields[1])
 		}
-		tasks = append(tasks, t)
+		files = append(files, fc)
 	}
-	return tasks, s.Err()
+	return files
 }
 
-func findTaskIndex(tasks []Task, taskID string) int {
-	for i := range tasks {
-		if tasks[i].ID == taskID {
-			return i
-		}
+// landedCommits re-reads the attempt's commits ending at tip in workdir,
+// where integration may have rebased them onto new SHAs. Subjects and
+// order survive a rebase, so the last len(commits) commits are them.
+func landedCommits(workdir, tip string, commits []runCommit) []runCommit {
+	out, err := runGit(workdir, "log", "--reverse", "--first-parent", "--format=%H%x1f%s", "-n", strconv.Itoa(len(commits)), tip)
+	if err != nil {
+		return commits
 	}
-	return -1
+	if landed := parseRunCommits(out); len(landed) == len(commits) {
+		return landed
+	}
+	return commits
 }
 
-func loadRuns(path string) ([]RunLog, error) {
-	f, err := os.Open(path)
+// diffSummary describes how workdir differs from base: a diffstat covering
+// commits and uncommitted edits, plus any new untracked files. Obliviate's
+// own state directory is left out.
+func diffSummary(workdir, base string) string {
+	stat, err := runGit(workdir, "diff", "--stat", base, "--", ".", ":(exclude).obliviate")
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return []RunLog{}, nil
-		}
-		return nil, err
+		return ""
 	}
-	defer f.Close()
-
-	runs := make([]RunLog, 0)
-	s := bufio.NewScanner(f)
-	lineNo := 0
-	for s.Scan() {
-		lineNo++
-		line := strings.TrimSpace(s.Text())
-		if line == "" {
-			continue
-		}
-		var r RunLog
-		if err := json.Unmarshal([]byte(line), &r); err != nil {
-			return nil, fmt.Errorf("runs parse line %d: %w", lineNo, err)
+	var b strings.Builder
+	b.WriteString(stat)
+	if untracked, err := runGit(workdir, "ls-files", "--others", "--exclude-standard", "--", ".", ":(exclude).obliviate"); err == nil {
+		for _, f := range strings.Split(untracked, "\n") {
+			if f == "" {
+				continue
+			}
+			fmt.Fprintf(&b, "\n new file (untracked): %s", f)
 		}
-		runs = append(runs, r)
 	}
-	return runs, s.Err()
+	return strings.TrimSpace(b.String())
 }
 
-func saveTasks(path string, tasks []Task) error {
-	tmp := path + ".tmp"
-	f, err := os.Create(tmp)
+func gitHead(workdir string) (string, error) {
+	cmd := exec.Command("git", "rev-parse", "HEAD")
+	cmd.Dir = workdir
+	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return err
-	}
-	enc := json.NewEncoder(f)
-	enc.SetEscapeHTML(false)
-	for _, t := range tasks {
-		if err := enc.Encode(t); err != nil {
-			f.Close()
-			_ = os.Remove(tmp)
-			return err
+		msg := strings.TrimSpace(string(out))
+		if msg == "" {
+			msg = err.Error()
 		}
+		return "", fmt.Errorf("git rev-parse HEAD in %s failed: %s", workdir, msg)
 	}
-	if err := f.Close(); err != nil {
-		return err
+	head := strings.TrimSpace(string(out))
+	if head == "" {
+		return "", fmt.Errorf("git rev-parse HEAD in %s returned empty output", workdir)
 	}
-	return os.Rename(tmp, path)
+	return head, nil
 }
 
-func loadInstanceMeta(path string) (InstanceMeta, error) {
-	var m InstanceMeta
-	b, err := os.ReadFile(path)
+// runGit runs git in dir and returns its trimmed combined output.
+func runGit(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	text := strings.TrimSpace(string(out))
 	if err != nil {
-		return m, err
+		msg := text
+		if msg == "" {
+			msg = err.Error()
+		}
+		return text, fmt.Errorf("git %s in %s failed: %s", strings.Join(args, " "), dir, msg)
 	}
-	err = json.Unmarshal(b, &m)
-	return m, err
+	return text, nil
 }
 
-func nextRunnableTaskIndex(tasks []Task, maxAttempts int) int {
-	for i := range tasks {
-		if tasks[i].Status == statusTodo {
-			return i
-		}
-	}
-	for i := range tasks {
-		if tasks[i].Status == statusFailed && tasks[i].Attempts < maxAttempts {
-			return i
-		}
+func shortSHA(sha string) string {
+	if len(sha) > 12 {
+		return sha[:12]
 	}
-	return -1
+	return sha
 }
 
-func buildExecutionPrompt(home, instance string, task Task) (string, error) {
-	skill, _ := readText(filepath.Join(home, "SKILL.md"))
-	globalPrompt, _ := readText(filepath.Join(home, "global-prompt.md"))
-	instDir := filepath.Join(home, "state", instance)
-	promptMD, _ := readText(filepath.Join(instDir, "prompt.md"))
-	specMD, _ := readText(filepath.Join(instDir, "spec.md"))
-	instLearn, _ := readText(filepath.Join(instDir, "learnings.md"))
-	globalLearn, _ := readText(filepath.Join(home, "global-learnings.md"))
+func printStatus(instance string, tasks []Task) {
+	printStatusSummary(summarizeStatus(instance, tasks))
+}
 
-	taskJSON, _ := json.MarshalIndent(task, "", "  ")
-	parts := []string{
-		"You are running inside Obliviate's fresh-context task loop. Complete exactly one task.",
-		"## SKILL.md\n" + skill,
-		"## Global Prompt\n" + globalPrompt,
-		"## Instance Prompt\n" + promptMD,
-		"## Feature Spec\n" + specMD,
-		"## Global Learnings\n" + globalLearn,
-		"## Instance Learnings\n" + instLearn,
-		"## Current Task (JSON)\n" + string(taskJSON),
-		"## Output Requirements\n- Implement the task\n- Run verify commands\n- Commit changes with a clear message\n- If blocked, explain exact blocker and failing command",
+type statusSummary struct {
+	Instance   string      `json:"instance"`
+	Total      int         `json:"total"`
+	Todo       int         `json:"todo"`
+	InProgress int         `json:"in_progress"`
+	Done       int         `json:"done"`
+	Failed     int         `json:"failed"`
+	Blocked    int         `json:"blocked"`
+	Waiting    int         `json:"waiting"`
+	Lock       *lockHolder `json:"lock,omitempty"`
+	Runner     *lockHolder `json:"runner,omitempty"`
+}
+
+func summarizeStatus(instance string, tasks []Task) statusSummary {
+	counts := map[string]int{
+		statusTodo:       0,
+		statusInProgress: 0,
+		statusDone:       0,
+		statusFailed:     0,
+		statusBlocked:    0,
+	}
+	statuses := taskStatusByID(tasks)
+	waiting := 0
+	for _, t := range tasks {
+		counts[t.Status]++
+		if (t.Status == statusTodo || t.Status == statusFailed) && !dependenciesDone(t, statuses) {
+			waiting++
+		}
+	}
+	return statusSummary{
+		Instance:   instance,
+		Total:      len(tasks),
+		Todo:       counts[statusTodo],
+		InProgress: counts[statusInProgress],
+		Done:       counts[statusDone],
+		Failed:     counts[statusFailed],
+		Blocked:    counts[statusBlocked],
+		Waiting:    waiting,
 	}
-	return strings.Join(parts, "\n\n"), nil
 }
 
-func routeModel(hint string) (provider, model string) {
-	h := strings.ToLower(strings.TrimSpace(hint))
-	if h == "" {
-		return "codex", ""
+func printStatusSummary(s statusSummary) {
+	fmt.Printf("[%s] total=%d todo=%d in_progress=%d done=%d failed=%d blocked=%d waiting=%d\n",
+		s.Instance,
+		s.Total,
+		s.Todo,
+		s.InProgress,
+		s.Done,
+		s.Failed,
+		s.Blocked,
+		s.Waiting)
+	if s.Runner != nil {
+		fmt.Printf("  runner: %s\n", s.Runner)
 	}
-	if strings.Contains(h, "opus") {
-		return "claude", "opus"
+	if s.Lock != nil {
+		fmt.Printf("  tasks lock held by %s\n", s.Lock)
 	}
-	if strings.Contains(h, "sonnet") {
-		return "claude", "sonnet"
+}
+
+// runArtifacts holds the transcript files for one run, kept under
+// state/<instance>/runs/<run-id>/. Paths are relative to the instance dir.
+type runArtifacts struct {
+	PromptPath string
+	OutputPath string
+	VerifyPath string
+	Output     *os.File
+	Verify     *os.File
+}
+
+func runArtifactDir(instDir, runID string) string {
+	return filepath.Join(instDir, "runs", runID)
+}
+
+// newRunID returns a sortable, unique run identifier such as
+// 20260217T101500Z-OB-001-3f2a.
+func newRunID(taskID string) string {
+	return fmt.Sprintf("%s-%s-%04x", time.Now().UTC().Format("20060102T150405Z"), taskID, rand.Uint32()&0xffff)
+}
+
+// openRunArtifacts creates the run directory, writes the prompt, and opens
+// the agent and verify transcripts for appending.
+func openRunArtifacts(instDir, runID, prompt string) (*runArtifacts, error) {
+	dir := runArtifactDir(instDir, runID)
+	if err := ensureDir(dir); err != nil {
+		return nil, err
 	}
-	if strings.Contains(h, "haiku") {
-		return "claude", "haiku"
+	rel := func(name string) string { return filepath.ToSlash(filepath.Join("runs", runID, name)) }
+	art := &runArtifacts{
+		PromptPath: rel("prompt.md"),
+		OutputPath: rel("agent.log"),
+		VerifyPath: rel("verify.log"),
 	}
-	if strings.HasPrefix(h, "claude") {
-		parts := strings.SplitN(h, ":", 2)
-		if len(parts) == 2 {
-			return "claude", normalizeClaudeModel(parts[1])
-		}
-		return "claude", normalizeClaudeModel(h)
+	if err := os.WriteFile(filepath.Join(dir, "prompt.md"), []byte(prompt), 0o644); err != nil {
+		return nil, err
 	}
-	if strings.HasPrefix(h, "codex") || strings.HasPrefix(h, "gpt") || strings.HasPrefix(h, "o") {
-		if h == "codex" {
-			return "codex", ""
-		}
-		return "codex", h
+	var err error
+	if art.Output, err = os.Create(filepath.Join(dir, "agent.log")); err != nil {
+		return nil, err
 	}
-	return "codex", ""
+	if art.Verify, err = os.Create(filepath.Join(dir, "verify.log")); err != nil {
+		art.Output.Close()
+		return nil, err
+	}
+	return art, nil
 }
 
-func normalizeClaudeModel(m string) string {
-	m = strings.ToLower(strings.TrimSpace(m))
-	m = strings.TrimPrefix(m, "claude-")
-	return m
+func (a *runArtifacts) Close() {
+	_ = a.Output.Close()
+	_ = a.Verify.Close()
 }
 
-func resolveWorkdir(projectRoot, configured string) string {
-	w := strings.TrimSpace(configured)
-	if w == "" {
-		return filepath.Clean(projectRoot)
+// writeVerifyResult closes a verify command's transcript entry; the command
+// line and its output have already been written as they happened.
+func writeVerifyResult(w io.Writer, output string, err error) {
+	if output != "" && !strings.HasSuffix(output, "\n") {
+		fmt.Fprintln(w)
 	}
-	if filepath.IsAbs(w) {
-		return filepath.Clean(w)
+	if err != nil {
+		fmt.Fprintf(w, "[obliviate verify failed: %v]\n", err)
+	} else {
+		fmt.Fprintln(w, "[obliviate verify passed]")
 	}
-	return filepath.Clean(filepath.Join(projectRoot, w))
 }
 
-func runAgentWithFallback(ctx context.Context, primaryProvider, primaryModel, workdir, prompt string, timeout time.Duration) (provider, model, output string, err error, fb *fallbackAttempt) {
-	out1, err1 := runAgent(ctx, primaryProvider, primaryModel, workdir, prompt, timeout)
-	if err1 == nil {
-		return primaryProvider, primaryModel, out1, nil, nil
-	}
-	reason := classifyProviderFailure(err1, out1)
-	if reason == "" {
-		return primaryProvider, primaryModel, out1, err1, nil
+// writeRunRecord stores the final RunLog next to its transcripts. Its
+// presence marks the run as finished.
+func writeRunRecord(instDir string, run RunLog) error {
+	b, err := json.MarshalIndent(run, "", "  ")
+	if err != nil {
+		return err
 	}
+	return os.WriteFile(filepath.Join(runArtifactDir(instDir, run.RunID), "run.json"), append(b, '\n'), 0o644)
+}
 
-	fallbackProvider, fallbackModel, ok := selectFallback(primaryProvider, primaryModel)
-	if !ok {
-		return primaryProvider, primaryModel, out1, err1, nil
+func loadRunRecord(instDir, runID string) (RunLog, error) {
+	var run RunLog
+	b, err := os.ReadFile(filepath.Join(runArtifactDir(instDir, runID), "run.json"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return RunLog{RunID: runID}, nil
+		}
+		return run, err
 	}
+	err = json.Unmarshal(b, &run)
+	return run, err
+}
 
-	out2, err2 := runAgent(ctx, fallbackProvider, fallbackModel, workdir, prompt, timeout)
-	combined := strings.TrimSpace(out1 + "\n\n[obliviate fallback]\n" + out2)
-	details := &fallbackAttempt{
-		PrimaryProvider:  primaryProvider,
-		PrimaryModel:     primaryModel,
-		FallbackProvider: fallbackProvider,
-		FallbackModel:    fallbackModel,
-		Reason:           reason,
+func listRunIDs(instDir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(instDir, "runs"))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
 	}
-	if err2 == nil {
-		return fallbackProvider, fallbackModel, combined, nil, details
+	ids := make([]string, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() {
+			ids = append(ids, e.Name())
+		}
 	}
-	return fallbackProvider, fallbackModel, combined, fmt.Errorf("primary failed (%s): %v; fallback failed: %v", reason, err1, err2), details
+	sort.Strings(ids)
+	return ids, nil
 }
 
-func selectFallback(provider, model string) (fallbackProvider, fallbackModel string, ok bool) {
-	if provider == "codex" {
-		// Cost guardrail: codex falls back to sonnet, never opus.
-		return "claude", "sonnet", true
+// resolveRunRef accepts a run ID or a task ID; a task ID resolves to that
+// task's most recent run.
+func resolveRunRef(instDir, ref string) (string, error) {
+	ids, err := listRunIDs(instDir)
+	if err != nil {
+		return "", err
+	}
+	latest := ""
+	for _, id := range ids {
+		if id == ref {
+			return id, nil
+		}
+		if strings.Contains(id, "-"+ref+"-") {
+			latest = id
+		}
 	}
-	if provider == "claude" {
-		// Claude variants fall back to codex.
-		return "codex", "", true
+	if latest == "" {
+		return "", fmt.Errorf("no run artifacts found for %q", ref)
 	}
-	return "", "", false
+	return latest, nil
 }
 
-func classifyProviderFailure(err error, output string) string {
-	if err == nil {
-		return ""
+// pruneRunArtifacts deletes the oldest finished run directories so at most
+// keep remain. Runs still in progress (no run.json yet) are never removed.
+func pruneRunArtifacts(instDir string, keep int) error {
+	ids, err := listRunIDs(instDir)
+	if err != nil {
+		return err
 	}
-	msg := strings.ToLower(err.Error() + "\n" + output)
-	// Broader contains-any pass for common provider-level failures.
-	containsAny := func(keys ...string) bool {
-		for _, k := range keys {
-			if strings.Contains(msg, k) {
-				return true
-			}
+	excess := len(ids) - keep
+	for _, id := range ids {
+		if excess <= 0 {
+			break
 		}
-		return false
+		dir := runArtifactDir(instDir, id)
+		if _, err := os.Stat(filepath.Join(dir, "run.json")); err != nil {
+			continue
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		excess--
 	}
-	switch {
-	case containsAny("rate limit", "rate-limited", "too many requests", "429"):
-		return "rate_limit"
-	case containsAny("usage limit", "quota", "daily limit", "weekly limit", "monthly limit"):
-		return "quota"
-	case containsAny("billing", "payment", "insufficient credits"):
-		return "billing"
-	case containsAny("model", "not exist", "not have access", "unknown model"):
-		return "model_unavailable"
-	case containsAny("temporarily unavailable", "service unavailable", "overloaded"):
-		return "provider_unavailable"
-	case containsAny("auth", "unauthorized", "forbidden", "login required"):
-		return "auth"
-	default:
-		return ""
+	return nil
+}
+
+func copyFileTo(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("run artifact not found (pruned?): %s", path)
+		}
+		return err
 	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
 }
 
-func isTransientFailure(reason string) bool {
-	return reason == "rate_limit" || reason == "provider_unavailable"
+// followRunArtifacts streams agent.log and then verify.log as they grow,
+// returning once run.json appears or ctx is cancelled.
+func followRunArtifacts(ctx context.Context, dir, runID string, w io.Writer) error {
+	finished := func() bool {
+		_, err := os.Stat(filepath.Join(dir, "run.json"))
+		return err == nil
+	}
+	verifyStarted := func() bool {
+		info, err := os.Stat(filepath.Join(dir, "verify.log"))
+		return err == nil && info.Size() > 0
+	}
+	sections := []struct {
+		name, title string
+		done        func() bool
+	}{
+		{"agent.log", "agent output", func() bool { return finished() || verifyStarted() }},
+		{"verify.log", "verify", finished},
+	}
+	for _, sec := range sections {
+		fmt.Fprintf(w, "=== %s (%s) ===\n", sec.title, runID)
+		var offset int64
+		for {
+			// Check completion before draining so the final bytes are not missed.
+			done := sec.done()
+			n, err := copyFileFrom(w, filepath.Join(dir, sec.name), offset)
+			if err != nil {
+				return err
+			}
+			offset += n
+			if done {
+				break
+			}
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(500 * time.Millisecond):
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	return nil
 }
 
-func killProcessTree(p *os.Process) error {
-	if runtime.GOOS == "windows" {
-		kill := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(p.Pid))
-		if err := kill.Run(); err != nil {
-			return p.Kill()
+func copyFileFrom(w io.Writer, path string, offset int64) (int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
 		}
-		return nil
+		return 0, err
 	}
-	return p.Kill()
+	defer f.Close()
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, f)
 }
 
-func runAgent(parentCtx context.Context, provider, model, workdir, prompt string, timeout time.Duration) (string, error) {
-	ctx, cancel := context.WithTimeout(parentCtx, timeout)
-	defer cancel()
+// lineWriter hands each complete line written to it to emit. It is safe for
+// concurrent use; Flush emits any trailing partial line.
+type lineWriter struct {
+	mu   sync.Mutex
+	buf  []byte
+	emit func(string)
+}
 
-	var cmd *exec.Cmd
-	if provider == "claude" {
-		args := []string{
-			"-p",
-			"--output-format", "text",
-			"--permission-mode", "bypassPermissions",
-			"--dangerously-skip-permissions",
-			"--no-session-persistence",
-			"--disallowedTools", "AskUserQuestion,EnterPlanMode",
-		}
-		if model != "" {
-			args = append(args, "--model", model)
-		}
-		cmd = exec.CommandContext(ctx, "claude", args...)
-		cmd.Stdin = strings.NewReader(prompt)
-	} else {
-		args := []string{
-			"exec",
-			"--cd", workdir,
-			"--skip-git-repo-check",
-			"--dangerously-bypass-approvals-and-sandbox",
-			"-",
-		}
-		if model != "" {
-			args = append([]string{"exec", "--cd", workdir, "--skip-git-repo-check", "--dangerously-bypass-approvals-and-sandbox", "--model", model, "-"})
+func newLineWriter(emit func(string)) *lineWriter {
+	return &lineWriter{emit: emit}
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
 		}
-		cmd = exec.CommandContext(ctx, "codex", args...)
-		cmd.Stdin = strings.NewReader(prompt)
+		w.emit(strings.TrimRight(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
 	}
+	return len(p), nil
+}
 
-	cmd.Dir = workdir
-	cmd.WaitDelay = 10 * time.Second
-	cmd.Cancel = func() error { return killProcessTree(cmd.Process) }
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
-	err := cmd.Run()
-	if err != nil && ctx.Err() == context.DeadlineExceeded {
-		return out.String(), fmt.Errorf("agent timed out after %s: %w", timeout, err)
+func (w *lineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.buf) > 0 {
+		w.emit(strings.TrimRight(string(w.buf), "\r"))
+		w.buf = nil
 	}
-	return out.String(), err
 }
 
-// resolveShell returns the shell binary and its "run command" flag.
-// Prefers bash for consistent cross-platform behaviour, falls back to
-// cmd.exe on Windows or sh on Unix.
-func resolveShell() (string, string) {
-	if p, err := exec.LookPath("bash"); err == nil {
-		return p, "-c"
+// emitOutputLine prints one streamed output line for go --stream.
+func emitOutputLine(cfg goConfig, taskID, source, line string) {
+	if cfg.JSON {
+		emitEvent(agentOutputEvent{
+			eventEnvelope: newEnvelope(cfg.Instance, "agent_output"),
+			TaskID:        taskID,
+			Source:        source,
+			Line:          line,
+		})
+		return
 	}
-	if runtime.GOOS == "windows" {
-		// Common Git-for-Windows / MSYS2 locations not always in PATH.
-		for _, candidate := range []string{
-			filepath.Join(os.Getenv("ProgramFiles"), "Git", "bin", "bash.exe"),
-			filepath.Join(os.Getenv("ProgramFiles(x86)"), "Git", "bin", "bash.exe"),
-			filepath.Join(os.Getenv("LocalAppData"), "Programs", "Git", "bin", "bash.exe"),
-			`C:\msys64\usr\bin\bash.exe`,
-		} {
-			if _, err := os.Stat(candidate); err == nil {
-				return candidate, "-c"
-			}
-		}
-		return "cmd", "/c"
+	if source == "verify" {
+		fmt.Printf("%s verify| %s\n", taskID, line)
+		return
 	}
-	return "sh", "-c"
+	fmt.Printf("%s| %s\n", taskID, line)
 }
 
-func runVerify(workdir, verifyCmd string, timeout time.Duration) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
-	defer cancel()
+// learningEntry is one learning reported by an agent. Promote routes it to
+// global-learnings.md instead of the instance file.
+type learningEntry struct {
+	Text    string
+	Promote bool
+}
 
-	shell, flag := resolveShell()
-	cmd := exec.CommandContext(ctx, shell, flag, verifyCmd)
-	cmd.Dir = workdir
-	cmd.WaitDelay = 10 * time.Second
-	cmd.Cancel = func() error { return killProcessTree(cmd.Process) }
-	var out bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &out
-	err := cmd.Run()
-	if err != nil && ctx.Err() == context.DeadlineExceeded {
-		return out.String(), fmt.Errorf("verify timed out after %s: %w", timeout, err)
-	}
-	return out.String(), err
+type learningsStats struct {
+	Entries    int `json:"entries"`
+	Duplicates int `json:"removed_duplicates"`
+	Pruned     int `json:"pruned"`
 }
 
-func gitHead(workdir string) (string, error) {
-	cmd := exec.Command("git", "rev-parse", "HEAD")
-	cmd.Dir = workdir
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		msg := strings.TrimSpace(string(out))
-		if msg == "" {
-			msg = err.Error()
+var (
+	learningsBlockRe = regexp.MustCompile(`(?s)<learnings>(.*?)</learnings>`)
+	// learningPrefixRe matches the "- [ts] OB-001: " (or "web/OB-001: ")
+	// prefix written by recordLearnings.
+	learningPrefixRe = regexp.MustCompile(`^-\s*(\[[^\]]*\]\s*)?([\w.-]+/)?(OB-\d+:\s*)?`)
+	// legacyCompletedRe matches the completion lines older versions appended
+	// after every done task.
+	legacyCompletedRe = regexp.MustCompile(`^- \[[^\]]*\] OB-\d+ completed \(.*\)$`)
+)
+
+// parseLearnings extracts entries from every <learnings>...</learnings>
+// block in agent output. Each non-empty line is one entry; list bullets are
+// stripped and a leading [promote] marks the entry for global learnings.
+func parseLearnings(output string) []learningEntry {
+	var entries []learningEntry
+	for _, m := range learningsBlockRe.FindAllStringSubmatch(output, -1) {
+		for _, line := range strings.Split(m[1], "\n") {
+			line = strings.TrimSpace(line)
+			line = strings.TrimSpace(strings.TrimLeft(line, "-*"))
+			promote := false
+			if strings.HasPrefix(strings.ToLower(line), "[promote]") {
+				promote = true
+				line = strings.TrimSpace(line[len("[promote]"):])
+			}
+			if line == "" {
+				continue
+			}
+			entries = append(entries, learningEntry{Text: line, Promote: promote})
 		}
-		return "", fmt.Errorf("git rev-parse HEAD in %s failed: %s", workdir, msg)
-	}
-	head := strings.TrimSpace(string(out))
-	if head == "" {
-		return "", fmt.Errorf("git rev-parse HEAD in %s returned empty output", workdir)
 	}
-	return head, nil
+	return entries
 }
 
-func printStatus(instance string, tasks []Task) {
-	printStatusSummary(summarizeStatus(instance, tasks))
+// recordLearnings appends entries to the instance's learnings.md, or to
+// global-learnings.md (tagged with the instance) for promoted ones.
+func recordLearnings(home, instance, taskID string, entries []learningEntry) error {
+	ts := nowUTC()
+	var local, global strings.Builder
+	for _, e := range entries {
+		if e.Promote {
+			fmt.Fprintf(&global, "- [%s] %s/%s: %s\n", ts, instance, taskID, e.Text)
+		} else {
+			fmt.Fprintf(&local, "- [%s] %s: %s\n", ts, taskID, e.Text)
+		}
+	}
+	if local.Len() > 0 {
+		if err := appendLine(filepath.Join(home, "state", instance, "learnings.md"), local.String()); err != nil {
+			return err
+		}
+	}
+	if global.Len() > 0 {
+		return appendLine(filepath.Join(home, "global-learnings.md"), global.String())
+	}
+	return nil
 }
 
-type statusSummary struct {
-	Instance   string `json:"instance"`
-	Total      int    `json:"total"`
-	Todo       int    `json:"todo"`
-	InProgress int    `json:"in_progress"`
-	Done       int    `json:"done"`
-	Failed     int    `json:"failed"`
-	Blocked    int    `json:"blocked"`
+// compactLearnings rewrites a learnings file, optionally dropping entries
+// whose text (ignoring timestamp and task prefix, case, and spacing) repeats
+// an earlier one, and legacy completion lines. Non-entry lines such as
+// headings are kept as is.
+func compactLearnings(content string, dedupe, prune bool) (string, learningsStats) {
+	var stats learningsStats
+	seen := map[string]bool{}
+	var out []string
+	for _, line := range strings.SplitAfter(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if !strings.HasPrefix(trimmed, "- ") {
+			out = append(out, line)
+			continue
+		}
+		if prune && legacyCompletedRe.MatchString(trimmed) {
+			stats.Pruned++
+			continue
+		}
+		key := strings.ToLower(strings.Join(strings.Fields(learningPrefixRe.ReplaceAllString(trimmed, "")), " "))
+		if dedupe && seen[key] {
+			stats.Duplicates++
+			continue
+		}
+		seen[key] = true
+		stats.Entries++
+		out = append(out, line)
+	}
+	return strings.Join(out, ""), stats
 }
 
-func summarizeStatus(instance string, tasks []Task) statusSummary {
-	counts := map[string]int{
-		statusTodo:       0,
-		statusInProgress: 0,
-		statusDone:       0,
-		statusFailed:     0,
-		statusBlocked:    0,
-	}
-	for _, t := range tasks {
-		counts[t.Status]++
-	}
-	return statusSummary{
-		Instance:   instance,
-		Total:      len(tasks),
-		Todo:       counts[statusTodo],
-		InProgress: counts[statusInProgress],
-		Done:       counts[statusDone],
-		Failed:     counts[statusFailed],
-		Blocked:    counts[statusBlocked],
+func learningEntryLines(content string) []string {
+	lines := []string{}
+	for _, line := range strings.Split(content, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "- ") {
+			lines = append(lines, strings.TrimSpace(line))
+		}
 	}
+	return lines
 }
 
-func printStatusSummary(s statusSummary) {
-	fmt.Printf("[%s] total=%d todo=%d in_progress=%d done=%d failed=%d blocked=%d\n",
-		s.Instance,
-		s.Total,
-		s.Todo,
-		s.InProgress,
-		s.Done,
-		s.Failed,
-		s.Blocked)
+// writeFileAtomic replaces path with content via a temp file and rename.
+func writeFileAtomic(path, content string) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(content), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
 }
 
 func readText(path string) (string, error) {
@@ -1788,7 +6525,7 @@ Rules for each task run:
 4. Commit once with a clear message.
 5. If blocked, report failing command and why.
 6. Read and apply learnings from both .obliviate/global-learnings.md and this instance's learnings.md.
-7. Append non-obvious learnings to this instance's learnings.md (and promote reusable ones to .obliviate/global-learnings.md).
+7. Report non-obvious learnings in a <learnings> block at the end of your final answer, one per line; prefix reusable ones with [promote] to share them across instances.
 `, instance)
 }
 
@@ -1806,25 +6543,284 @@ func acquireInstanceLock(instDir string) (func(), error) {
 	if err := ensureDir(instDir); err != nil {
 		return nil, fmt.Errorf("cannot create instance dir %s: %w", instDir, err)
 	}
-	lockPath := filepath.Join(instDir, ".tasks.lock")
+	f, err := acquireFileLock(filepath.Join(instDir, tasksLockName), lockWaitMax)
+	if err != nil {
+		return nil, err
+	}
+	return func() { releaseFileLock(f) }, nil
+}
+
+const tasksLockName = ".tasks.lock"
+
+var errLockBusy = errors.New("lock is held by another process")
+
+// lockHolder is the diagnostic payload written into a lock file by the
+// process holding it. The OS advisory lock is what actually excludes
+// others; the payload only says who has it.
+type lockHolder struct {
+	ID          string `json:"id,omitempty"`
+	PID         int    `json:"pid"`
+	Host        string `json:"host,omitempty"`
+	StartedAt   string `json:"started_at,omitempty"`
+	HeartbeatAt string `json:"heartbeat_at,omitempty"`
+	Command     string `json:"command,omitempty"`
+}
+
+func (h lockHolder) String() string {
+	if h.PID == 0 {
+		return "unknown process"
+	}
+	s := fmt.Sprintf("pid %d", h.PID)
+	if h.Host != "" {
+		s += " on " + h.Host
+	}
+	if h.StartedAt != "" {
+		s += " since " + h.StartedAt
+	}
+	if h.Command != "" {
+		s += fmt.Sprintf(" (obliviate %s)", h.Command)
+	}
+	if h.HeartbeatAt != "" {
+		s += ", last heartbeat " + h.HeartbeatAt
+	}
+	return s
+}
+
+// heartbeatFresh reports whether a runner lease holder has heartbeated
+// within runnerLeaseTTL.
+func (h lockHolder) heartbeatFresh() bool {
+	at, err := time.Parse(time.RFC3339, h.HeartbeatAt)
+	return err == nil && time.Since(at) < runnerLeaseTTL
+}
+
+// dead reports whether the holder is known to be gone: it ran on this host
+// and its PID no longer exists. Holders on other hosts are never assumed
+// dead.
+func (h lockHolder) dead() bool {
+	host, _ := os.Hostname()
+	return h.PID > 0 && h.Host == host && !processAlive(h.PID)
+}
+
+// acquireFileLock takes an exclusive advisory lock on path, waiting up to
+// wait. The OS drops the lock when the holder exits, even on SIGKILL, so a
+// stale payload never blocks; the file is never removed here, since a
+// waiter unlinking it could let two processes lock different inodes.
+func acquireFileLock(path string, wait time.Duration) (*os.File, error) {
 	start := time.Now()
 	for {
-		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		err = tryLockFile(f)
 		if err == nil {
-			_, _ = fmt.Fprintf(f, "%d\n", os.Getpid())
+			// The file may have been replaced between open and lock.
+			if lockedCurrentFile(f, path) {
+				writeLockPayload(f, newLockHolder())
+				return f, nil
+			}
+			_ = unlockFile(f)
 			_ = f.Close()
-			return func() { _ = os.Remove(lockPath) }, nil
+			continue
 		}
-		if !os.IsExist(err) && !errors.Is(err, os.ErrExist) {
-			return nil, err
+		_ = f.Close()
+		if !errors.Is(err, errLockBusy) {
+			return nil, fmt.Errorf("lock %s: %w", path, err)
 		}
-		if time.Since(start) > lockWaitMax {
-			return nil, fmt.Errorf("runtime: timed out waiting for lock %s", lockPath)
+		if time.Since(start) > wait {
+			holder, _ := readLockHolder(path)
+			return nil, fmt.Errorf("runtime: timed out waiting for lock %s held by %s", path, holder)
 		}
 		time.Sleep(lockWaitStep)
 	}
 }
 
+// lockedCurrentFile reports whether f is still the file at path.
+func lockedCurrentFile(f *os.File, path string) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	cur, err := os.Stat(path)
+	return err == nil && os.SameFile(fi, cur)
+}
+
+func newLockHolder() lockHolder {
+	host, _ := os.Hostname()
+	return lockHolder{
+		PID:       os.Getpid(),
+		Host:      host,
+		StartedAt: nowUTC(),
+		Command:   strings.Join(os.Args[1:], " "),
+	}
+}
+
+// writeLockPayload overwrites the payload in place, truncating afterwards
+// so readers never see an empty file between writes.
+func writeLockPayload(f *os.File, h lockHolder) {
+	b, _ := json.Marshal(h)
+	b = append(b, '\n')
+	_, _ = f.WriteAt(b, 0)
+	_ = f.Truncate(int64(len(b)))
+}
+
+const (
+	runnerLockName  = ".runner.lock"
+	runnerHeartbeat = 10 * time.Second
+	runnerLeaseTTL  = 3 * runnerHeartbeat
+)
+
+// runnerLease is held by a go loop for its whole run so that only one
+// runner works an instance at a time. Besides the OS lock, the holder
+// heartbeats into the lease file; that lets runners on other hosts sharing
+// the state directory (where advisory locks may not reach) see it is alive.
+type runnerLease struct {
+	f      *os.File
+	holder lockHolder
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// acquireRunnerLease takes the instance's runner lease. If another runner
+// is alive it fails, or with wait polls until the lease frees up, calling
+// onWait once with the current holder.
+func acquireRunnerLease(instDir string, wait bool, onWait func(lockHolder)) (*runnerLease, error) {
+	if err := ensureDir(instDir); err != nil {
+		return nil, fmt.Errorf("cannot create instance dir %s: %w", instDir, err)
+	}
+	path := filepath.Join(instDir, runnerLockName)
+	host, _ := os.Hostname()
+	waiting := false
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+		if err != nil {
+			return nil, err
+		}
+		var holder lockHolder
+		err = tryLockFile(f)
+		switch {
+		case err == nil && !lockedCurrentFile(f, path):
+			_ = unlockFile(f)
+			_ = f.Close()
+			continue
+		case err == nil:
+			prev, _ := readLockHolder(path)
+			if prev.ID == "" || prev.Host == host || !prev.heartbeatFresh() {
+				return startRunnerLease(f), nil
+			}
+			// A runner on another host is still heartbeating.
+			_ = unlockFile(f)
+			_ = f.Close()
+			holder = prev
+		case errors.Is(err, errLockBusy):
+			_ = f.Close()
+			holder, _ = readLockHolder(path)
+		default:
+			_ = f.Close()
+			return nil, fmt.Errorf("lock %s: %w", path, err)
+		}
+		if !wait {
+			return nil, fmt.Errorf("another go runner is active for this instance: %s; use --wait to run after it", holder)
+		}
+		if !waiting && onWait != nil {
+			onWait(holder)
+		}
+		waiting = true
+		time.Sleep(time.Second)
+	}
+}
+
+func startRunnerLease(f *os.File) *runnerLease {
+	l := &runnerLease{f: f, holder: newLockHolder(), stop: make(chan struct{}), done: make(chan struct{})}
+	l.holder.ID = fmt.Sprintf("%s-%d-%s", l.holder.Host, l.holder.PID, time.Now().UTC().Format("20060102T150405Z"))
+	l.holder.HeartbeatAt = l.holder.StartedAt
+	writeLockPayload(f, l.holder)
+	go func() {
+		defer close(l.done)
+		ticker := time.NewTicker(runnerHeartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-l.stop:
+				return
+			case <-ticker.C:
+				l.holder.HeartbeatAt = nowUTC()
+				writeLockPayload(f, l.holder)
+			}
+		}
+	}()
+	return l
+}
+
+func (l *runnerLease) release() {
+	close(l.stop)
+	<-l.done
+	releaseFileLock(l.f)
+}
+
+// runnerStatus reports the active go runner for an instance, or nil.
+func runnerStatus(instDir string) *lockHolder {
+	path := filepath.Join(instDir, runnerLockName)
+	if holder, err := lockStatus(path); err == nil && holder != nil {
+		return holder
+	}
+	host, _ := os.Hostname()
+	if prev, err := readLockHolder(path); err == nil && prev.ID != "" && prev.Host != host && prev.heartbeatFresh() {
+		return &prev
+	}
+	return nil
+}
+
+// releaseFileLock clears the payload and drops the lock. The file itself
+// is kept: removing it would let a waiter lock a file nobody else opens.
+func releaseFileLock(f *os.File) {
+	_ = f.Truncate(0)
+	_ = unlockFile(f)
+	_ = f.Close()
+}
+
+// readLockHolder parses a lock file payload. Lock files written by older
+// versions hold only the PID.
+func readLockHolder(path string) (lockHolder, error) {
+	var h lockHolder
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return h, err
+	}
+	text := strings.TrimSpace(string(b))
+	if text == "" {
+		return h, nil
+	}
+	if pid, err := strconv.Atoi(text); err == nil {
+		h.PID = pid
+		return h, nil
+	}
+	err = json.Unmarshal([]byte(text), &h)
+	return h, err
+}
+
+// lockStatus reports who holds the lock at path, or nil when it is free.
+func lockStatus(path string) (*lockHolder, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	err = tryLockFile(f)
+	if err == nil {
+		_ = unlockFile(f)
+		return nil, nil
+	}
+	if !errors.Is(err, errLockBusy) {
+		return nil, err
+	}
+	holder, _ := readLockHolder(path)
+	return &holder, nil
+}
+
 func printJSON(v any) error {
 	enc := json.NewEncoder(os.Stdout)
 	enc.SetEscapeHTML(false)
@@ -1847,8 +6843,3 @@ func classifyExitCode(err error) int {
 		return exitRuntime
 	}
 }
-
-
-
-
-
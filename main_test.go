@@ -1,10 +1,17 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestParseBatchJSONAndJSONL(t *testing.T) {
@@ -19,7 +26,7 @@ func TestParseBatchJSONAndJSONL(t *testing.T) {
 	if len(got) != 2 {
 		t.Fatalf("expected 2 tasks, got %d", len(got))
 	}
-	if len(got[0].Verify) != 1 || got[0].Verify[0] != "go test ./..." {
+	if len(got[0].Verify) != 1 || got[0].Verify[0].Cmd != "go test ./..." {
 		t.Fatalf("unexpected verify parsing for first task: %#v", got[0].Verify)
 	}
 	if len(got[1].Verify) != 2 {
@@ -76,7 +83,7 @@ func TestNextRunnableTaskIndex(t *testing.T) {
 		{ID: "OB-002", Status: statusFailed, Attempts: 1},
 		{ID: "OB-003", Status: statusTodo},
 	}
-	idx := nextRunnableTaskIndex(tasks, 2)
+	idx := nextRunnableTaskIndex(tasks, 2, "")
 	if idx != 2 {
 		t.Fatalf("expected todo task index 2 first, got %d", idx)
 	}
@@ -86,7 +93,7 @@ func TestNextRunnableTaskIndex(t *testing.T) {
 		{ID: "OB-002", Status: statusFailed, Attempts: 1},
 		{ID: "OB-003", Status: statusBlocked, Attempts: 2},
 	}
-	idx = nextRunnableTaskIndex(tasks, 2)
+	idx = nextRunnableTaskIndex(tasks, 2, "")
 	if idx != 1 {
 		t.Fatalf("expected failed retry task index 1, got %d", idx)
 	}
@@ -98,12 +105,12 @@ func TestNextRunnableTaskIndexCustomMaxAttempts(t *testing.T) {
 		{ID: "OB-002", Status: statusFailed, Attempts: 3},
 	}
 	// With maxAttempts=2, OB-001 is at the limit so not runnable.
-	idx := nextRunnableTaskIndex(tasks, 2)
+	idx := nextRunnableTaskIndex(tasks, 2, "")
 	if idx != -1 {
 		t.Fatalf("expected -1 with maxAttempts=2, got %d", idx)
 	}
 	// With maxAttempts=4, both are runnable; first one wins.
-	idx = nextRunnableTaskIndex(tasks, 4)
+	idx = nextRunnableTaskIndex(tasks, 4, "")
 	if idx != 0 {
 		t.Fatalf("expected 0 with maxAttempts=4, got %d", idx)
 	}
@@ -312,7 +319,7 @@ func TestBuildExecutionPromptIncludesGlobalPrompt(t *testing.T) {
 	}
 
 	task := Task{ID: "OB-001", Title: "test task", Spec: "do stuff", Status: statusTodo}
-	prompt, err := buildExecutionPrompt(home, instance, task)
+	prompt, _, err := buildExecutionPrompt(home, instance, task, 0, nil)
 	if err != nil {
 		t.Fatalf("buildExecutionPrompt error: %v", err)
 	}
@@ -338,7 +345,7 @@ func TestBuildExecutionPromptMissingGlobalPrompt(t *testing.T) {
 	}
 
 	task := Task{ID: "OB-001", Title: "test task", Spec: "do stuff", Status: statusTodo}
-	prompt, err := buildExecutionPrompt(home, instance, task)
+	prompt, _, err := buildExecutionPrompt(home, instance, task, 0, nil)
 	if err != nil {
 		t.Fatalf("buildExecutionPrompt error: %v", err)
 	}
@@ -346,3 +353,1813 @@ func TestBuildExecutionPromptMissingGlobalPrompt(t *testing.T) {
 		t.Fatalf("prompt should contain ## Global Prompt section heading even when file is missing")
 	}
 }
+
+func TestNextRunnableTaskIndexDependencies(t *testing.T) {
+	tasks := []Task{
+		{ID: "OB-001", Status: statusTodo, DependsOn: []string{"OB-002"}},
+		{ID: "OB-002", Status: statusTodo},
+	}
+	if idx := nextRunnableTaskIndex(tasks, 2, ""); idx != 1 {
+		t.Fatalf("expected dependency OB-002 (index 1) first, got %d", idx)
+	}
+
+	tasks[1].Status = statusDone
+	if idx := nextRunnableTaskIndex(tasks, 2, ""); idx != 0 {
+		t.Fatalf("expected OB-001 runnable once dependency is done, got %d", idx)
+	}
+
+	tasks = []Task{
+		{ID: "OB-001", Status: statusBlocked, Attempts: 2},
+		{ID: "OB-002", Status: statusTodo, DependsOn: []string{"OB-001"}},
+	}
+	if idx := nextRunnableTaskIndex(tasks, 2, ""); idx != -1 {
+		t.Fatalf("expected no runnable task behind blocked dependency, got %d", idx)
+	}
+}
+
+func TestValidateDependencies(t *testing.T) {
+	ok := []Task{
+		{ID: "OB-001"},
+		{ID: "OB-002", DependsOn: []string{"OB-001"}},
+		{ID: "OB-003", DependsOn: []string{"OB-001", "OB-002"}},
+	}
+	if err := validateDependencies(ok); err != nil {
+		t.Fatalf("validateDependencies(valid DAG) error: %v", err)
+	}
+
+	unknown := []Task{{ID: "OB-001", DependsOn: []string{"OB-404"}}}
+	if err := validateDependencies(unknown); err == nil || !strings.Contains(err.Error(), "OB-404") {
+		t.Fatalf("expected unknown dependency error, got: %v", err)
+	}
+
+	cycle := []Task{
+		{ID: "OB-001", DependsOn: []string{"OB-003"}},
+		{ID: "OB-002", DependsOn: []string{"OB-001"}},
+		{ID: "OB-003", DependsOn: []string{"OB-002"}},
+	}
+	err := validateDependencies(cycle)
+	if err == nil || !strings.Contains(err.Error(), "acyclic") {
+		t.Fatalf("expected cycle error, got: %v", err)
+	}
+	if classifyExitCode(err) != exitValidation {
+		t.Fatalf("expected cycle error to classify as validation, got %d", classifyExitCode(err))
+	}
+}
+
+func TestMarkBlockedDependents(t *testing.T) {
+	tasks := []Task{
+		{ID: "OB-001", Status: statusBlocked},
+		{ID: "OB-002", Status: statusTodo, DependsOn: []string{"OB-001"}},
+		{ID: "OB-003", Status: statusTodo, DependsOn: []string{"OB-002"}},
+		{ID: "OB-004", Status: statusTodo},
+		{ID: "OB-005", Status: statusFailed, DependsOn: []string{"OB-001"}, LastError: "verify failed: go test ./..."},
+	}
+	if !markBlockedDependents(tasks) {
+		t.Fatalf("expected markBlockedDependents to report changes")
+	}
+	for _, i := range []int{1, 2} {
+		if tasks[i].LastError != "waiting on blocked dependency OB-001" {
+			t.Fatalf("%s last_error = %q", tasks[i].ID, tasks[i].LastError)
+		}
+		if tasks[i].Status != statusTodo {
+			t.Fatalf("%s status should stay todo, got %s", tasks[i].ID, tasks[i].Status)
+		}
+	}
+	if tasks[3].LastError != "" {
+		t.Fatalf("independent task should be untouched, got %q", tasks[3].LastError)
+	}
+	if tasks[4].LastError != "verify failed: go test ./..." {
+		t.Fatalf("a task's own error must not be replaced, got %q", tasks[4].LastError)
+	}
+	if markBlockedDependents(tasks) {
+		t.Fatalf("expected second pass to be a no-op")
+	}
+
+	tasks[0].Status = statusTodo
+	if !markBlockedDependents(tasks) {
+		t.Fatalf("expected notes to be cleared once upstream is unblocked")
+	}
+	if tasks[1].LastError != "" || tasks[2].LastError != "" {
+		t.Fatalf("expected dependency notes cleared, got %q / %q", tasks[1].LastError, tasks[2].LastError)
+	}
+}
+
+func TestSummarizeStatusWaiting(t *testing.T) {
+	tasks := []Task{
+		{ID: "OB-001", Status: statusTodo},
+		{ID: "OB-002", Status: statusTodo, DependsOn: []string{"OB-001"}},
+		{ID: "OB-003", Status: statusDone},
+		{ID: "OB-004", Status: statusTodo, DependsOn: []string{"OB-003"}},
+	}
+	s := summarizeStatus("alpha", tasks)
+	if s.Waiting != 1 {
+		t.Fatalf("expected 1 waiting task, got %d", s.Waiting)
+	}
+}
+
+func TestNextRunnableTaskIndexPriority(t *testing.T) {
+	tasks := []Task{
+		{ID: "OB-001", Status: statusTodo, Priority: priorityLow},
+		{ID: "OB-002", Status: statusTodo, Priority: priorityMed},
+		{ID: "OB-003", Status: statusFailed, Priority: priorityHigh, Attempts: 1},
+		{ID: "OB-004", Status: statusTodo, Priority: priorityHigh},
+	}
+	if idx := nextRunnableTaskIndex(tasks, 2, ""); idx != 3 {
+		t.Fatalf("expected high todo OB-004 first, got %d", idx)
+	}
+	tasks[3].Status = statusDone
+	if idx := nextRunnableTaskIndex(tasks, 2, ""); idx != 2 {
+		t.Fatalf("expected high retry OB-003 before lower priorities, got %d", idx)
+	}
+	tasks[2].Status = statusDone
+	if idx := nextRunnableTaskIndex(tasks, 2, ""); idx != 1 {
+		t.Fatalf("expected med OB-002 before low, got %d", idx)
+	}
+	if idx := nextRunnableTaskIndex(tasks, 2, priorityHigh); idx != -1 {
+		t.Fatalf("expected no task at or above high floor, got %d", idx)
+	}
+	if idx := nextRunnableTaskIndex(tasks, 2, priorityMed); idx != 1 {
+		t.Fatalf("expected med floor to admit OB-002, got %d", idx)
+	}
+}
+
+func TestNormalizePriority(t *testing.T) {
+	cases := []struct {
+		in      string
+		want    string
+		wantErr bool
+	}{
+		{in: "", want: priorityMed},
+		{in: " HIGH ", want: priorityHigh},
+		{in: "low", want: priorityLow},
+		{in: "urgent", wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := normalizePriority(tc.in)
+		if tc.wantErr {
+			if err == nil {
+				t.Fatalf("normalizePriority(%q) expected error", tc.in)
+			}
+			continue
+		}
+		if err != nil || got != tc.want {
+			t.Fatalf("normalizePriority(%q) = %q, %v; want %q", tc.in, got, err, tc.want)
+		}
+	}
+}
+
+// initTestRepo creates a git repo with one commit and a fixed identity.
+func initTestRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	t.Setenv("GIT_AUTHOR_NAME", "obliviate-test")
+	t.Setenv("GIT_AUTHOR_EMAIL", "test@example.com")
+	t.Setenv("GIT_COMMITTER_NAME", "obliviate-test")
+	t.Setenv("GIT_COMMITTER_EMAIL", "test@example.com")
+	dir := t.TempDir()
+	gitT(t, dir, "init", "-q")
+	writeFileT(t, filepath.Join(dir, "base.txt"), "base\n")
+	gitT(t, dir, "add", "-A")
+	gitT(t, dir, "commit", "-q", "-m", "base")
+	return dir
+}
+
+func gitT(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	out, err := runGit(dir, args...)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	return out
+}
+
+func writeFileT(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestIntegrateWorktreeRebasesOntoMovedHead(t *testing.T) {
+	repo := initTestRepo(t)
+	wt, base, err := createTaskWorktree(repo, "alpha", "OB-001", "")
+	if err != nil {
+		t.Fatalf("createTaskWorktree: %v", err)
+	}
+	defer removeTaskWorktree(repo, wt)
+
+	writeFileT(t, filepath.Join(wt, "task.txt"), "task\n")
+	gitT(t, wt, "add", "-A")
+	gitT(t, wt, "commit", "-q", "-m", "task work")
+
+	// The main workdir moves on while the task runs.
+	writeFileT(t, filepath.Join(repo, "other.txt"), "other\n")
+	gitT(t, repo, "add", "-A")
+	gitT(t, repo, "commit", "-q", "-m", "other work")
+
+	head, err := integrateWorktree(repo, wt, base)
+	if err != nil {
+		t.Fatalf("integrateWorktree: %v", err)
+	}
+	if got := gitT(t, repo, "rev-parse", "HEAD"); got != head {
+		t.Fatalf("integrateWorktree returned %s, workdir HEAD is %s", head, got)
+	}
+	if got := gitT(t, repo, "log", "-1", "--format=%s"); got != "task work" {
+		t.Fatalf("expected workdir HEAD to be the task commit, got %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(repo, "task.txt")); err != nil {
+		t.Fatalf("expected task.txt in workdir after integration: %v", err)
+	}
+}
+
+func TestIntegrateWorktreeConflict(t *testing.T) {
+	repo := initTestRepo(t)
+	wt, base, err := createTaskWorktree(repo, "alpha", "OB-002", "")
+	if err != nil {
+		t.Fatalf("createTaskWorktree: %v", err)
+	}
+	defer removeTaskWorktree(repo, wt)
+
+	writeFileT(t, filepath.Join(wt, "base.txt"), "from task\n")
+	gitT(t, wt, "commit", "-q", "-am", "task edit")
+	writeFileT(t, filepath.Join(repo, "base.txt"), "from main\n")
+	gitT(t, repo, "commit", "-q", "-am", "main edit")
+	mainHead := gitT(t, repo, "rev-parse", "HEAD")
+
+	_, err = integrateWorktree(repo, wt, base)
+	if err == nil || !strings.Contains(err.Error(), "merge conflict") || !strings.Contains(err.Error(), "base.txt") {
+		t.Fatalf("expected merge conflict naming base.txt, got: %v", err)
+	}
+	if got := gitT(t, repo, "rev-parse", "HEAD"); got != mainHead {
+		t.Fatalf("workdir HEAD moved after conflict: %s != %s", got, mainHead)
+	}
+
+	removeTaskWorktree(repo, wt)
+	if _, err := os.Stat(wt); !os.IsNotExist(err) {
+		t.Fatalf("expected worktree to be removed, stat err: %v", err)
+	}
+}
+
+func TestRouteModelRegistry(t *testing.T) {
+	reg := defaultProviderRegistry()
+	reg.Providers["aider"] = ProviderDef{Name: "aider", Command: "aider"}
+	reg.Providers["stub"] = ProviderDef{Name: "stub", Command: "true"}
+
+	cases := []struct {
+		hint, provider, model string
+	}{
+		{"", "codex", ""},
+		{"codex", "codex", ""},
+		{"claude-opus", "claude", "opus"},
+		{"claude:sonnet", "claude", "sonnet"},
+		{"gpt-5", "codex", "gpt-5"},
+		{"aider", "aider", ""},
+		{"aider-gpt-4o", "aider", "gpt-4o"},
+		{"aider:deepseek", "aider", "deepseek"},
+		{"stub", "stub", ""},
+	}
+	for _, tc := range cases {
+		p, m := routeModel(reg, tc.hint)
+		if p != tc.provider || m != tc.model {
+			t.Fatalf("routeModel(%q) = %s/%s, want %s/%s", tc.hint, p, m, tc.provider, tc.model)
+		}
+	}
+}
+
+func TestExpandProviderArgs(t *testing.T) {
+	reg := defaultProviderRegistry()
+	got := expandProviderArgs(reg.Providers["codex"], "gpt-5", "/work", "prompt", "")
+	want := []string{"exec", "--cd", "/work", "--skip-git-repo-check", "--dangerously-bypass-approvals-and-sandbox", "--model", "gpt-5", "-"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("codex args = %q, want %q", got, want)
+	}
+	got = expandProviderArgs(reg.Providers["codex"], "", "/work", "prompt", "")
+	if strings.Contains(strings.Join(got, " "), "--model") {
+		t.Fatalf("codex args without model should omit --model, got %q", got)
+	}
+
+	file := ProviderDef{Command: "aider", Args: []string{"--yes"}, Prompt: promptViaFile, ModelFlag: "--model"}
+	got = expandProviderArgs(file, "gpt-4o", "/work", "prompt", "/tmp/p.md")
+	want = []string{"--yes", "--model", "gpt-4o", "/tmp/p.md"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Fatalf("file-prompt args = %q, want %q", got, want)
+	}
+
+	arg := ProviderDef{Command: "x", Args: []string{"--message", "{{prompt}}"}, Prompt: promptViaArg}
+	got = expandProviderArgs(arg, "", "/work", "do it", "")
+	if len(got) != 2 || got[1] != "do it" {
+		t.Fatalf("arg-prompt args = %q", got)
+	}
+}
+
+func TestLoadProviderRegistry(t *testing.T) {
+	home := t.TempDir()
+	reg, err := loadProviderRegistry(home)
+	if err != nil {
+		t.Fatalf("loadProviderRegistry(no file) error: %v", err)
+	}
+	if _, ok := reg.Providers["claude"]; !ok || reg.Default != "codex" {
+		t.Fatalf("expected built-in providers without providers.json")
+	}
+
+	writeFileT(t, filepath.Join(home, "providers.json"), `{
+		"default": "stub",
+		"providers": [
+			{"name": "stub", "command": "sh", "prompt": "file", "fallback": {"provider": "claude", "model": "haiku"}}
+		]
+	}`)
+	reg, err = loadProviderRegistry(home)
+	if err != nil {
+		t.Fatalf("loadProviderRegistry error: %v", err)
+	}
+	if reg.Default != "stub" {
+		t.Fatalf("default = %q, want stub", reg.Default)
+	}
+	if hops := resolveFallbackChain(reg, fallbackConfig{}, "stub", "", "quota"); len(hops) != 1 || hops[0].Provider != "claude" || hops[0].Model != "haiku" {
+		t.Fatalf("stub fallback = %+v", hops)
+	}
+	if hops := resolveFallbackChain(reg, fallbackConfig{}, "codex", "", "quota"); len(hops) != 1 || hops[0].Provider != "claude" || hops[0].Model != "sonnet" {
+		t.Fatalf("built-in codex fallback changed: %+v", hops)
+	}
+
+	writeFileT(t, filepath.Join(home, "providers.json"), `{"providers": [{"name": "bad", "command": "x", "prompt": "pipe"}]}`)
+	if _, err := loadProviderRegistry(home); err == nil || !strings.Contains(err.Error(), "prompt must be") {
+		t.Fatalf("expected invalid prompt mode error, got: %v", err)
+	}
+}
+
+func TestRunAgentStubProvider(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	reg := defaultProviderRegistry()
+	reg.Providers["stub"] = ProviderDef{
+		Name:    "stub",
+		Command: "sh",
+		Args:    []string{"-c", `printf '%s|' "$STUB_TAG"; cat "$1"`, "sh", "{{prompt_file}}"},
+		Prompt:  promptViaFile,
+		Env:     map[string]string{"STUB_TAG": "stubbed"},
+	}
+	out, err := runAgent(context.Background(), reg, "stub", "", t.TempDir(), "hello agent", time.Minute, nil)
+	if err != nil {
+		t.Fatalf("runAgent(stub) error: %v\n%s", err, out)
+	}
+	if out != "stubbed|hello agent" {
+		t.Fatalf("runAgent(stub) output = %q", out)
+	}
+}
+
+func TestResolveFallbackChain(t *testing.T) {
+	reg := defaultProviderRegistry()
+	home := t.TempDir()
+	instDir := filepath.Join(home, "state", "alpha")
+	if err := os.MkdirAll(instDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	writeFileT(t, filepath.Join(home, "fallback.json"), `{
+		"reasons": ["quota", "rate_limit", "provider_unavailable"],
+		"chains": {
+			"claude-opus": {"steps": ["claude-sonnet", "codex"]},
+			"claude": {"steps": ["codex"], "reasons": ["quota"]}
+		}
+	}`)
+	cfg, err := loadFallbackConfig(home, instDir)
+	if err != nil {
+		t.Fatalf("loadFallbackConfig: %v", err)
+	}
+
+	hops := resolveFallbackChain(reg, cfg, "claude", "opus", "quota")
+	if len(hops) != 2 || hops[0].Model != "sonnet" || hops[1].Provider != "codex" {
+		t.Fatalf("opus chain = %+v", hops)
+	}
+	if hops := resolveFallbackChain(reg, cfg, "claude", "opus", "auth"); hops != nil {
+		t.Fatalf("auth must not fall back, got %+v", hops)
+	}
+	if hops := resolveFallbackChain(reg, cfg, "claude", "haiku", "rate_limit"); hops != nil {
+		t.Fatalf("provider chain limited to quota should not apply to rate_limit, got %+v", hops)
+	}
+	if hops := resolveFallbackChain(reg, cfg, "claude", "haiku", "quota"); len(hops) != 1 || hops[0].Provider != "codex" {
+		t.Fatalf("provider-level chain = %+v", hops)
+	}
+
+	writeFileT(t, filepath.Join(instDir, "fallback.json"), `{"enabled": false}`)
+	cfg, err = loadFallbackConfig(home, instDir)
+	if err != nil {
+		t.Fatalf("loadFallbackConfig(instance): %v", err)
+	}
+	if hops := resolveFallbackChain(reg, cfg, "claude", "opus", "quota"); hops != nil {
+		t.Fatalf("instance-disabled fallback returned %+v", hops)
+	}
+
+	writeFileT(t, filepath.Join(instDir, "fallback.json"), `{"reasons": ["bogus"]}`)
+	if _, err := loadFallbackConfig(home, instDir); err == nil {
+		t.Fatalf("expected unknown reason to be rejected")
+	}
+}
+
+func TestRunAgentWithFallbackWalksChain(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	reg := defaultProviderRegistry()
+	stub := func(name, script string) ProviderDef {
+		return ProviderDef{Name: name, Command: "sh", Args: []string{"-c", script}, Prompt: promptViaStdin}
+	}
+	reg.Providers["first"] = stub("first", "echo 'usage limit reached'; exit 1")
+	reg.Providers["second"] = stub("second", "echo '429 too many requests'; exit 1")
+	reg.Providers["third"] = stub("third", "cat >/dev/null; echo ok")
+	cfg := fallbackConfig{Chains: map[string]fallbackChain{
+		"first": {Steps: []string{"second", "third"}},
+	}}
+
+	provider, _, out, err, hops := runAgentWithFallback(context.Background(), reg, cfg, "first", "", t.TempDir(), "p", time.Minute, nil)
+	if err != nil {
+		t.Fatalf("expected chain to succeed, got %v", err)
+	}
+	if provider != "third" || len(hops) != 2 {
+		t.Fatalf("provider=%s hops=%+v", provider, hops)
+	}
+	if hops[0].Reason != "quota" || hops[0].Error == "" || hops[1].Reason != "rate_limit" || hops[1].Error != "" {
+		t.Fatalf("unexpected hop details: %+v", hops)
+	}
+	if !strings.Contains(out, "[obliviate fallback -> third]") {
+		t.Fatalf("combined output missing hop marker: %q", out)
+	}
+
+	// The chain's own reasons also gate later hops: second fails with
+	// rate_limit, which this chain does not allow.
+	cfg.Chains["first"] = fallbackChain{Steps: []string{"second", "third"}, Reasons: []string{"quota"}}
+	provider, _, _, err, hops = runAgentWithFallback(context.Background(), reg, cfg, "first", "", t.TempDir(), "p", time.Minute, nil)
+	if err == nil || provider != "second" || len(hops) != 1 {
+		t.Fatalf("chain reasons should stop after second: provider=%s hops=%+v err=%v", provider, hops, err)
+	}
+}
+
+func TestLookupFallbackChainDeterministic(t *testing.T) {
+	reg := defaultProviderRegistry()
+	cfg := fallbackConfig{Chains: map[string]fallbackChain{
+		"claude":       {Steps: []string{"codex"}},
+		"opus":         {Steps: []string{"b"}},
+		"claude-opus":  {Steps: []string{"exact"}},
+		"claude-opus4": {Steps: []string{"c"}},
+	}}
+	for i := 0; i < 20; i++ {
+		if c, ok := lookupFallbackChain(reg, cfg, "claude", "opus"); !ok || c.Steps[0] != "exact" {
+			t.Fatalf("exact key should win, got %+v", c)
+		}
+	}
+	delete(cfg.Chains, "claude-opus")
+	for i := 0; i < 20; i++ {
+		if c, ok := lookupFallbackChain(reg, cfg, "claude", "opus"); !ok || c.Steps[0] != "c" {
+			t.Fatalf("first sorted matching key should win, got %+v", c)
+		}
+	}
+	if c, ok := lookupFallbackChain(reg, cfg, "claude", "haiku"); !ok || c.Steps[0] != "codex" {
+		t.Fatalf("bare provider key = %+v, %v", c, ok)
+	}
+}
+
+func TestRunArtifactsResolveAndPrune(t *testing.T) {
+	instDir := t.TempDir()
+	ids := []string{
+		"20260101T000000Z-OB-001-0001",
+		"20260101T000100Z-OB-002-0002",
+		"20260101T000200Z-OB-001-0003",
+	}
+	for _, id := range ids {
+		art, err := openRunArtifacts(instDir, id, "prompt for "+id)
+		if err != nil {
+			t.Fatalf("openRunArtifacts: %v", err)
+		}
+		_, _ = art.Output.WriteString("output " + id)
+		art.Close()
+		if err := writeRunRecord(instDir, RunLog{RunID: id, TaskID: "x", PromptPath: art.PromptPath}); err != nil {
+			t.Fatalf("writeRunRecord: %v", err)
+		}
+	}
+
+	got, err := resolveRunRef(instDir, "OB-001")
+	if err != nil || got != ids[2] {
+		t.Fatalf("resolveRunRef(task) = %q, %v; want latest %q", got, err, ids[2])
+	}
+	got, err = resolveRunRef(instDir, ids[0])
+	if err != nil || got != ids[0] {
+		t.Fatalf("resolveRunRef(run id) = %q, %v", got, err)
+	}
+	if _, err := resolveRunRef(instDir, "OB-404"); err == nil {
+		t.Fatalf("expected error for unknown ref")
+	}
+
+	// An in-progress run (no run.json) must survive pruning.
+	if _, err := openRunArtifacts(instDir, "20260101T000300Z-OB-003-0004", "p"); err != nil {
+		t.Fatalf("openRunArtifacts: %v", err)
+	}
+	if err := pruneRunArtifacts(instDir, 2); err != nil {
+		t.Fatalf("pruneRunArtifacts: %v", err)
+	}
+	left, err := listRunIDs(instDir)
+	if err != nil {
+		t.Fatalf("listRunIDs: %v", err)
+	}
+	want := []string{ids[2], "20260101T000300Z-OB-003-0004"}
+	if strings.Join(left, ",") != strings.Join(want, ",") {
+		t.Fatalf("after prune = %v, want %v", left, want)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	var lines []string
+	w := newLineWriter(func(line string) { lines = append(lines, line) })
+	_, _ = w.Write([]byte("first\r\nsec"))
+	_, _ = w.Write([]byte("ond\nthi"))
+	if strings.Join(lines, "|") != "first|second" {
+		t.Fatalf("lines before flush = %q", lines)
+	}
+	w.Flush()
+	if strings.Join(lines, "|") != "first|second|thi" {
+		t.Fatalf("lines after flush = %q", lines)
+	}
+}
+
+func TestEventsJSONSchema(t *testing.T) {
+	schema := eventsJSONSchema()
+	defs, ok := schema["$defs"].(map[string]any)
+	if !ok || len(defs) != len(goEventTypes) {
+		t.Fatalf("expected one definition per event type, got %d", len(defs))
+	}
+	for _, et := range goEventTypes {
+		def := defs[et.Name].(map[string]any)
+		required := def["required"].([]string)
+		for _, field := range []string{"event", "ts", "instance", "schema_version"} {
+			if !containsString(required, field) {
+				t.Fatalf("event %s schema missing required envelope field %q", et.Name, field)
+			}
+		}
+	}
+
+	// Every key a real event serializes must be declared in its schema.
+	ev := taskFinishedEvent{
+		eventEnvelope: newEnvelope("alpha", "task_finished"),
+		TaskID:        "OB-001",
+		Status:        statusFailed,
+		Model:         "sonnet",
+		Error:         "verify failed",
+	}
+	b, err := json.Marshal(ev)
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if bytes.Contains(b, []byte("\n")) {
+		t.Fatalf("event must serialize to a single line: %s", b)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+	props := defs["task_finished"].(map[string]any)["properties"].(map[string]any)
+	for k := range got {
+		if _, ok := props[k]; !ok {
+			t.Fatalf("task_finished field %q missing from schema", k)
+		}
+	}
+	if got["schema_version"] != float64(eventSchemaVersion) || got["instance"] != "alpha" {
+		t.Fatalf("unexpected envelope: %v", got)
+	}
+}
+
+func TestParseVerifyObjects(t *testing.T) {
+	got, err := parseVerify([]byte(`["go build ./...", {"cmd": "go test ./integration/...", "timeout": "8m", "cwd": "svc", "env": {"CI": "1"}}]`))
+	if err != nil {
+		t.Fatalf("parseVerify error: %v", err)
+	}
+	if len(got) != 2 || got[0].Cmd != "go build ./..." || got[1].Timeout != "8m" || got[1].Cwd != "svc" || got[1].Env["CI"] != "1" {
+		t.Fatalf("unexpected verify parsing: %#v", got)
+	}
+
+	if _, err := parseVerify([]byte(`{"cmd": "go test", "timeout": "soon"}`)); err == nil || !strings.Contains(err.Error(), "timeout must be") {
+		t.Fatalf("expected invalid timeout error, got %v", err)
+	}
+
+	// Plain commands keep serializing as strings so old tasks.jsonl files round-trip.
+	b, err := json.Marshal(Task{ID: "OB-001", Verify: got})
+	if err != nil {
+		t.Fatalf("marshal: %v", err)
+	}
+	if !strings.Contains(string(b), `"verify":["go build ./...",{"cmd":"go test ./integration/..."`) {
+		t.Fatalf("unexpected verify encoding: %s", b)
+	}
+	var back Task
+	if err := json.Unmarshal([]byte(`{"id":"OB-001","verify":["echo ok"]}`), &back); err != nil {
+		t.Fatalf("unmarshal legacy task: %v", err)
+	}
+	if len(back.Verify) != 1 || back.Verify[0].Cmd != "echo ok" {
+		t.Fatalf("legacy verify = %#v", back.Verify)
+	}
+}
+
+func TestRunVerifyOverrides(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	workdir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(workdir, "sub"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	out, err := runVerify(workdir, VerifyCommand{Cmd: `basename "$PWD"; echo "$GATE"`, Cwd: "sub", Env: map[string]string{"GATE": "on"}}, time.Minute, nil)
+	if err != nil {
+		t.Fatalf("runVerify error: %v", err)
+	}
+	if out != "sub\non\n" {
+		t.Fatalf("runVerify output = %q", out)
+	}
+
+	_, err = runVerify(workdir, VerifyCommand{Cmd: "sleep 5", Timeout: "100ms"}, time.Minute, nil)
+	if err == nil || !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Fatalf("expected per-command timeout, got %v", err)
+	}
+}
+
+func TestVerifyExitCode(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	workdir := t.TempDir()
+	_, err := runVerify(workdir, VerifyCommand{Cmd: "exit 3"}, time.Minute, nil)
+	if got := verifyExitCode(err); got != 3 {
+		t.Fatalf("verifyExitCode(exit 3) = %d", got)
+	}
+	_, err = runVerify(workdir, VerifyCommand{Cmd: "sleep 5", Timeout: "100ms"}, time.Minute, nil)
+	if got := verifyExitCode(err); got != -1 {
+		t.Fatalf("verifyExitCode(timeout) = %d", got)
+	}
+	if got := verifyExitCode(nil); got != 0 {
+		t.Fatalf("verifyExitCode(nil) = %d", got)
+	}
+}
+
+func TestPreviousAttemptsSection(t *testing.T) {
+	runs := []RunLog{
+		{RunID: "r1", TaskID: "OB-001", Status: statusFailed, Error: "stale attempt"},
+		{RunID: "r2", TaskID: "OB-001", Status: statusDone},
+		{RunID: "r3", TaskID: "OB-002", Status: statusFailed, Error: "other task"},
+		{RunID: "r4", TaskID: "OB-001", Status: statusFailed, Provider: "codex", Error: "agent exited 1", OutputTail: "panic: boom"},
+		{RunID: "r5", TaskID: "OB-001", Status: statusFailed, Provider: "codex", Error: "verify failed: go test ./...",
+			VerifyResults: []VerifyResult{
+				{Cmd: "go build ./...", ExitCode: 0, Duration: "1s"},
+				{Cmd: "go test ./...", ExitCode: 1, Duration: "3s", OutputTail: "--- FAIL: TestX"},
+			},
+			DiffStat: " a.go | 2 +-\n 1 file changed"},
+		{RunID: "r6", TaskID: "OB-001", Status: "interrupted"},
+	}
+	got := previousAttemptsSection(runs, "OB-001", 6000)
+	for _, want := range []string{"### Attempt 2 (r5, failed via codex)", "Verify failed: `go test ./...` (exit 1, 3s)", "--- FAIL: TestX", "a.go | 2 +-", "### Attempt 1 (r4", "panic: boom"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("section missing %q:\n%s", want, got)
+		}
+	}
+	if strings.Index(got, "r5") > strings.Index(got, "r4") {
+		t.Fatalf("attempts should be newest first:\n%s", got)
+	}
+	for _, unwanted := range []string{"stale attempt", "other task", "go build", "r6"} {
+		if strings.Contains(got, unwanted) {
+			t.Fatalf("section should not contain %q:\n%s", unwanted, got)
+		}
+	}
+
+	small := previousAttemptsSection(runs, "OB-001", 200)
+	if len(small) > 240 || !strings.Contains(small, "r5") || !strings.Contains(small, "(1 older attempt(s) omitted)") {
+		t.Fatalf("budgeted section = %q", small)
+	}
+	if got := previousAttemptsSection(runs, "OB-003", 6000); got != "" {
+		t.Fatalf("section for task without attempts = %q", got)
+	}
+}
+
+func TestDiffSummary(t *testing.T) {
+	repo := initTestRepo(t)
+	base := gitT(t, repo, "rev-parse", "HEAD")
+	writeFileT(t, filepath.Join(repo, "committed.txt"), "one\n")
+	gitT(t, repo, "add", "committed.txt")
+	gitT(t, repo, "commit", "-m", "add committed")
+	writeFileT(t, filepath.Join(repo, "new file.txt"), "two\n")
+	if err := os.MkdirAll(filepath.Join(repo, ".obliviate", "state"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	writeFileT(t, filepath.Join(repo, ".obliviate", "state", "x.json"), "{}\n")
+
+	got := diffSummary(repo, base)
+	if !strings.Contains(got, "committed.txt") || !strings.Contains(got, "new file (untracked): new file.txt") {
+		t.Fatalf("diffSummary = %q", got)
+	}
+	if strings.Contains(got, ".obliviate") {
+		t.Fatalf("diffSummary should skip .obliviate: %q", got)
+	}
+}
+
+func TestNormalizeVerifyMode(t *testing.T) {
+	for in, want := range map[string]string{"": "", "ALL": verifyModeAll, " first ": verifyModeFirst} {
+		got, err := normalizeVerifyMode(in)
+		if err != nil || got != want {
+			t.Fatalf("normalizeVerifyMode(%q) = %q, %v", in, got, err)
+		}
+	}
+	if _, err := normalizeVerifyMode("some"); err == nil {
+		t.Fatal("expected error for invalid verify mode")
+	}
+}
+
+func TestAssemblePromptBudget(t *testing.T) {
+	learnings := ""
+	for i := 1; i <= 50; i++ {
+		learnings += fmt.Sprintf("- learning %02d\n", i)
+	}
+	sections := []promptSection{
+		{Name: "intro", Body: "intro", Keep: keepAll},
+		{Name: "skill", Heading: "SKILL.md", Body: strings.Repeat("s", 500), Priority: 6, Keep: keepHead},
+		{Name: "spec", Heading: "Feature Spec", Body: strings.Repeat("x", 300), Keep: keepAll},
+		{Name: "instance_learnings", Heading: "Instance Learnings", Body: learnings, Priority: 4, Keep: keepTail},
+	}
+
+	full, _, report := assemblePrompt(sections, 0)
+	if report.TotalBytes != len(full) || report.Budget != 0 || report.OverBudget {
+		t.Fatalf("unbudgeted report = %+v (len %d)", report, len(full))
+	}
+
+	budget := 700
+	got, _, report := assemblePrompt(sections, budget)
+	if len(got) != report.TotalBytes || len(got) > budget || report.OverBudget {
+		t.Fatalf("budgeted prompt is %d bytes, report %+v", len(got), report)
+	}
+	if !strings.Contains(got, strings.Repeat("x", 300)) {
+		t.Fatal("spec must never be truncated")
+	}
+	if !report.Sections[1].Truncated || report.Sections[1].Bytes >= report.Sections[1].OriginalBytes {
+		t.Fatalf("skill (lowest priority) should be truncated first: %+v", report.Sections[1])
+	}
+	if !strings.Contains(got, "- learning 50") {
+		t.Fatalf("newest learnings should be kept:\n%s", got)
+	}
+
+	tight, _, report := assemblePrompt(sections, 300)
+	if !report.OverBudget || !strings.Contains(tight, strings.Repeat("x", 300)) {
+		t.Fatalf("tight budget should keep spec and report over budget: %+v", report)
+	}
+	if strings.Contains(tight, "- learning 01") {
+		t.Fatalf("oldest learnings should be dropped first:\n%s", tight)
+	}
+}
+
+func TestTruncateLinesKeepTail(t *testing.T) {
+	got := truncateLinesKeepTail("one\ntwo\nthree\nfour\n", 50)
+	if got != "one\ntwo\nthree\nfour\n" {
+		t.Fatalf("input under budget changed: %q", got)
+	}
+	long := ""
+	for i := 1; i <= 10; i++ {
+		long += fmt.Sprintf("line %02d\n", i)
+	}
+	got = truncateLinesKeepTail(long, 60)
+	if got != "[... 7 older line(s) truncated ...]\nline 08\nline 09\nline 10\n" {
+		t.Fatalf("truncateLinesKeepTail = %q", got)
+	}
+	if got := truncateLinesKeepTail("short", 50); got != "short" {
+		t.Fatalf("short input changed: %q", got)
+	}
+}
+
+func TestParsePromptBudget(t *testing.T) {
+	for in, want := range map[string]int{"0": 0, "200000": 200000, "50000t": 200000, " 10T ": 40} {
+		got, err := parsePromptBudget(in)
+		if err != nil || got != want {
+			t.Fatalf("parsePromptBudget(%q) = %d, %v", in, got, err)
+		}
+	}
+	for _, in := range []string{"", "-1", "abc", "12k"} {
+		if _, err := parsePromptBudget(in); err == nil {
+			t.Fatalf("parsePromptBudget(%q) should fail", in)
+		}
+	}
+}
+
+func TestPromptTemplate(t *testing.T) {
+	home := t.TempDir()
+	instDir := filepath.Join(home, "state", "alpha")
+	if err := os.MkdirAll(instDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	writeFileT(t, filepath.Join(instDir, "spec.md"), "the spec")
+	writeFileT(t, filepath.Join(instDir, "instance.json"), `{"name":"alpha","workdir":"."}`)
+
+	tmpl, err := loadPromptTemplate(home, instDir)
+	if err != nil || tmpl != nil {
+		t.Fatalf("no template should load as nil, got %v, %v", tmpl, err)
+	}
+
+	writeFileT(t, filepath.Join(home, "prompt.tmpl"), "global {{.Task.ID}}")
+	writeFileT(t, filepath.Join(instDir, "prompt.tmpl"), "{{.Meta.Name}}/{{.Task.ID}}: {{.Task.Title}}\n{{.Files.Spec}}\n{{len .Runs}} runs\n{{lastLines 1 .OutputRequirements}}")
+	tmpl, err = loadPromptTemplate(home, instDir)
+	if err != nil {
+		t.Fatalf("loadPromptTemplate: %v", err)
+	}
+	if tmpl.Path != filepath.Join(instDir, "prompt.tmpl") {
+		t.Fatalf("instance template should win, got %s", tmpl.Path)
+	}
+	prompt, report, err := buildExecutionPrompt(home, "alpha", Task{ID: "OB-001", Title: "do it"}, 0, tmpl)
+	if err != nil {
+		t.Fatalf("buildExecutionPrompt: %v", err)
+	}
+	want := "alpha/OB-001: do it\nthe spec\n0 runs\n- If blocked, explain exact blocker and failing command"
+	if prompt != want {
+		t.Fatalf("prompt = %q, want %q", prompt, want)
+	}
+	if report.Template != tmpl.Path || report.TotalBytes != len(prompt) {
+		t.Fatalf("report = %+v", report)
+	}
+
+	writeFileT(t, filepath.Join(instDir, "prompt.tmpl"), "{{.Task.Nope}}")
+	if _, err := loadPromptTemplate(home, instDir); err == nil || !strings.Contains(err.Error(), "prompt template") {
+		t.Fatalf("unknown field should fail at load, got %v", err)
+	}
+	writeFileT(t, filepath.Join(instDir, "prompt.tmpl"), "{{.Task.ID")
+	if _, err := loadPromptTemplate(home, instDir); err == nil {
+		t.Fatal("parse error should fail at load")
+	}
+}
+
+func TestParseLearnings(t *testing.T) {
+	out := "working...\n<learnings>\n- go vet needs -tags integration here\n\n* [promote] Use slog for all logging\n</learnings>\ndone\n<learnings>fixtures live in testdata/</learnings>"
+	got := parseLearnings(out)
+	want := []learningEntry{
+		{Text: "go vet needs -tags integration here"},
+		{Text: "Use slog for all logging", Promote: true},
+		{Text: "fixtures live in testdata/"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("parseLearnings = %+v", got)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("entry %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if got := parseLearnings("no block, or an unclosed <learnings> tag"); len(got) != 0 {
+		t.Fatalf("expected no entries, got %+v", got)
+	}
+}
+
+func TestRecordLearnings(t *testing.T) {
+	home := t.TempDir()
+	instDir := filepath.Join(home, "state", "web")
+	if err := os.MkdirAll(instDir, 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	err := recordLearnings(home, "web", "OB-004", []learningEntry{{Text: "local one"}, {Text: "shared one", Promote: true}})
+	if err != nil {
+		t.Fatalf("recordLearnings: %v", err)
+	}
+	local, _ := readText(filepath.Join(instDir, "learnings.md"))
+	global, _ := readText(filepath.Join(home, "global-learnings.md"))
+	if !strings.HasSuffix(local, "] OB-004: local one") || strings.Contains(local, "shared") {
+		t.Fatalf("instance learnings = %q", local)
+	}
+	if !strings.HasSuffix(global, "] web/OB-004: shared one") || strings.Contains(global, "local") {
+		t.Fatalf("global learnings = %q", global)
+	}
+}
+
+func TestCompactLearnings(t *testing.T) {
+	content := "# Learnings\n" +
+		"- [2026-01-01T00:00:00Z] OB-001 completed (Add parser)\n" +
+		"- [2026-01-01T00:00:00Z] OB-001: Run  go generate first\n" +
+		"- [2026-01-02T00:00:00Z] OB-002: run go generate first\n" +
+		"- manual note\n"
+
+	got, stats := compactLearnings(content, true, true)
+	want := "# Learnings\n- [2026-01-01T00:00:00Z] OB-001: Run  go generate first\n- manual note\n"
+	if got != want {
+		t.Fatalf("compactLearnings = %q, want %q", got, want)
+	}
+	if stats != (learningsStats{Entries: 2, Duplicates: 1, Pruned: 1}) {
+		t.Fatalf("stats = %+v", stats)
+	}
+	if got, stats := compactLearnings(content, false, false); got != content || stats.Entries != 4 {
+		t.Fatalf("no-op compaction changed content or miscounted: %q %+v", got, stats)
+	}
+}
+
+func TestFileLockHolderAndTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".tasks.lock")
+	f, err := acquireFileLock(path, time.Second)
+	if err != nil {
+		t.Fatalf("acquireFileLock: %v", err)
+	}
+	holder, err := lockStatus(path)
+	if err != nil || holder == nil || holder.PID != os.Getpid() {
+		t.Fatalf("lockStatus while held = %+v, %v", holder, err)
+	}
+	if _, err := acquireFileLock(path, 200*time.Millisecond); err == nil || !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) {
+		t.Fatalf("second acquire should time out naming the holder, got %v", err)
+	}
+	releaseFileLock(f)
+	if holder, err := lockStatus(path); err != nil || holder != nil {
+		t.Fatalf("lockStatus after release = %+v, %v", holder, err)
+	}
+	f, err = acquireFileLock(path, time.Second)
+	if err != nil {
+		t.Fatalf("reacquire after release: %v", err)
+	}
+	releaseFileLock(f)
+}
+
+func TestFileLockIgnoresStalePayload(t *testing.T) {
+	dead := exec.Command("true")
+	if err := dead.Run(); err != nil {
+		t.Skip("true not available")
+	}
+	path := filepath.Join(t.TempDir(), ".tasks.lock")
+	// A holder that was killed leaves its payload behind, but the OS has
+	// already dropped its lock.
+	host, _ := os.Hostname()
+	payload, _ := json.Marshal(lockHolder{PID: dead.Process.Pid, Host: host})
+	writeFileT(t, path, string(payload))
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+
+	f, err := acquireFileLock(path, time.Second)
+	if err != nil {
+		t.Fatalf("stale payload should not block acquisition: %v", err)
+	}
+	after, err := os.Stat(path)
+	if err != nil || !os.SameFile(before, after) {
+		t.Fatalf("lock file was replaced instead of reused: %v", err)
+	}
+	if holder, _ := readLockHolder(path); holder.PID != os.Getpid() {
+		t.Fatalf("payload after acquire = %+v, want our pid", holder)
+	}
+
+	// While the lock is held, a dead PID in the payload must not let a
+	// waiter take over the file.
+	writeLockPayload(f, lockHolder{PID: dead.Process.Pid, Host: host})
+	if _, err := acquireFileLock(path, 200*time.Millisecond); err == nil {
+		t.Fatal("held lock with a dead payload should still block")
+	}
+	if cur, err := os.Stat(path); err != nil || !os.SameFile(before, cur) {
+		t.Fatalf("waiter removed a held lock file: %v", err)
+	}
+	releaseFileLock(f)
+}
+
+func TestRunnerLeaseExclusive(t *testing.T) {
+	instDir := t.TempDir()
+	lease, err := acquireRunnerLease(instDir, false, nil)
+	if err != nil {
+		t.Fatalf("acquireRunnerLease: %v", err)
+	}
+	if lease.holder.ID == "" || lease.holder.HeartbeatAt == "" {
+		t.Fatalf("lease holder = %+v", lease.holder)
+	}
+	if got := runnerStatus(instDir); got == nil || got.ID != lease.holder.ID {
+		t.Fatalf("runnerStatus = %+v, want %s", got, lease.holder.ID)
+	}
+	if _, err := acquireRunnerLease(instDir, false, nil); err == nil || !strings.Contains(err.Error(), "another go runner is active") {
+		t.Fatalf("second runner should be refused, got %v", err)
+	}
+	// A dead PID in the payload of a held lease must not hand it out.
+	host, _ := os.Hostname()
+	writeLockPayload(lease.f, lockHolder{ID: "gone", PID: 1 << 30, Host: host})
+	if _, err := acquireRunnerLease(instDir, false, nil); err == nil {
+		t.Fatal("held lease with a dead payload should still refuse a second runner")
+	}
+	lease.release()
+	if got := runnerStatus(instDir); got != nil {
+		t.Fatalf("runnerStatus after release = %+v", got)
+	}
+	lease, err = acquireRunnerLease(instDir, false, nil)
+	if err != nil {
+		t.Fatalf("acquire after release: %v", err)
+	}
+	lease.release()
+}
+
+func TestRunnerLeaseRemoteHeartbeat(t *testing.T) {
+	instDir := t.TempDir()
+	path := filepath.Join(instDir, runnerLockName)
+	remote := lockHolder{ID: "other-1", PID: 1, Host: "some-other-host", HeartbeatAt: nowUTC()}
+	b, _ := json.Marshal(remote)
+	writeFileT(t, path, string(b))
+
+	if _, err := acquireRunnerLease(instDir, false, nil); err == nil || !strings.Contains(err.Error(), "some-other-host") {
+		t.Fatalf("fresh remote heartbeat should block, got %v", err)
+	}
+	if got := runnerStatus(instDir); got == nil || got.ID != "other-1" {
+		t.Fatalf("runnerStatus = %+v", got)
+	}
+
+	remote.HeartbeatAt = time.Now().Add(-2 * runnerLeaseTTL).UTC().Format(time.RFC3339)
+	b, _ = json.Marshal(remote)
+	writeFileT(t, path, string(b))
+	lease, err := acquireRunnerLease(instDir, false, nil)
+	if err != nil {
+		t.Fatalf("stale remote heartbeat should not block: %v", err)
+	}
+	lease.release()
+}
+
+func TestChangedTaskFields(t *testing.T) {
+	a := Task{ID: "OB-001", Title: "t", Spec: "s", Verify: verifyCommands([]string{"go test ./..."}), ModelHint: "codex", Priority: priorityMed}
+	b := a
+	b.DependsOn = []string{}
+	if got := changedTaskFields(a, b); len(got) != 0 {
+		t.Fatalf("nil vs empty depends_on should not count as a change: %v", got)
+	}
+	b.Spec = "new spec"
+	b.Verify = verifyCommands([]string{"go test ./...", "go vet ./..."})
+	b.Status = statusDone
+	if got := strings.Join(changedTaskFields(a, b), ","); got != "spec,verify" {
+		t.Fatalf("changedTaskFields = %q", got)
+	}
+}
+
+func TestEditTaskInEditor(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	script := filepath.Join(t.TempDir(), "editor.sh")
+	writeFileT(t, script, "#!/bin/sh\nsed -i.bak 's/old spec/new spec/' \"$1\"\n")
+	if err := os.Chmod(script, 0o755); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	t.Setenv("VISUAL", "")
+	t.Setenv("EDITOR", script)
+
+	task := Task{ID: "OB-001", Title: "t", Spec: "old spec", Verify: verifyCommands([]string{"true"}), ModelHint: "codex", Priority: priorityHigh}
+	raw, err := editTaskInEditor(task)
+	if err != nil {
+		t.Fatalf("editTaskInEditor: %v", err)
+	}
+	in, err := normalizeInput(raw)
+	if err != nil {
+		t.Fatalf("normalizeInput: %v", err)
+	}
+	if in.Spec != "new spec" || in.Priority != priorityHigh || in.Verify[0].Cmd != "true" {
+		t.Fatalf("edited input = %+v", in)
+	}
+}
+
+func TestRemoveMoveArchiveKeepIDsUnique(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := cmdInit([]string{"alpha"}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	instDir, err := resolveInstanceDir("alpha")
+	if err != nil {
+		t.Fatalf("resolveInstanceDir: %v", err)
+	}
+	in := func(title string, deps ...string) taskInput {
+		return taskInput{Title: title, Spec: "s", Verify: verifyCommands([]string{"true"}), ModelHint: "codex", Priority: priorityMed, DependsOn: deps, Source: "test"}
+	}
+	if _, err := addTasks("alpha", []taskInput{in("one"), in("two", "OB-001"), in("three"), in("four")}); err != nil {
+		t.Fatalf("addTasks: %v", err)
+	}
+	tasksPath := filepath.Join(instDir, "tasks.jsonl")
+	ids := func() string {
+		tasks, err := loadTasks(tasksPath)
+		if err != nil {
+			t.Fatalf("loadTasks: %v", err)
+		}
+		var out []string
+		for _, task := range tasks {
+			out = append(out, task.ID)
+		}
+		return strings.Join(out, ",")
+	}
+
+	if err := cmdMove([]string{"alpha", "OB-004", "--before", "OB-002"}); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if got := ids(); got != "OB-001,OB-004,OB-002,OB-003" {
+		t.Fatalf("order after move = %s", got)
+	}
+
+	if err := cmdRm([]string{"alpha", "OB-001"}); err == nil || !strings.Contains(err.Error(), "OB-002 depends on it") {
+		t.Fatalf("rm of a dependency should be refused, got %v", err)
+	}
+	if err := cmdRm([]string{"alpha", "OB-003"}); err != nil {
+		t.Fatalf("rm: %v", err)
+	}
+
+	tasks, _ := loadTasks(tasksPath)
+	tasks[findTaskIndex(tasks, "OB-001")].Status = statusDone
+	if err := saveTasks(tasksPath, tasks); err != nil {
+		t.Fatalf("saveTasks: %v", err)
+	}
+	if err := cmdArchive([]string{"alpha"}); err != nil {
+		t.Fatalf("archive: %v", err)
+	}
+	if got := ids(); got != "OB-004,OB-002" {
+		t.Fatalf("live tasks after archive = %s", got)
+	}
+	tasks, _ = loadTasks(tasksPath)
+	dependent := tasks[findTaskIndex(tasks, "OB-002")]
+	if len(dependent.DependsOn) != 0 {
+		t.Fatalf("dependency on archived done task should be dropped, got %v", dependent.DependsOn)
+	}
+	archived, _ := loadTasks(filepath.Join(instDir, archiveFileName))
+	if len(archived) != 1 || archived[0].ID != "OB-001" || archived[0].ArchivedAt == "" {
+		t.Fatalf("archive = %+v", archived)
+	}
+	if dependent.UpdatedAt != archived[0].ArchivedAt {
+		t.Fatalf("dependent updated_at = %q, want bumped to %q", dependent.UpdatedAt, archived[0].ArchivedAt)
+	}
+	// Rewriting a batch that was already archived replaces it.
+	if err := writeArchive(filepath.Join(instDir, archiveFileName), archived); err != nil {
+		t.Fatalf("writeArchive: %v", err)
+	}
+	if again, _ := loadTasks(filepath.Join(instDir, archiveFileName)); len(again) != 1 {
+		t.Fatalf("re-archiving duplicated entries: %+v", again)
+	}
+
+	if err := cmdRm([]string{"alpha", "OB-004", "OB-002"}); err != nil {
+		t.Fatalf("rm: %v", err)
+	}
+	added, err := addTasks("alpha", []taskInput{in("five", "OB-001")})
+	if err != nil {
+		t.Fatalf("addTasks after archive: %v", err)
+	}
+	if added[0].ID != "OB-005" || len(added[0].DependsOn) != 0 {
+		t.Fatalf("new task = %s deps %v, want OB-005 with the archived dependency dropped", added[0].ID, added[0].DependsOn)
+	}
+}
+
+func TestBulkResetAndSkipSelectors(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := cmdInit([]string{"alpha"}); err != nil {
+		t.Fatalf("init: %v", err)
+	}
+	instDir, err := resolveInstanceDir("alpha")
+	if err != nil {
+		t.Fatalf("resolveInstanceDir: %v", err)
+	}
+	var inputs []taskInput
+	for i := 0; i < 5; i++ {
+		model := "codex"
+		if i%2 == 1 {
+			model = "claude-opus"
+		}
+		inputs = append(inputs, taskInput{Title: fmt.Sprintf("t%d", i+1), Spec: "s", Verify: verifyCommands([]string{"true"}), ModelHint: model, Priority: priorityMed, Source: "test"})
+	}
+	if _, err := addTasks("alpha", inputs); err != nil {
+		t.Fatalf("addTasks: %v", err)
+	}
+	tasksPath := filepath.Join(instDir, "tasks.jsonl")
+	tasks, _ := loadTasks(tasksPath)
+	for i := range tasks {
+		tasks[i].Status = statusBlocked
+		tasks[i].Attempts = 2
+		tasks[i].LastError = "agent failed"
+	}
+	tasks[1].LastError = "Quota exceeded"
+	tasks[3].LastError = "quota exceeded"
+	if err := saveTasks(tasksPath, tasks); err != nil {
+		t.Fatalf("saveTasks: %v", err)
+	}
+	statuses := func() string {
+		tasks, err := loadTasks(tasksPath)
+		if err != nil {
+			t.Fatalf("loadTasks: %v", err)
+		}
+		var out []string
+		for _, task := range tasks {
+			out = append(out, task.Status)
+		}
+		return strings.Join(out, ",")
+	}
+
+	if err := cmdReset([]string{"alpha", "--error-contains", "quota", "--dry-run"}); err != nil {
+		t.Fatalf("dry-run reset: %v", err)
+	}
+	if got := statuses(); got != "blocked,blocked,blocked,blocked,blocked" {
+		t.Fatalf("dry-run changed tasks: %s", got)
+	}
+	if err := cmdReset([]string{"alpha", "OB-001..OB-003", "--error-contains", "quota", "--model", "Claude-Opus"}); err != nil {
+		t.Fatalf("reset: %v", err)
+	}
+	if got := statuses(); got != "blocked,todo,blocked,blocked,blocked" {
+		t.Fatalf("statuses after filtered reset = %s", got)
+	}
+	if err := cmdReset([]string{"alpha", "OB-001", "OB-004..OB-005"}); err != nil {
+		t.Fatalf("reset ids: %v", err)
+	}
+	if got := statuses(); got != "todo,todo,blocked,todo,todo" {
+		t.Fatalf("statuses after id reset = %s", got)
+	}
+	if err := cmdSkip([]string{"alpha", "--status", "todo", "--model", "codex", "--reason", "outage"}); err != nil {
+		t.Fatalf("skip: %v", err)
+	}
+	if got := statuses(); got != "blocked,todo,blocked,todo,blocked" {
+		t.Fatalf("statuses after skip = %s", got)
+	}
+
+	if err := cmdReset([]string{"alpha", "OB-002", "OB-009"}); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatalf("unknown id should fail the whole reset, got %v", err)
+	}
+	if err := cmdReset([]string{"alpha", "OB-005..OB-002"}); err == nil || !strings.Contains(err.Error(), "must be") {
+		t.Fatalf("descending range should be rejected, got %v", err)
+	}
+	if err := cmdReset([]string{"alpha", "--dry-run"}); err == nil || !strings.Contains(err.Error(), "required") {
+		t.Fatalf("reset without a selector should be rejected, got %v", err)
+	}
+}
+
+func TestListSelectAndSort(t *testing.T) {
+	tasks := []Task{
+		{ID: "OB-001", Title: "Add parser", Status: statusDone, Priority: priorityLow, Source: "planner", Attempts: 1, UpdatedAt: "2026-01-01T00:00:03Z"},
+		{ID: "OB-002", Title: "Fix lexer", Status: statusBlocked, Priority: priorityHigh, Source: "agent", Attempts: 3, LastError: "Quota exceeded", UpdatedAt: "2026-01-01T00:00:01Z"},
+		{ID: "OB-003", Title: "Docs", Spec: "document the parser", Status: statusTodo, Priority: priorityHigh, Source: "planner", UpdatedAt: "2026-01-01T00:00:02Z"},
+	}
+	ids := func(ts []Task) string {
+		var out []string
+		for _, t := range ts {
+			out = append(out, t.ID)
+		}
+		return strings.Join(out, ",")
+	}
+	pick := func(sel taskSelector) []Task {
+		idxs, err := selectTasks(tasks, sel, "alpha")
+		if err != nil {
+			t.Fatalf("selectTasks: %v", err)
+		}
+		var out []Task
+		for _, i := range idxs {
+			out = append(out, tasks[i])
+		}
+		return out
+	}
+	if got := ids(pick(taskSelector{Search: "parser"})); got != "OB-001,OB-003" {
+		t.Fatalf("search = %s", got)
+	}
+	if got := ids(pick(taskSelector{Source: "Planner", Statuses: map[string]bool{statusTodo: true}})); got != "OB-003" {
+		t.Fatalf("source+status = %s", got)
+	}
+
+	for by, want := range map[string]string{
+		"file":     "OB-001,OB-002,OB-003",
+		"priority": "OB-002,OB-003,OB-001",
+		"updated":  "OB-001,OB-003,OB-002",
+		"attempts": "OB-002,OB-001,OB-003",
+	} {
+		sorted := append([]Task(nil), tasks...)
+		if err := sortTasks(sorted, by); err != nil {
+			t.Fatalf("sortTasks(%s): %v", by, err)
+		}
+		if got := ids(sorted); got != want {
+			t.Fatalf("sortTasks(%s) = %s, want %s", by, got, want)
+		}
+	}
+	if err := sortTasks(tasks, "title"); err == nil {
+		t.Fatal("unknown sort key should be rejected")
+	}
+
+	var buf bytes.Buffer
+	if err := writeTasksCSV(&buf, tasks[1:2]); err != nil {
+		t.Fatalf("writeTasksCSV: %v", err)
+	}
+	if want := "id,status,priority,model_hint,attempts,source,updated_at,title,last_error\nOB-002,blocked,high,,3,agent,2026-01-01T00:00:01Z,Fix lexer,Quota exceeded\n"; buf.String() != want {
+		t.Fatalf("csv = %q", buf.String())
+	}
+	if got := truncateCell("line one\nline two is long", 12); got != "line one ..." {
+		t.Fatalf("truncateCell = %q", got)
+	}
+}
+
+func TestAutoCommitKeepsStateOut(t *testing.T) {
+	repo := initTestRepo(t)
+	stateDir := filepath.Join(repo, ".obliviate", "state")
+	if err := os.MkdirAll(filepath.Join(stateDir, "alpha"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFileT(t, filepath.Join(stateDir, "alpha", "tasks.jsonl"), "{}\n")
+	writeFileT(t, filepath.Join(repo, "work.txt"), "work\n")
+
+	rel, ignored, err := stateDirRel(repo, stateDir)
+	if err != nil || rel != ".obliviate/state" || ignored {
+		t.Fatalf("stateDirRel = %q, %v, %v", rel, ignored, err)
+	}
+	tmpl, err := parseCommitTemplate("feat: {{.Task.Title}}")
+	if err != nil {
+		t.Fatalf("parseCommitTemplate: %v", err)
+	}
+	cfg := goConfig{CommitTemplate: tmpl, StateRel: rel}
+	data := commitTemplateData{Instance: "alpha", Task: Task{ID: "OB-007", Title: "Add\nparser"}, RunID: "run-1", Provider: "codex", Model: "o3"}
+
+	// Uncommitted edits from before the task must not ride along.
+	if err := autoCommitClean(cfg, repo); err == nil || !strings.Contains(err.Error(), "work.txt") {
+		t.Fatalf("dirty tree should be refused naming the file, got %v", err)
+	}
+	sha, err := autoCommit(cfg, repo, data)
+	if err != nil {
+		t.Fatalf("autoCommit: %v", err)
+	}
+	if err := autoCommitClean(cfg, repo); err != nil {
+		t.Fatalf("clean tree with an untracked state dir excluded: %v", err)
+	}
+	if got := gitT(t, repo, "rev-parse", "HEAD"); got != sha {
+		t.Fatalf("autoCommit returned %s, HEAD is %s", sha, got)
+	}
+	want := "feat: Add\nparser\n\nObliviate-Instance: alpha\nObliviate-Task: OB-007\nObliviate-Title: Add parser\nObliviate-Model: codex/o3\nObliviate-Run: run-1"
+	if got := gitT(t, repo, "log", "-1", "--format=%B"); got != want {
+		t.Fatalf("commit message = %q", got)
+	}
+	if got := gitT(t, repo, "show", "--name-only", "--format=", "HEAD"); got != "work.txt" {
+		t.Fatalf("committed files = %q", got)
+	}
+
+	if sha, err := autoCommit(cfg, repo, data); err != nil || sha != "" {
+		t.Fatalf("autoCommit with nothing to commit = %q, %v", sha, err)
+	}
+
+	gitT(t, repo, "add", "-f", ".obliviate/state/alpha/tasks.jsonl")
+	if _, err := autoCommit(cfg, repo, data); err == nil || !strings.Contains(err.Error(), "allow-state-commit") {
+		t.Fatalf("staged state files should be refused, got %v", err)
+	}
+	cfg.AllowStateCommit = true
+	if sha, err := autoCommit(cfg, repo, data); err != nil || sha == "" {
+		t.Fatalf("autoCommit with --allow-state-commit = %q, %v", sha, err)
+	}
+
+	if _, err := parseCommitTemplate("{{.Task.Nope}}"); err == nil {
+		t.Fatal("template referencing an unknown field should fail at parse time")
+	}
+}
+
+// attemptTestConfig returns a go config for repo whose "stub" provider runs
+// script with sh, keeping obliviate's state outside the repository. The
+// tasks are saved already claimed and must use the "stub" model hint.
+func attemptTestConfig(t *testing.T, repo, script string, tasks ...Task) goConfig {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	home := t.TempDir()
+	instDir := filepath.Join(home, "state", "alpha")
+	if err := os.MkdirAll(instDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	reg := defaultProviderRegistry()
+	reg.Providers["stub"] = ProviderDef{Name: "stub", Command: "sh", Args: []string{"-c", script}, Prompt: promptViaStdin}
+	cfg := goConfig{
+		Instance:      "alpha",
+		InstDir:       instDir,
+		Home:          home,
+		Workdir:       repo,
+		TasksPath:     filepath.Join(instDir, "tasks.jsonl"),
+		RunsPath:      filepath.Join(instDir, "runs.jsonl"),
+		JSON:          true,
+		AgentTimeout:  time.Minute,
+		MaxAttempts:   2,
+		Providers:     reg,
+		VerifyTimeout: time.Minute,
+		VerifyMode:    verifyModeFirst,
+	}
+	for i := range tasks {
+		tasks[i].Status = statusInProgress
+	}
+	if err := saveTasks(cfg.TasksPath, tasks); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestRollbackWhenTaskRemovedMidRun(t *testing.T) {
+	repo := initTestRepo(t)
+	head := gitT(t, repo, "rev-parse", "HEAD")
+	task := Task{ID: "OB-001", Title: "gone", ModelHint: "stub"}
+	// The agent commits, leaves an edit behind, and removes its own task
+	// from the queue while it runs.
+	cfg := attemptTestConfig(t, repo, `cat >/dev/null; echo a > a.txt && git add a.txt && git commit -qm agent && echo b > b.txt && : > "$OB_TASKS"`, task)
+	t.Setenv("OB_TASKS", cfg.TasksPath)
+	cfg.RollbackOnFail = true
+
+	res, err := runTaskAttempt(context.Background(), cfg, task, repo, nil, nil)
+	if err != nil || res.Status != "" {
+		t.Fatalf("runTaskAttempt = %+v, %v; want removed", res, err)
+	}
+	if got := gitT(t, repo, "rev-parse", "HEAD"); got != head {
+		t.Fatalf("HEAD = %s, want rolled back to %s", got, head)
+	}
+	if status := gitT(t, repo, "status", "--porcelain"); status != "" {
+		t.Fatalf("workdir not restored:\n%s", status)
+	}
+	if files := gitT(t, repo, "show", "--name-only", "--format=", "refs/obliviate/alpha/OB-001/1"); files != "b.txt" {
+		t.Fatalf("saved ref should hold the leftover edit, got %q", files)
+	}
+}
+
+func TestInterruptAfterIntegrationKeepsWork(t *testing.T) {
+	repo := initTestRepo(t)
+	task := Task{ID: "OB-001", Title: "lands", ModelHint: "stub"}
+	cfg := attemptTestConfig(t, repo, `cat >/dev/null; echo a > a.txt && git add a.txt && git commit -qm agent`, task)
+	cfg.RollbackOnFail = true
+
+	// The signal arrives right after the work has landed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	res, err := runTaskAttempt(ctx, cfg, task, repo, func() (string, error) {
+		cancel()
+		return gitHead(repo)
+	}, nil)
+	if err != nil || res.Status != statusDone || res.Interrupted {
+		t.Fatalf("runTaskAttempt = %+v, %v; want done", res, err)
+	}
+	if got := gitT(t, repo, "log", "-1", "--format=%s"); got != "agent" {
+		t.Fatalf("HEAD = %q, want the landed agent commit", got)
+	}
+	if refs := gitT(t, repo, "for-each-ref", "refs/obliviate"); refs != "" {
+		t.Fatalf("landed work was rolled back: %s", refs)
+	}
+}
+
+func TestRollbackWorkdirRestoresSnapshot(t *testing.T) {
+	repo := initTestRepo(t)
+	writeFileT(t, filepath.Join(repo, ".gitignore"), ".obliviate/\n")
+	gitT(t, repo, "add", "-A")
+	gitT(t, repo, "commit", "-q", "-m", "ignore state")
+	stateDir := filepath.Join(repo, ".obliviate", "state")
+	if err := os.MkdirAll(stateDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFileT(t, filepath.Join(stateDir, "tasks.jsonl"), "{}\n")
+	rel, ignored, err := stateDirRel(repo, stateDir)
+	if err != nil || !ignored {
+		t.Fatalf("stateDirRel = %q, %v, %v", rel, ignored, err)
+	}
+
+	// The user's own edits before the task starts.
+	writeFileT(t, filepath.Join(repo, "base.txt"), "user edit\n")
+	writeFileT(t, filepath.Join(repo, "staged.txt"), "staged\n")
+	gitT(t, repo, "add", "staged.txt")
+	writeFileT(t, filepath.Join(repo, "notes.txt"), "mine\n")
+	statusBefore := gitT(t, repo, "status", "--porcelain")
+	head := gitT(t, repo, "rev-parse", "HEAD")
+
+	snap, err := snapshotWorkdir(repo, "")
+	if err != nil {
+		t.Fatalf("snapshotWorkdir: %v", err)
+	}
+	if got := gitT(t, repo, "status", "--porcelain"); got != statusBefore {
+		t.Fatalf("snapshot changed the index:\n%s", got)
+	}
+
+	// The failed attempt commits, edits, and leaves junk behind.
+	writeFileT(t, filepath.Join(repo, "task.txt"), "task\n")
+	gitT(t, repo, "add", "task.txt")
+	gitT(t, repo, "commit", "-q", "-m", "task work")
+	writeFileT(t, filepath.Join(repo, "base.txt"), "agent edit\n")
+	writeFileT(t, filepath.Join(repo, "junk.txt"), "junk\n")
+
+	ref := rollbackRef(repo, "alpha", "OB-001", 1)
+	saved, err := rollbackWorkdir(repo, "", snap, ref, "failed attempt")
+	if err != nil || saved != "refs/obliviate/alpha/OB-001/1" {
+		t.Fatalf("rollbackWorkdir = %q, %v", saved, err)
+	}
+	if got := gitT(t, repo, "rev-parse", "HEAD"); got != head {
+		t.Fatalf("HEAD after rollback = %s, want %s", got, head)
+	}
+	if got := gitT(t, repo, "status", "--porcelain"); got != statusBefore {
+		t.Fatalf("status after rollback:\n%s\nwant:\n%s", got, statusBefore)
+	}
+	if b, _ := os.ReadFile(filepath.Join(repo, "base.txt")); string(b) != "user edit\n" {
+		t.Fatalf("base.txt after rollback = %q", b)
+	}
+	if _, err := os.Stat(filepath.Join(stateDir, "tasks.jsonl")); err != nil {
+		t.Fatalf("state file removed by rollback: %v", err)
+	}
+	if got := gitT(t, repo, "show", saved+":base.txt"); got != "agent edit" {
+		t.Fatalf("saved ref base.txt = %q", got)
+	}
+	if got := gitT(t, repo, "log", "-1", "--format=%s", saved+"^"); got != "task work" {
+		t.Fatalf("saved ref parent = %q", got)
+	}
+	if next := rollbackRef(repo, "alpha", "OB-001", 1); next != "refs/obliviate/alpha/OB-001/1-2" {
+		t.Fatalf("rollbackRef reused a taken ref: %s", next)
+	}
+
+	snap, err = snapshotWorkdir(repo, "")
+	if err != nil {
+		t.Fatalf("snapshotWorkdir: %v", err)
+	}
+	if saved, err := rollbackWorkdir(repo, "", snap, "refs/obliviate/alpha/OB-002/1", "unchanged"); err != nil || saved != "" {
+		t.Fatalf("rollback of an attempt that changed nothing = %q, %v", saved, err)
+	}
+}
+
+func TestTaskBranchCheckoutAndMerge(t *testing.T) {
+	repo := initTestRepo(t)
+	target := currentBranch(repo)
+	commit := func(name, content string) {
+		writeFileT(t, filepath.Join(repo, name), content)
+		gitT(t, repo, "add", "-A")
+		gitT(t, repo, "commit", "-q", "-m", name)
+	}
+
+	branch := taskBranchName(branchModeTask, "alpha", "OB-001")
+	if err := checkoutTaskBranch(repo, "", branch, target); err != nil {
+		t.Fatalf("checkoutTaskBranch: %v", err)
+	}
+	commit("task.txt", "task\n")
+	// The target moves on while the task runs; ff rebases onto it.
+	gitT(t, repo, "checkout", "-q", target)
+	commit("other.txt", "other\n")
+	gitT(t, repo, "checkout", "-q", branch)
+
+	tip, err := mergeTaskBranch(repo, "", branch, target, mergeStrategyFF, "unused")
+	if err != nil {
+		t.Fatalf("mergeTaskBranch ff: %v", err)
+	}
+	if got := currentBranch(repo); got != target {
+		t.Fatalf("after merge on %s, want %s", got, target)
+	}
+	if got := gitT(t, repo, "rev-parse", "HEAD"); got != tip {
+		t.Fatalf("ff merge returned %s, target is at %s", tip, got)
+	}
+	if got := gitT(t, repo, "log", "-1", "--format=%P"); strings.Contains(got, " ") {
+		t.Fatalf("ff strategy created a merge commit")
+	}
+
+	branch = taskBranchName(branchModeTask, "alpha", "OB-002")
+	if err := checkoutTaskBranch(repo, "", branch, target); err != nil {
+		t.Fatalf("checkoutTaskBranch: %v", err)
+	}
+	commit("base.txt", "from task\n")
+	gitT(t, repo, "checkout", "-q", target)
+	commit("base.txt", "from target\n")
+	targetHead := gitT(t, repo, "rev-parse", "HEAD")
+	gitT(t, repo, "checkout", "-q", branch)
+	branchHead := gitT(t, repo, "rev-parse", "HEAD")
+
+	_, err = mergeTaskBranch(repo, "", branch, target, mergeStrategyMerge, "Merge OB-002")
+	if err == nil || !strings.Contains(err.Error(), "base.txt") {
+		t.Fatalf("expected merge conflict naming base.txt, got %v", err)
+	}
+	if got := currentBranch(repo); got != branch {
+		t.Fatalf("after conflict on %s, want the task branch", got)
+	}
+	if got := gitT(t, repo, "rev-parse", "HEAD"); got != branchHead {
+		t.Fatalf("task branch moved after conflict")
+	}
+	if got := gitT(t, repo, "rev-parse", target); got != targetHead {
+		t.Fatalf("target moved after conflict")
+	}
+
+	writeFileT(t, filepath.Join(repo, "wip.txt"), "wip\n")
+	if err := checkoutTaskBranch(repo, "", taskBranchName(branchModeTask, "alpha", "OB-003"), target); err == nil || !strings.Contains(err.Error(), "uncommitted") {
+		t.Fatalf("switching branches with a dirty tree should fail, got %v", err)
+	}
+	if err := checkoutTaskBranch(repo, "", branch, target); err != nil {
+		t.Fatalf("staying on the current branch should not need a clean tree: %v", err)
+	}
+}
+
+// branchAgentScript commits "<id> try <n>" to <id>.txt on the n-th call for
+// a task, counting calls in $OB_COUNT. On its first try OB-001 also leaves
+// an uncommitted edit to base.txt behind.
+const branchAgentScript = `id=$(grep -o '"id": "OB-[0-9]*"' | head -1 | grep -o 'OB-[0-9]*')
+n=$(( $(cat "$OB_COUNT/$id" 2>/dev/null || echo 0) + 1 )); echo "$n" > "$OB_COUNT/$id"
+echo "$id try $n" > "$id.txt" && git add "$id.txt" && git commit -qm "$id try $n"
+if [ "$id" = OB-001 ] && [ "$n" = 1 ]; then echo leftover >> base.txt; fi`
+
+// reloadTask returns the task as saved, for the next attempt.
+func reloadTask(t *testing.T, cfg goConfig, id string) Task {
+	t.Helper()
+	tasks, err := loadTasks(cfg.TasksPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	task := tasks[findTaskIndex(tasks, id)]
+	task.Status = statusInProgress
+	return task
+}
+
+func TestTaskBranchFailureKeepsRunGoing(t *testing.T) {
+	repo := initTestRepo(t)
+	t.Setenv("OB_COUNT", t.TempDir())
+	target := currentBranch(repo)
+	// OB-001 passes only on its second try.
+	first := Task{ID: "OB-001", Title: "flaky", ModelHint: "stub", Verify: verifyCommands([]string{"grep -q 'try 2' OB-001.txt"})}
+	second := Task{ID: "OB-002", Title: "passes", ModelHint: "stub", Verify: verifyCommands([]string{"true"})}
+	cfg := attemptTestConfig(t, repo, branchAgentScript, first, second)
+	cfg.BranchMode, cfg.TargetBranch, cfg.MergeStrategy = branchModeTask, target, mergeStrategyFF
+
+	res, err := runTaskInWorkdir(context.Background(), cfg, first)
+	if err != nil || res.Status != statusFailed {
+		t.Fatalf("first task = %+v, %v; want failed", res, err)
+	}
+	if got := currentBranch(repo); got != target {
+		t.Fatalf("after a failure on %s, want %s", got, target)
+	}
+	kept := taskBranchName(branchModeTask, "alpha", "OB-001") + "-attempt-1"
+	if got := reloadTask(t, cfg, "OB-001").Branch; got != kept {
+		t.Fatalf("task branch = %q, want the failed attempt kept as %q", got, kept)
+	}
+	if log := gitT(t, repo, "log", "--format=%s", target+".."+kept); !strings.HasPrefix(log, "WIP OB-001") || !strings.HasSuffix(log, "OB-001 try 1") {
+		t.Fatalf("kept branch log = %q, want the attempt and its WIP leftovers", log)
+	}
+
+	res, err = runTaskInWorkdir(context.Background(), cfg, second)
+	if err != nil || res.Status != statusDone {
+		t.Fatalf("second task = %+v, %v; want done", res, err)
+	}
+
+	// The retry starts from the target, so nothing from the failed attempt
+	// lands with it.
+	res, err = runTaskInWorkdir(context.Background(), cfg, reloadTask(t, cfg, "OB-001"))
+	if err != nil || res.Status != statusDone {
+		t.Fatalf("retry = %+v, %v; want done", res, err)
+	}
+	if log := gitT(t, repo, "log", "--format=%s", target); log != "OB-001 try 2\nOB-002 try 1\nbase" {
+		t.Fatalf("target log = %q", log)
+	}
+	if got := gitT(t, repo, "show", target+":base.txt"); got != "base" {
+		t.Fatalf("base.txt on target = %q, want the leftover kept off it", got)
+	}
+}
+
+func TestInstanceBranchFailureSavesLeftovers(t *testing.T) {
+	repo := initTestRepo(t)
+	t.Setenv("OB_COUNT", t.TempDir())
+	target := currentBranch(repo)
+	first := Task{ID: "OB-001", Title: "fails", ModelHint: "stub", Verify: verifyCommands([]string{"false"})}
+	second := Task{ID: "OB-002", Title: "passes", ModelHint: "stub", Verify: verifyCommands([]string{"true"})}
+	cfg := attemptTestConfig(t, repo, branchAgentScript, first, second)
+	cfg.BranchMode, cfg.TargetBranch, cfg.MergeStrategy = branchModeInstance, target, mergeStrategyFF
+
+	if res, err := runTaskInWorkdir(context.Background(), cfg, first); err != nil || res.Status != statusFailed {
+		t.Fatalf("first task = %+v, %v; want failed", res, err)
+	}
+	if status := gitT(t, repo, "status", "--porcelain"); status != "" {
+		t.Fatalf("leftovers should be cleared from the instance branch:\n%s", status)
+	}
+	if got := gitT(t, repo, "show", "refs/obliviate/alpha/OB-001/1:base.txt"); got != "base\nleftover" {
+		t.Fatalf("saved leftovers = %q", got)
+	}
+	if res, err := runTaskInWorkdir(context.Background(), cfg, second); err != nil || res.Status != statusDone {
+		t.Fatalf("second task = %+v, %v; want done after the failure", res, err)
+	}
+}
+
+func TestRecordGitFacts(t *testing.T) {
+	repo := initTestRepo(t)
+	base := gitT(t, repo, "rev-parse", "HEAD")
+	writeFileT(t, filepath.Join(repo, "a.txt"), "one\ntwo\n")
+	gitT(t, repo, "add", "a.txt")
+	gitT(t, repo, "commit", "-q", "-m", "add a")
+	writeFileT(t, filepath.Join(repo, "base.txt"), "changed\n")
+	gitT(t, repo, "commit", "-q", "-am", "edit base")
+	writeFileT(t, filepath.Join(repo, "a.txt"), "one\n")
+	writeFileT(t, filepath.Join(repo, "new.txt"), "new\n")
+	if err := os.MkdirAll(filepath.Join(repo, ".obliviate"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeFileT(t, filepath.Join(repo, ".obliviate", "learnings.md"), "x\n")
+
+	var run RunLog
+	recordGitFacts(&run, repo, base)
+	if run.HeadBefore != base || run.HeadAfter != gitT(t, repo, "rev-parse", "HEAD") {
+		t.Fatalf("heads = %s..%s", run.HeadBefore, run.HeadAfter)
+	}
+	if len(run.Commits) != 2 || run.Commits[0].Subject != "add a" || run.Commits[1].Subject != "edit base" {
+		t.Fatalf("commits = %+v", run.Commits)
+	}
+	want := []fileChange{
+		{Path: "a.txt", Insertions: 1},
+		{Path: "base.txt", Insertions: 1, Deletions: 1},
+		{Path: "new.txt", Untracked: true},
+	}
+	if !reflect.DeepEqual(run.Files, want) {
+		t.Fatalf("files = %+v", run.Files)
+	}
+	if !run.Dirty {
+		t.Fatal("expected dirty tree")
+	}
+
+	// A rebase onto a moved target rewrites both SHAs.
+	gitT(t, repo, "stash", "-u", "-q")
+	gitT(t, repo, "checkout", "-q", "-b", "moved", base)
+	writeFileT(t, filepath.Join(repo, "other.txt"), "other\n")
+	gitT(t, repo, "add", "other.txt")
+	gitT(t, repo, "commit", "-q", "-m", "other")
+	gitT(t, repo, "cherry-pick", run.Commits[0].SHA, run.Commits[1].SHA)
+	landed := landedCommits(repo, gitT(t, repo, "rev-parse", "HEAD"), run.Commits)
+	if len(landed) != 2 || landed[1].SHA == run.Commits[1].SHA || landed[0].Subject != "add a" {
+		t.Fatalf("landed = %+v", landed)
+	}
+
+	runs := []RunLog{
+		{RunID: "r1", TaskID: "OB-001", Status: statusFailed, Commits: run.Commits[:1]},
+		{RunID: "r2", TaskID: "OB-002", Status: statusDone, Commits: []runCommit{{SHA: "x", Subject: "other task"}}},
+		{RunID: "r3", TaskID: "OB-001", Status: statusDone, Commits: landed},
+	}
+	got := taskCommits(runs, "OB-001")
+	if len(got) != 3 || got[0].RunID != "r1" || got[0].Status != statusFailed || got[2].SHA != landed[1].SHA {
+		t.Fatalf("taskCommits = %+v", got)
+	}
+}
+
+func TestRevertUndoesLandedWork(t *testing.T) {
+	for _, mode := range []string{branchModeTask, ""} {
+		t.Run(orDash(mode), func(t *testing.T) {
+			repo := initTestRepo(t)
+			t.Setenv("OB_COUNT", t.TempDir())
+			before := gitT(t, repo, "rev-parse", "HEAD^{tree}")
+			task := Task{ID: "OB-001", Title: "flaky", ModelHint: "stub", Verify: verifyCommands([]string{"grep -q 'try 2' OB-001.txt"})}
+			cfg := attemptTestConfig(t, repo, branchAgentScript, task)
+			if mode != "" {
+				cfg.BranchMode, cfg.TargetBranch, cfg.MergeStrategy = mode, currentBranch(repo), mergeStrategyFF
+			}
+
+			if res, err := runTaskInWorkdir(context.Background(), cfg, task); err != nil || res.Status != statusFailed {
+				t.Fatalf("first attempt = %+v, %v; want failed", res, err)
+			}
+			if mode == "" {
+				// Without a branch the failed commit stays; drop only the leftover edit.
+				gitT(t, repo, "checkout", "--", "base.txt")
+			}
+			if res, err := runTaskInWorkdir(context.Background(), cfg, reloadTask(t, cfg, "OB-001")); err != nil || res.Status != statusDone {
+				t.Fatalf("retry = %+v, %v; want done", res, err)
+			}
+
+			runs, err := loadRuns(cfg.RunsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			commits, err := revertableCommits(repo, runs, "OB-001")
+			if err != nil {
+				t.Fatalf("revertableCommits: %v", err)
+			}
+			if _, err := revertCommits(repo, gitT(t, repo, "rev-parse", "HEAD"), commits); err != nil {
+				t.Fatalf("revertCommits: %v", err)
+			}
+			if got := gitT(t, repo, "rev-parse", "HEAD^{tree}"); got != before {
+				t.Fatalf("tree after revert differs from before the task:\n%s", gitT(t, repo, "diff", "--stat", before, got))
+			}
+		})
+	}
+}
+
+func TestRevertCommits(t *testing.T) {
+	repo := initTestRepo(t)
+	commit := func(name, content string) runCommit {
+		writeFileT(t, filepath.Join(repo, name), content)
+		gitT(t, repo, "add", "-A")
+		gitT(t, repo, "commit", "-q", "-m", "write "+name)
+		return runCommit{SHA: gitT(t, repo, "rev-parse", "HEAD"), Subject: "write " + name}
+	}
+	first := commit("a.txt", "a1\n")
+	second := commit("a.txt", "a2\n")
+	third := commit("b.txt", "b\n")
+
+	runs := []RunLog{
+		{TaskID: "OB-001", Status: statusDone, Commits: []runCommit{first}},
+		{TaskID: "OB-001", Status: runStatusReverted},
+		{TaskID: "OB-001", Status: statusFailed, Commits: []runCommit{{SHA: "f"}}},
+		{TaskID: "OB-001", Status: statusDone, Commits: []runCommit{second}},
+		{TaskID: "OB-002", Status: statusDone, Commits: []runCommit{third}},
+		{TaskID: "OB-001", Status: statusDone, Commits: []runCommit{third}},
+	}
+	got, err := revertableCommits(repo, runs, "OB-001")
+	if err != nil || len(got) != 2 || got[0] != second || got[1] != third {
+		t.Fatalf("revertableCommits = %+v", got)
+	}
+
+	head := gitT(t, repo, "rev-parse", "HEAD")
+	created, err := revertCommits(repo, head, got)
+	if err != nil {
+		t.Fatalf("revertCommits: %v", err)
+	}
+	if len(created) != 2 || created[0].Subject != `Revert "write b.txt"` || created[1].Subject != `Revert "write a.txt"` {
+		t.Fatalf("created = %+v", created)
+	}
+	if b, _ := os.ReadFile(filepath.Join(repo, "a.txt")); string(b) != "a1\n" {
+		t.Fatalf("a.txt after revert = %q", b)
+	}
+	if _, err := os.Stat(filepath.Join(repo, "b.txt")); !os.IsNotExist(err) {
+		t.Fatalf("b.txt should be gone after revert, stat err: %v", err)
+	}
+
+	// Reverting first now conflicts with the later edits; nothing may change.
+	commit("a.txt", "a3\n")
+	head = gitT(t, repo, "rev-parse", "HEAD")
+	if _, err := revertCommits(repo, head, []runCommit{first, third}); err == nil || !strings.Contains(err.Error(), "nothing was changed") {
+		t.Fatalf("expected conflicting revert to fail cleanly, got %v", err)
+	}
+	if got := gitT(t, repo, "rev-parse", "HEAD"); got != head {
+		t.Fatalf("HEAD moved after failed revert: %s != %s", got, head)
+	}
+	if status := gitT(t, repo, "status", "--porcelain"); status != "" {
+		t.Fatalf("tree left dirty after failed revert:\n%s", status)
+	}
+}